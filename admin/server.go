@@ -0,0 +1,114 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/sirupsen/logrus"
+)
+
+var globalRegistry = &handlerRegistry{
+	pathToHandler: make(map[string]http.HandlerFunc),
+}
+
+// handlerRegistry stores the mapping from the url path to the admin handler.
+type handlerRegistry struct {
+	mu            sync.RWMutex
+	pathToHandler map[string]http.HandlerFunc
+}
+
+// Register an admin handler on the path, the previous handler on the same path is replaced.
+func Register(path string, handler http.HandlerFunc) {
+	globalRegistry.mu.Lock()
+	defer globalRegistry.mu.Unlock()
+	globalRegistry.pathToHandler[path] = handler
+}
+
+func (r *handlerRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	handler, ok := r.pathToHandler[req.URL.Path]
+	r.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	handler(w, req)
+}
+
+// RenderJSON writes v into the response in json format.
+func RenderJSON(w http.ResponseWriter, v interface{}) {
+	RenderJSONWithStatus(w, http.StatusOK, v)
+}
+
+// RenderJSONWithStatus is like RenderJSON, but responds with the given status code.
+func RenderJSONWithStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("failed to render admin response: %s", err)
+	}
+}
+
+// RenderError writes the error message into the response in json format, e.g. {"error": "..."}.
+func RenderError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	RenderJSONWithStatus(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// handleConfig shows the effective configuration, including the default values and the reloaded options.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	RenderJSON(w, config.Current())
+}
+
+var adminHTTPServer *http.Server
+
+// Init starts the admin http server if `admin.address` is configured.
+func Init() {
+	addr := config.GlobalConfig.AdminOpts.Address
+	if addr == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logrus.Fatalf("start admin server error: %s", err)
+	}
+	logrus.Infof("start admin server listen: %s", ln.Addr())
+	Register("/config", handleConfig)
+	adminHTTPServer = &http.Server{Handler: globalRegistry}
+	go func() {
+		if err := adminHTTPServer.Serve(ln); err != http.ErrServerClosed {
+			logrus.Fatal(err)
+		}
+	}()
+}
+
+// Close stops the admin http server.
+func Close(ctx context.Context) error {
+	if adminHTTPServer == nil {
+		return nil
+	}
+	return adminHTTPServer.Shutdown(ctx)
+}
@@ -0,0 +1,71 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandlerRegistry(t *testing.T) {
+	Register("/test", func(w http.ResponseWriter, r *http.Request) {
+		RenderJSON(w, map[string]string{"path": r.URL.Path})
+	})
+
+	server := httptest.NewServer(globalRegistry)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/test")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	recorder := httptest.NewRecorder()
+	globalRegistry.ServeHTTP(recorder, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, "{\"path\":\"/test\"}\n", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	globalRegistry.ServeHTTP(recorder, httptest.NewRequest("GET", "/notExist", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestAdminConfig(t *testing.T) {
+	config.Init("../config/yaml/meta-proxy-example.yml")
+	recorder := httptest.NewRecorder()
+	handleConfig(recorder, httptest.NewRequest("GET", "/config", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var cfg map[string]map[string]interface{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &cfg))
+	assert.Equal(t, "zookeeper", cfg["route"]["type"])
+	assert.Equal(t, float64(10000), cfg["server"]["max_request_timeout"])
+	assert.Equal(t, "127.0.0.1:9092", cfg["admin"]["address"])
+
+	recorder = httptest.NewRecorder()
+	RenderError(recorder, http.StatusBadRequest, "table \"%s\" is invalid", "temp")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "{\"error\":\"table \\\"temp\\\" is invalid\"}\n", recorder.Body.String())
+}
@@ -0,0 +1,131 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// version is set at build time by `-ldflags "-X main.version=..."`.
+var version = "dev"
+
+const usage = `Usage:
+  meta-proxy serve [--config <file>] [--log-file <file>] [--log-level <level>] [--dry-run]
+  meta-proxy validate-config [--config <file>]
+  meta-proxy version
+  meta-proxy help
+  meta-proxy <config file> [log file]    (deprecated, same as serve)
+
+Commands:
+  serve            start the proxy, it's the default command
+  validate-config  check the config file and exit, all the problems are reported at once
+  version          print the version
+  help             print this help
+
+The flags can also be set by the environment variables:
+  META_PROXY_CONFIG, META_PROXY_LOG_FILE, META_PROXY_LOG_LEVEL
+and the options in config file can be overridden by META_PROXY_<SECTION>_<KEY>, e.g. META_PROXY_ZOOKEEPER_ROOT.
+The log is written to stdout if the log file is empty or "-".
+"serve --dry-run" validates the config file and prints the effective config (defaults filled) without serving.
+`
+
+const (
+	envConfig   = "META_PROXY_CONFIG"
+	envLogFile  = "META_PROXY_LOG_FILE"
+	envLogLevel = "META_PROXY_LOG_LEVEL"
+)
+
+// cliOptions is the options parsed from the command line.
+type cliOptions struct {
+	command    string
+	configFile string
+	logFile    string
+	logLevel   string
+	dryRun     bool
+}
+
+var errHelp = errors.New("help requested")
+
+// parseArgs parses the command line arguments (without the program name). errHelp is returned if the help
+// is requested, the usage has been printed into out.
+func parseArgs(args []string, out io.Writer) (*cliOptions, error) {
+	opts := &cliOptions{command: "serve"}
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve", "validate-config", "version":
+			opts.command = args[0]
+			args = args[1:]
+		case "help", "-h", "-help", "--help":
+			fmt.Fprint(out, usage)
+			return nil, errHelp
+		}
+	}
+	if opts.command == "version" {
+		return opts, nil
+	}
+
+	fs := flag.NewFlagSet("meta-proxy "+opts.command, flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprint(out, usage)
+	}
+	fs.StringVar(&opts.configFile, "config", os.Getenv(envConfig), "the config file")
+	if opts.command == "serve" {
+		fs.StringVar(&opts.logFile, "log-file", os.Getenv(envLogFile), "the log file, stdout if it's empty or \"-\"")
+		fs.StringVar(&opts.logLevel, "log-level", getEnvOr(envLogLevel, "info"), "the log level")
+		fs.BoolVar(&opts.dryRun, "dry-run", false, "validate the config and print the effective config, then exit")
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, errHelp
+		}
+		return nil, err
+	}
+
+	// the deprecated positional form: meta-proxy <config file> <log file>
+	positional := fs.Args()
+	if len(positional) > 0 && opts.command == "serve" {
+		opts.configFile = positional[0]
+		positional = positional[1:]
+		if len(positional) > 0 {
+			opts.logFile = positional[0]
+			positional = positional[1:]
+		}
+	}
+	if len(positional) > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(positional, " "))
+	}
+	if opts.configFile == "" {
+		return nil, fmt.Errorf("config file is required, set it by --config or %s", envConfig)
+	}
+	return opts, nil
+}
+
+func getEnvOr(key string, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return defaultValue
+}
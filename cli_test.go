@@ -0,0 +1,106 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArgs(t *testing.T) {
+	var out bytes.Buffer
+	opts, err := parseArgs([]string{"serve", "--config", "meta-proxy.yml", "--log-file", "meta-proxy.log",
+		"--log-level", "debug"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, &cliOptions{command: "serve", configFile: "meta-proxy.yml", logFile: "meta-proxy.log",
+		logLevel: "debug"}, opts)
+
+	// serve is the default command, and the log is written to stdout by default
+	opts, err = parseArgs([]string{"-config=meta-proxy.yml"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, &cliOptions{command: "serve", configFile: "meta-proxy.yml", logLevel: "info"}, opts)
+
+	// the deprecated positional form
+	opts, err = parseArgs([]string{"meta-proxy.yml", "meta-proxy.log"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, &cliOptions{command: "serve", configFile: "meta-proxy.yml", logFile: "meta-proxy.log",
+		logLevel: "info"}, opts)
+
+	opts, err = parseArgs([]string{"validate-config", "--config", "meta-proxy.yml"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, &cliOptions{command: "validate-config", configFile: "meta-proxy.yml"}, opts)
+	opts, err = parseArgs([]string{"serve", "--config", "meta-proxy.yml", "--dry-run"}, &out)
+	assert.Nil(t, err)
+	assert.True(t, opts.dryRun)
+	opts, err = parseArgs([]string{"version"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "version", opts.command)
+
+	_, err = parseArgs([]string{"serve"}, &out)
+	assert.NotNil(t, err)
+	_, err = parseArgs([]string{"validate-config", "--log-file", "meta-proxy.log"}, &out)
+	assert.NotNil(t, err)
+	_, err = parseArgs([]string{"a.yml", "a.log", "unexpected"}, &out)
+	assert.NotNil(t, err)
+
+	out.Reset()
+	_, err = parseArgs([]string{"help"}, &out)
+	assert.Equal(t, errHelp, err)
+	assert.Contains(t, out.String(), "meta-proxy validate-config")
+	out.Reset()
+	_, err = parseArgs([]string{"serve", "--help"}, &out)
+	assert.Equal(t, errHelp, err)
+	assert.Contains(t, out.String(), "Usage:")
+}
+
+func TestParseArgsFromEnv(t *testing.T) {
+	os.Setenv(envConfig, "env.yml")
+	os.Setenv(envLogLevel, "warn")
+	defer os.Unsetenv(envConfig)
+	defer os.Unsetenv(envLogLevel)
+
+	var out bytes.Buffer
+	opts, err := parseArgs([]string{}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, &cliOptions{command: "serve", configFile: "env.yml", logLevel: "warn"}, opts)
+
+	// the flags take precedence over the environment variables
+	opts, err = parseArgs([]string{"--config", "flag.yml", "--log-level", "error"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, &cliOptions{command: "serve", configFile: "flag.yml", logLevel: "error"}, opts)
+}
+
+func TestInitLog(t *testing.T) {
+	assert.NotNil(t, initLog("", "unknown"))
+	assert.Nil(t, initLog("-", "info"))
+}
+
+func TestDryRun(t *testing.T) {
+	var out bytes.Buffer
+	assert.Nil(t, dryRun("config/yaml/meta-proxy-example.yml", &out))
+	assert.Contains(t, out.String(), `"table_watcher_cache_capacity": 1024`)
+
+	out.Reset()
+	assert.NotNil(t, dryRun("config/yaml/not-exist.yml", &out))
+	assert.Empty(t, out.String())
+}
@@ -20,47 +20,311 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 // zookeeperOpts is the configuration for zookeeper client.
 type zookeeperOpts struct {
-	Address      []string `mapstructure:"address"`
-	Root         string   `mapstructure:"root"`
-	Timeout      int      `mapstructure:"timeout"`
-	WatcherCount int      `mapstructure:"table_watcher_cache_capacity"`
+	Address      []string `mapstructure:"address" json:"address"`
+	Root         string   `mapstructure:"root" json:"root"`
+	Timeout      int      `mapstructure:"timeout" json:"timeout"`
+	WatcherCount int      `mapstructure:"table_watcher_cache_capacity" json:"table_watcher_cache_capacity"`
+}
+
+// etcdOpts is the configuration for etcd client.
+type etcdOpts struct {
+	Endpoints []string `mapstructure:"endpoints" json:"endpoints"`
+	Root      string   `mapstructure:"root" json:"root"`
+	Timeout   int      `mapstructure:"timeout" json:"timeout"` // ms
+}
+
+// routeOpts is the configuration for the store of the table routes, which map the table to its cluster.
+type routeOpts struct {
+	Type string `mapstructure:"type" json:"type"` // "zookeeper", "etcd" or "file"
+	File string `mapstructure:"file" json:"file"` // the route file path if type is "file"
+	// load all the table routes at start rather than on the first request of each table
+	WarmUp bool `mapstructure:"warm_up" json:"warm_up"`
+	// the local file to persist the table routes, which is used to start when the route store is unavailable
+	SnapshotFile     string `mapstructure:"snapshot_file" json:"snapshot_file"`
+	SnapshotInterval int    `mapstructure:"snapshot_interval" json:"snapshot_interval"` // ms
+}
+
+// configCacheOpts is the configuration for caching the partition configuration responses of meta servers.
+type configCacheOpts struct {
+	Enable   bool `mapstructure:"enable" json:"enable"`
+	TTL      int  `mapstructure:"ttl" json:"ttl"` // ms
+	Capacity int  `mapstructure:"capacity" json:"capacity"`
+}
+
+// metaOpts is the configuration for the connections to meta servers.
+type metaOpts struct {
+	// CheckInterval(ms) is the interval to probe the meta servers.
+	CheckInterval int `mapstructure:"check_interval" json:"check_interval"`
+	CheckTimeout  int `mapstructure:"check_timeout" json:"check_timeout"` // ms
+}
+
+// failoverOpts is the configuration for switching the tables to their backup clusters once the primary
+// clusters are unhealthy.
+type failoverOpts struct {
+	CheckInterval int `mapstructure:"check_interval" json:"check_interval"` // ms
+	CheckTimeout  int `mapstructure:"check_timeout" json:"check_timeout"`   // ms
+	// FailureThreshold is the number of consecutive failed checks to switch to the backup cluster.
+	FailureThreshold int `mapstructure:"failure_threshold" json:"failure_threshold"`
+	// RecoveryThreshold is the number of consecutive successful checks to switch back to the primary cluster.
+	RecoveryThreshold int `mapstructure:"recovery_threshold" json:"recovery_threshold"`
 }
 
 // metricsOpts used for init the perfCounter type(now support the Falcon and Prometheus) and
 type metricsOpts struct {
-	Type string   `mapstructure:"type"`
-	Tags []string `mapstructure:"tags"`
+	// Type is the single metric sink, it's deprecated by Types and used only if Types is not set.
+	Type string `mapstructure:"type" json:"type"`
+	// Types is the metric sinks which all the counters are reported to, e.g. [falcon, prometheus].
+	Types []string `mapstructure:"types" json:"types"`
+	Tags  []string `mapstructure:"tags" json:"tags"`
+	// PromAddress is the address the prometheus http server listens on, only used for type "prometheus".
+	PromAddress string `mapstructure:"prometheus_address" json:"prometheus_address"`
+	// HistogramBuckets is the prometheus buckets of the histograms keyed by counter name, e.g. the latency
+	// in microseconds.
+	HistogramBuckets map[string][]float64 `mapstructure:"histogram_buckets" json:"histogram_buckets"`
+	Statsd           statsdOpts           `mapstructure:"statsd" json:"statsd"`
+}
+
+// statsdOpts is the configuration for reporting to the StatsD agent over udp, only used for type "statsd".
+type statsdOpts struct {
+	Address string `mapstructure:"address" json:"address"`
+	// Prefix is prepended to the counter names, e.g. "meta_proxy.".
+	Prefix string `mapstructure:"prefix" json:"prefix"`
+	// DogStatsD sends the tags in DogStatsD format ("|#key:value"), otherwise they're joined into the name.
+	DogStatsD     bool `mapstructure:"dogstatsd" json:"dogstatsd"`
+	FlushInterval int  `mapstructure:"flush_interval" json:"flush_interval"` // ms
+	// MaxPacketSize is the max bytes of the udp packet the metrics are batched into.
+	MaxPacketSize int `mapstructure:"max_packet_size" json:"max_packet_size"`
+}
+
+// tracingOpts is the configuration for the OpenTelemetry tracing of the client requests.
+type tracingOpts struct {
+	// Exporter is "none", "otlp", "stdout" or "file", the tracing is disabled if it's "none".
+	Exporter string `mapstructure:"exporter" json:"exporter"`
+	// Endpoint is the "host:port" of the OTLP grpc collector, only used for exporter "otlp".
+	Endpoint string `mapstructure:"endpoint" json:"endpoint"`
+	// Insecure connects the OTLP collector without TLS.
+	Insecure bool `mapstructure:"insecure" json:"insecure"`
+	// File is the path the spans are appended to in json, only used for exporter "file".
+	File string `mapstructure:"file" json:"file"`
+	// SampleRatio is the ratio of the requests to trace, in (0, 1].
+	SampleRatio float64 `mapstructure:"sample_ratio" json:"sample_ratio"`
+	ServiceName string  `mapstructure:"service_name" json:"service_name"`
+}
+
+// listenerOpts is one endpoint the rpc server accepts client connections on.
+type listenerOpts struct {
+	// Network is "tcp" or "unix".
+	Network string `mapstructure:"network" json:"network"`
+	// Address is "host:port" for tcp, or the socket file path for unix.
+	Address string `mapstructure:"address" json:"address"`
+}
+
+// serverOpts is the configuration for the rpc server.
+type serverOpts struct {
+	Listeners []listenerOpts `mapstructure:"listeners" json:"listeners"`
+	// ShutdownTimeout is the max time(ms) to wait for the ongoing requests when shutting down.
+	ShutdownTimeout int `mapstructure:"shutdown_timeout" json:"shutdown_timeout"`
+	// MaxConnections is the max number of client connections, 0 means unlimited.
+	MaxConnections int `mapstructure:"max_connections" json:"max_connections"`
+	// MaxConnectionsPerIP is the max number of client connections from one host, 0 means unlimited.
+	MaxConnectionsPerIP int `mapstructure:"max_connections_per_ip" json:"max_connections_per_ip"`
+	// IdleTimeout(ms) closes the connection which has no request for a while, 0 means never.
+	IdleTimeout int `mapstructure:"idle_timeout" json:"idle_timeout"`
+	// DefaultRequestTimeout(ms) is used when the client sets no timeout in request header.
+	DefaultRequestTimeout int `mapstructure:"default_request_timeout" json:"default_request_timeout"`
+	// MaxRequestTimeout(ms) caps the timeout set by client.
+	MaxRequestTimeout int `mapstructure:"max_request_timeout" json:"max_request_timeout"`
+}
+
+// adminOpts is the configuration for the admin http server.
+type adminOpts struct {
+	// Address is the address the admin http server listens on, the server is disabled if it's empty.
+	Address string `mapstructure:"address" json:"address"`
+}
+
+// passthroughOpts is the configuration for relaying the requests of the methods the proxy doesn't
+// handle itself to meta servers.
+type passthroughOpts struct {
+	Enable bool `mapstructure:"enable" json:"enable"`
+	// DefaultMetaAddrs is the meta servers the request is forwarded to if its table can't be resolved.
+	DefaultMetaAddrs string `mapstructure:"default_meta_addrs" json:"default_meta_addrs"`
 }
 
+// GlobalConfig is the config the proxy starts with. The reloadable options should be read by Current instead.
 var GlobalConfig Configuration
 
-// Configuration is the wrapper of zookeeperOpts and metricsOpts
+// Configuration is the wrapper of all the options
 type Configuration struct {
-	ZookeeperOpts zookeeperOpts `mapstructure:"zookeeper"`
-	MetricsOpts   metricsOpts   `mapstructure:"metric"`
+	ServerOpts      serverOpts      `mapstructure:"server" json:"server"`
+	AdminOpts       adminOpts       `mapstructure:"admin" json:"admin"`
+	RouteOpts       routeOpts       `mapstructure:"route" json:"route"`
+	ZookeeperOpts   zookeeperOpts   `mapstructure:"zookeeper" json:"zookeeper"`
+	EtcdOpts        etcdOpts        `mapstructure:"etcd" json:"etcd"`
+	PassthroughOpts passthroughOpts `mapstructure:"passthrough" json:"passthrough"`
+	ConfigCacheOpts configCacheOpts `mapstructure:"config_cache" json:"config_cache"`
+	MetaOpts        metaOpts        `mapstructure:"meta" json:"meta"`
+	FailoverOpts    failoverOpts    `mapstructure:"failover" json:"failover"`
+	MetricsOpts     metricsOpts     `mapstructure:"metric" json:"metric"`
+	TracingOpts     tracingOpts     `mapstructure:"tracing" json:"tracing"`
 }
 
+const (
+	defaultListenNetwork   = "tcp"
+	defaultListenAddress   = "0.0.0.0:34601"
+	defaultShutdownTimeout = 10000
+	defaultRequestTimeout  = 5000
+	maxRequestTimeout      = 60000
+	defaultPromAddress     = ":9091"
+	defaultStatsdAddress   = "127.0.0.1:8125"
+	defaultStatsdFlush     = 1000
+	defaultStatsdPacket    = 1432
+	defaultTraceExporter   = "none"
+	defaultTraceEndpoint   = "localhost:4317"
+	defaultTraceSampling   = 1
+	defaultTraceService    = "meta-proxy"
+	defaultRouteType       = "zookeeper"
+	defaultStoreTimeout    = 1000
+	defaultSnapshotPeriod  = 60000
+	defaultConfigCacheTTL  = 1000
+	defaultConfigCacheCap  = 1024
+	defaultCheckInterval   = 1000
+	defaultCheckTimeout    = 500
+	defaultFailureCount    = 3
+	defaultRecoveryCount   = 3
+)
+
+// EnvPrefix is the prefix of the environment variables which override the options in config file, e.g.
+// META_PROXY_ZOOKEEPER_ROOT overrides `zookeeper.root`.
+const EnvPrefix = "META_PROXY"
+
 // Init meta-proxy config using the config file
 func Init(path string) {
-	viper.SetConfigFile(path)
-	viper.SetConfigType("yaml")
-	if err := viper.ReadInConfig(); err != nil {
+	cfg, err := Load(path)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	GlobalConfig = cfg
+	configPath = path
+	current.Store(&cfg)
+	logrus.Infof("init config: %v", GlobalConfig)
+}
+
+// Load reads the config file, fills the default values and validates the options. The options in file can be
+// overridden by the environment variables.
+func Load(path string) (Configuration, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if err := v.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			logrus.Panicf("unable find config file \"%s\"", path)
-		} else {
-			logrus.Panicf("fatal error config file \"%s\":%s", path, err)
+			return Configuration{}, fmt.Errorf("unable find config file \"%s\"", path)
 		}
+		return Configuration{}, fmt.Errorf("fatal error config file \"%s\":%s", path, err)
 	}
 
-	err := viper.Unmarshal(&GlobalConfig)
-	if err != nil {
-		logrus.Panicf("unable to decode \"%s\" into struct: %s", path, err)
+	cfg := Configuration{}
+	if err := v.Unmarshal(&cfg); err != nil {
+		return Configuration{}, fmt.Errorf("unable to decode \"%s\" into struct: %s", path, err)
+	}
+	fillDefault(&cfg)
+	if err := cfg.Validate(); err != nil {
+		return Configuration{}, fmt.Errorf("invalid config file \"%s\": %s", path, err)
+	}
+	return cfg, nil
+}
+
+// fillDefault sets the default value for the options that are not specified in config file.
+func fillDefault(cfg *Configuration) {
+	if len(cfg.ServerOpts.Listeners) == 0 {
+		cfg.ServerOpts.Listeners = []listenerOpts{{Network: defaultListenNetwork, Address: defaultListenAddress}}
+	}
+	for i := range cfg.ServerOpts.Listeners {
+		if cfg.ServerOpts.Listeners[i].Network == "" {
+			cfg.ServerOpts.Listeners[i].Network = defaultListenNetwork
+		}
+	}
+	if cfg.ServerOpts.ShutdownTimeout == 0 {
+		cfg.ServerOpts.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if cfg.ServerOpts.DefaultRequestTimeout == 0 {
+		cfg.ServerOpts.DefaultRequestTimeout = defaultRequestTimeout
+	}
+	if cfg.ServerOpts.MaxRequestTimeout == 0 {
+		cfg.ServerOpts.MaxRequestTimeout = maxRequestTimeout
+	}
+	if cfg.RouteOpts.Type == "" {
+		cfg.RouteOpts.Type = defaultRouteType
+	}
+	if cfg.ZookeeperOpts.Timeout == 0 {
+		cfg.ZookeeperOpts.Timeout = defaultStoreTimeout
+	}
+	if cfg.EtcdOpts.Timeout == 0 {
+		cfg.EtcdOpts.Timeout = defaultStoreTimeout
+	}
+	if cfg.RouteOpts.SnapshotInterval == 0 {
+		cfg.RouteOpts.SnapshotInterval = defaultSnapshotPeriod
+	}
+	if cfg.ConfigCacheOpts.TTL == 0 {
+		cfg.ConfigCacheOpts.TTL = defaultConfigCacheTTL
+	}
+	if cfg.ConfigCacheOpts.Capacity == 0 {
+		cfg.ConfigCacheOpts.Capacity = defaultConfigCacheCap
+	}
+	if cfg.MetaOpts.CheckInterval == 0 {
+		cfg.MetaOpts.CheckInterval = defaultCheckInterval
+	}
+	if cfg.MetaOpts.CheckTimeout == 0 {
+		cfg.MetaOpts.CheckTimeout = defaultCheckTimeout
+	}
+	if cfg.FailoverOpts.CheckInterval == 0 {
+		cfg.FailoverOpts.CheckInterval = defaultCheckInterval
+	}
+	if cfg.FailoverOpts.CheckTimeout == 0 {
+		cfg.FailoverOpts.CheckTimeout = defaultCheckTimeout
+	}
+	if cfg.FailoverOpts.FailureThreshold == 0 {
+		cfg.FailoverOpts.FailureThreshold = defaultFailureCount
+	}
+	if cfg.FailoverOpts.RecoveryThreshold == 0 {
+		cfg.FailoverOpts.RecoveryThreshold = defaultRecoveryCount
+	}
+	if len(cfg.MetricsOpts.Types) == 0 && cfg.MetricsOpts.Type != "" {
+		cfg.MetricsOpts.Types = []string{cfg.MetricsOpts.Type}
+	}
+	if cfg.MetricsOpts.PromAddress == "" {
+		cfg.MetricsOpts.PromAddress = defaultPromAddress
+	}
+	if cfg.MetricsOpts.Statsd.Address == "" {
+		cfg.MetricsOpts.Statsd.Address = defaultStatsdAddress
+	}
+	if cfg.MetricsOpts.Statsd.FlushInterval == 0 {
+		cfg.MetricsOpts.Statsd.FlushInterval = defaultStatsdFlush
+	}
+	if cfg.MetricsOpts.Statsd.MaxPacketSize == 0 {
+		cfg.MetricsOpts.Statsd.MaxPacketSize = defaultStatsdPacket
+	}
+	if cfg.TracingOpts.Exporter == "" {
+		cfg.TracingOpts.Exporter = defaultTraceExporter
+	}
+	if cfg.TracingOpts.Endpoint == "" {
+		cfg.TracingOpts.Endpoint = defaultTraceEndpoint
+	}
+	if cfg.TracingOpts.SampleRatio == 0 {
+		cfg.TracingOpts.SampleRatio = defaultTraceSampling
+	}
+	if cfg.TracingOpts.ServiceName == "" {
+		cfg.TracingOpts.ServiceName = defaultTraceService
 	}
-	logrus.Infof("init config: %v", GlobalConfig)
 }
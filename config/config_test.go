@@ -20,6 +20,7 @@
 package config
 
 import (
+	"os"
 	"testing"
 
 	"github.com/magiconair/properties/assert"
@@ -28,17 +29,134 @@ import (
 func TestConfig(t *testing.T) {
 	Init("yaml/meta-proxy-example.yml")
 	config := Configuration{
+		ServerOpts: serverOpts{
+			Listeners: []listenerOpts{
+				{Network: "tcp", Address: "0.0.0.0:34601"},
+				{Network: "unix", Address: "/tmp/meta-proxy.sock"},
+			},
+			ShutdownTimeout:       5000,
+			MaxConnections:        10000,
+			MaxConnectionsPerIP:   100,
+			IdleTimeout:           600000,
+			DefaultRequestTimeout: 3000,
+			MaxRequestTimeout:     10000,
+		},
+		AdminOpts: adminOpts{
+			Address: "127.0.0.1:9092",
+		},
+		RouteOpts: routeOpts{
+			Type:             "zookeeper",
+			File:             "../config/yaml/routes-example.yml",
+			WarmUp:           false,
+			SnapshotInterval: 30000,
+		},
 		ZookeeperOpts: zookeeperOpts{
 			Address:      []string{"127.0.0.1:22181", "127.0.0.2:22181"},
 			Root:         "/pegasus-cluster",
 			Timeout:      1000,
 			WatcherCount: 1024,
 		},
+		EtcdOpts: etcdOpts{
+			Endpoints: []string{"127.0.0.1:2379"},
+			Root:      "/pegasus-cluster",
+			Timeout:   1000,
+		},
+		PassthroughOpts: passthroughOpts{
+			Enable:           true,
+			DefaultMetaAddrs: "pegasus-meta1.example.com:34601,pegasus-meta2.example.com:34601,pegasus-meta3.example.com:34601",
+		},
+		ConfigCacheOpts: configCacheOpts{
+			Enable:   true,
+			TTL:      3000,
+			Capacity: 512,
+		},
+		MetaOpts: metaOpts{
+			CheckInterval: 10000,
+			CheckTimeout:  1000,
+		},
+		FailoverOpts: failoverOpts{
+			CheckInterval:     2000,
+			CheckTimeout:      500,
+			FailureThreshold:  3,
+			RecoveryThreshold: 5,
+		},
 		MetricsOpts: metricsOpts{
-			Type: "falcon",
-			Tags: []string{"region=local_tst", "service=meta_proxy"},
+			Types:       []string{"falcon"},
+			Tags:        []string{"region=local_tst", "service=meta_proxy"},
+			PromAddress: ":9091",
+			HistogramBuckets: map[string][]float64{
+				"client_request_latency": {500, 1000, 5000, 10000, 50000, 100000, 500000, 1000000},
+			},
+			Statsd: statsdOpts{
+				Address:       "127.0.0.1:8125",
+				Prefix:        "meta_proxy.",
+				FlushInterval: 1000,
+				MaxPacketSize: 1432,
+			},
+		},
+		TracingOpts: tracingOpts{
+			Exporter:    "none",
+			Endpoint:    "localhost:4317",
+			Insecure:    true,
+			File:        "meta-proxy-trace.json",
+			SampleRatio: 1,
+			ServiceName: "meta-proxy",
 		},
 	}
 
 	assert.Equal(t, config, GlobalConfig)
 }
+
+func TestConfigDefault(t *testing.T) {
+	cfg := Configuration{
+		ServerOpts: serverOpts{
+			Listeners: []listenerOpts{{Address: "127.0.0.1:34601"}},
+		},
+	}
+	fillDefault(&cfg)
+	assert.Equal(t, []listenerOpts{{Network: "tcp", Address: "127.0.0.1:34601"}}, cfg.ServerOpts.Listeners)
+	assert.Equal(t, 10000, cfg.ServerOpts.ShutdownTimeout)
+	assert.Equal(t, 5000, cfg.ServerOpts.DefaultRequestTimeout)
+	assert.Equal(t, 60000, cfg.ServerOpts.MaxRequestTimeout)
+	assert.Equal(t, "zookeeper", cfg.RouteOpts.Type)
+	assert.Equal(t, 1000, cfg.ZookeeperOpts.Timeout)
+	assert.Equal(t, 1000, cfg.EtcdOpts.Timeout)
+	assert.Equal(t, 60000, cfg.RouteOpts.SnapshotInterval)
+	assert.Equal(t, 1000, cfg.ConfigCacheOpts.TTL)
+	assert.Equal(t, 1024, cfg.ConfigCacheOpts.Capacity)
+	assert.Equal(t, metaOpts{CheckInterval: 1000, CheckTimeout: 500}, cfg.MetaOpts)
+	assert.Equal(t, failoverOpts{CheckInterval: 1000, CheckTimeout: 500, FailureThreshold: 3, RecoveryThreshold: 3},
+		cfg.FailoverOpts)
+	assert.Equal(t, ":9091", cfg.MetricsOpts.PromAddress)
+	assert.Equal(t, statsdOpts{Address: "127.0.0.1:8125", FlushInterval: 1000, MaxPacketSize: 1432}, cfg.MetricsOpts.Statsd)
+	assert.Equal(t, tracingOpts{Exporter: "none", Endpoint: "localhost:4317", SampleRatio: 1, ServiceName: "meta-proxy"},
+		cfg.TracingOpts)
+
+	cfg = Configuration{}
+	fillDefault(&cfg)
+	assert.Equal(t, []listenerOpts{{Network: "tcp", Address: "0.0.0.0:34601"}}, cfg.ServerOpts.Listeners)
+
+	// the deprecated `metric.type` is used if `metric.types` is not set
+	cfg = Configuration{MetricsOpts: metricsOpts{Type: "prometheus"}}
+	fillDefault(&cfg)
+	assert.Equal(t, []string{"prometheus"}, cfg.MetricsOpts.Types)
+	cfg = Configuration{MetricsOpts: metricsOpts{Type: "prometheus", Types: []string{"falcon", "memory"}}}
+	fillDefault(&cfg)
+	assert.Equal(t, []string{"falcon", "memory"}, cfg.MetricsOpts.Types)
+}
+
+func TestConfigEnvOverride(t *testing.T) {
+	os.Setenv("META_PROXY_ZOOKEEPER_ROOT", "/env-root")
+	os.Setenv("META_PROXY_ZOOKEEPER_ADDRESS", "127.0.0.3:22181,127.0.0.4:22181")
+	defer os.Unsetenv("META_PROXY_ZOOKEEPER_ROOT")
+	defer os.Unsetenv("META_PROXY_ZOOKEEPER_ADDRESS")
+
+	cfg, err := Load("yaml/meta-proxy-example.yml")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/env-root", cfg.ZookeeperOpts.Root)
+	assert.Equal(t, []string{"127.0.0.3:22181", "127.0.0.4:22181"}, cfg.ZookeeperOpts.Address)
+	assert.Equal(t, 1000, cfg.ZookeeperOpts.Timeout)
+
+	_, err = Load("yaml/notExist.yml")
+	assert.Equal(t, true, err != nil)
+}
@@ -0,0 +1,176 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// Subscriber is notified with the previous and the new config once the config is reloaded. The configs are shared
+// snapshots, they must not be modified.
+type Subscriber func(old *Configuration, new *Configuration)
+
+var (
+	// current is the *Configuration in effect, it's replaced rather than modified on reloading
+	current    atomic.Value
+	configPath string
+
+	// reloadMut serializes the reloads and the notifications of subscribers
+	reloadMut   sync.Mutex
+	subscribers []Subscriber
+)
+
+// Current returns the snapshot of the config in effect, which reflects the reloaded options. GlobalConfig is
+// returned if the config has not been initialized by Init, e.g. in tests.
+func Current() *Configuration {
+	if cfg, ok := current.Load().(*Configuration); ok {
+		return cfg
+	}
+	return &GlobalConfig
+}
+
+// Subscribe registers the subscriber which is notified of the reloaded config.
+func Subscribe(subscriber Subscriber) {
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+	subscribers = append(subscribers, subscriber)
+}
+
+// Reload reads the config file again and publishes the reloadable options to the subscribers. The changed options
+// which can't be reloaded keep their previous values, their paths are returned and logged so that the proxy can be
+// restarted to apply them. The previous config keeps in effect if the config file is invalid.
+func Reload() ([]string, error) {
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+	if configPath == "" {
+		return nil, fmt.Errorf("config is not initialized from file")
+	}
+	cfg, err := Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	old := Current()
+	next := *old
+	applyReloadable(&next, &cfg)
+	notReloaded := diffOptions(reflect.ValueOf(next), reflect.ValueOf(cfg), "")
+	for _, path := range notReloaded {
+		logrus.Warnf("config option \"%s\" is changed but it can't be reloaded, restart to apply it", path)
+	}
+	changed := diffOptions(reflect.ValueOf(*old), reflect.ValueOf(next), "")
+	if len(changed) == 0 {
+		logrus.Infof("config file \"%s\" is reloaded, no option is changed", configPath)
+		return notReloaded, nil
+	}
+
+	current.Store(&next)
+	logrus.Infof("config file \"%s\" is reloaded, changed options: %s", configPath, strings.Join(changed, ", "))
+	for _, subscriber := range subscribers {
+		subscriber(old, &next)
+	}
+	return notReloaded, nil
+}
+
+// applyReloadable copies the options which take effect without restart from src to dst.
+func applyReloadable(dst *Configuration, src *Configuration) {
+	// the zookeeper connection is re-established and the table watcher cache is resized
+	dst.ZookeeperOpts.Address = src.ZookeeperOpts.Address
+	dst.ZookeeperOpts.Timeout = src.ZookeeperOpts.Timeout
+	dst.ZookeeperOpts.WatcherCount = src.ZookeeperOpts.WatcherCount
+	// the metric collectors are rebuilt with the new tags
+	dst.MetricsOpts.Tags = src.MetricsOpts.Tags
+}
+
+// diffOptions returns the yaml paths of the options which differ between the two configs.
+func diffOptions(a reflect.Value, b reflect.Value, prefix string) []string {
+	if a.Kind() != reflect.Struct {
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			return nil
+		}
+		return []string{prefix}
+	}
+	var paths []string
+	for i := 0; i < a.NumField(); i++ {
+		path := a.Type().Field(i).Tag.Get("mapstructure")
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		paths = append(paths, diffOptions(a.Field(i), b.Field(i), path)...)
+	}
+	return paths
+}
+
+// Watch reloads the config once the config file is changed or SIGHUP is received, until the ctx is done.
+func Watch(ctx context.Context) error {
+	// watch the directory rather than the file, so that the file replaced by renaming can still be watched
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("failed to watch config file \"%s\": %s", configPath, err)
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigCh)
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(configPath) || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				logrus.Infof("config file \"%s\" is changed, reload it", configPath)
+			case <-sigCh:
+				logrus.Infof("receive signal SIGHUP, reload config file \"%s\"", configPath)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Errorf("failed to watch config file \"%s\": %s", configPath, err)
+				continue
+			case <-ctx.Done():
+				return
+			}
+			if _, err := Reload(); err != nil {
+				logrus.Errorf("failed to reload config, keep the previous one: %s", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+// writeTestConfig writes the example config into path, with the replacements applied in pairs of old and new.
+func writeTestConfig(t *testing.T, path string, replacements ...string) {
+	data, err := ioutil.ReadFile("yaml/meta-proxy-example.yml")
+	assert.Equal(t, nil, err)
+	content := strings.NewReplacer(replacements...).Replace(string(data))
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta-proxy-config")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "meta-proxy.yml")
+	writeTestConfig(t, path)
+	Init(path)
+	initial := Current()
+
+	var notified [][2]*Configuration
+	Subscribe(func(old *Configuration, new *Configuration) {
+		if old == initial || new == initial {
+			notified = append(notified, [2]*Configuration{old, new})
+		}
+	})
+
+	writeTestConfig(t, path,
+		"timeout: 1000 # ms\n  table_watcher_cache_capacity: 1024",
+		"timeout: 3000 # ms\n  table_watcher_cache_capacity: 2048",
+		"region=local_tst", "region=c3",
+		"max_connections: 10000", "max_connections: 20000")
+	notReloaded, err := Reload()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"server.max_connections"}, notReloaded)
+	cfg := Current()
+	assert.Equal(t, 2048, cfg.ZookeeperOpts.WatcherCount)
+	assert.Equal(t, 3000, cfg.ZookeeperOpts.Timeout)
+	assert.Equal(t, []string{"region=c3", "service=meta_proxy"}, cfg.MetricsOpts.Tags)
+	assert.Equal(t, 10000, cfg.ServerOpts.MaxConnections)
+	assert.Equal(t, [][2]*Configuration{{initial, cfg}}, notified)
+	// the snapshot replaced is not modified
+	assert.Equal(t, 1024, initial.ZookeeperOpts.WatcherCount)
+
+	// the previous config keeps in effect if the file is invalid
+	cfg = Current()
+	writeTestConfig(t, path, "table_watcher_cache_capacity: 1024", "table_watcher_cache_capacity: 0")
+	_, err = Reload()
+	assert.Equal(t, true, err != nil)
+	assert.Equal(t, cfg, Current())
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta-proxy-config")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "meta-proxy.yml")
+	writeTestConfig(t, path)
+	Init(path)
+
+	reloaded := make(chan int, 10)
+	Subscribe(func(old *Configuration, new *Configuration) {
+		reloaded <- new.ZookeeperOpts.WatcherCount
+	})
+	waitReloaded := func() int {
+		select {
+		case capacity := <-reloaded:
+			return capacity
+		case <-time.After(3 * time.Second):
+			return 0
+		}
+	}
+
+	// the file changed before watching is reloaded by SIGHUP
+	writeTestConfig(t, path, "table_watcher_cache_capacity: 1024", "table_watcher_cache_capacity: 10")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Equal(t, nil, Watch(ctx))
+	assert.Equal(t, nil, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Equal(t, 10, waitReloaded())
+
+	writeTestConfig(t, path, "table_watcher_cache_capacity: 1024", "table_watcher_cache_capacity: 20")
+	assert.Equal(t, 20, waitReloaded())
+}
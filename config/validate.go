@@ -0,0 +1,257 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// maxUDPPayload is the max payload of an ipv4 udp packet.
+const maxUDPPayload = 65507
+
+// metricTypes is the metric sinks that can be enabled by `metric.types`.
+var metricTypes = []string{"prometheus", "falcon", "statsd", "memory"}
+
+// RegisterMetricType adds the metric sink which is registered in metrics package, so that it can be enabled in
+// config file.
+func RegisterMetricType(name string) {
+	for _, mtype := range metricTypes {
+		if mtype == name {
+			return
+		}
+	}
+	metricTypes = append(metricTypes, name)
+}
+
+// FieldError is a problem of an option, Path is the yaml path of the option, e.g. `server.listeners[0].address`.
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationError contains all the problems found in the configuration.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Errors)+1)
+	lines = append(lines, fmt.Sprintf("%d problems found in config:", len(e.Errors)))
+	for _, err := range e.Errors {
+		lines = append(lines, "  "+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validator collects the problems of the configuration.
+type validator struct {
+	errors []FieldError
+}
+
+func (v *validator) addf(path string, format string, args ...interface{}) {
+	v.errors = append(v.errors, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) positive(path string, value int) {
+	if value <= 0 {
+		v.addf(path, "must be positive, got %d", value)
+	}
+}
+
+func (v *validator) nonNegative(path string, value int) {
+	if value < 0 {
+		v.addf(path, "must not be negative, got %d", value)
+	}
+}
+
+func (v *validator) oneOf(path string, value string, options ...string) {
+	for _, option := range options {
+		if value == option {
+			return
+		}
+	}
+	v.addf(path, "must be one of \"%s\", got \"%s\"", strings.Join(options, "\", \""), value)
+}
+
+func (v *validator) hostPort(path string, value string) {
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		v.addf(path, "must be \"host:port\", got \"%s\"", value)
+	}
+}
+
+func (v *validator) hostPorts(path string, values []string) {
+	if len(values) == 0 {
+		v.addf(path, "must not be empty")
+	}
+	for i, value := range values {
+		v.hostPort(fmt.Sprintf("%s[%d]", path, i), value)
+	}
+}
+
+func (v *validator) rootPath(path string, value string) {
+	if !strings.HasPrefix(value, "/") {
+		v.addf(path, "must start with \"/\", got \"%s\"", value)
+	} else if len(value) > 1 && strings.HasSuffix(value, "/") {
+		v.addf(path, "must not end with \"/\", got \"%s\"", value)
+	}
+}
+
+// Validate checks all the options and returns *ValidationError containing all the problems, it should be called
+// after the default values are filled.
+func (c *Configuration) Validate() error {
+	v := &validator{}
+
+	for i, listener := range c.ServerOpts.Listeners {
+		path := fmt.Sprintf("server.listeners[%d]", i)
+		v.oneOf(path+".network", listener.Network, "tcp", "unix")
+		if listener.Address == "" {
+			v.addf(path+".address", "must not be empty")
+		} else if listener.Network == "tcp" {
+			v.hostPort(path+".address", listener.Address)
+		}
+	}
+	v.positive("server.shutdown_timeout", c.ServerOpts.ShutdownTimeout)
+	v.nonNegative("server.max_connections", c.ServerOpts.MaxConnections)
+	v.nonNegative("server.max_connections_per_ip", c.ServerOpts.MaxConnectionsPerIP)
+	v.nonNegative("server.idle_timeout", c.ServerOpts.IdleTimeout)
+	v.positive("server.default_request_timeout", c.ServerOpts.DefaultRequestTimeout)
+	if c.ServerOpts.MaxRequestTimeout < c.ServerOpts.DefaultRequestTimeout {
+		v.addf("server.max_request_timeout", "must not be less than server.default_request_timeout(%d), got %d",
+			c.ServerOpts.DefaultRequestTimeout, c.ServerOpts.MaxRequestTimeout)
+	}
+
+	if c.AdminOpts.Address != "" {
+		v.hostPort("admin.address", c.AdminOpts.Address)
+	}
+
+	v.oneOf("route.type", c.RouteOpts.Type, "zookeeper", "etcd", "file")
+	if c.RouteOpts.Type == "file" && c.RouteOpts.File == "" {
+		v.addf("route.file", "must not be empty if route.type is \"file\"")
+	}
+	v.positive("route.snapshot_interval", c.RouteOpts.SnapshotInterval)
+
+	// the capacity of the table cache is required by all route types
+	v.positive("zookeeper.table_watcher_cache_capacity", c.ZookeeperOpts.WatcherCount)
+	switch c.RouteOpts.Type {
+	case "zookeeper":
+		v.hostPorts("zookeeper.address", c.ZookeeperOpts.Address)
+		v.rootPath("zookeeper.root", c.ZookeeperOpts.Root)
+		v.positive("zookeeper.timeout", c.ZookeeperOpts.Timeout)
+	case "etcd":
+		v.hostPorts("etcd.endpoints", c.EtcdOpts.Endpoints)
+		v.rootPath("etcd.root", c.EtcdOpts.Root)
+		v.positive("etcd.timeout", c.EtcdOpts.Timeout)
+	}
+
+	if c.PassthroughOpts.Enable && c.PassthroughOpts.DefaultMetaAddrs != "" {
+		addrs := strings.Split(c.PassthroughOpts.DefaultMetaAddrs, ",")
+		if len(addrs) < 2 {
+			v.addf("passthrough.default_meta_addrs", "must contain at least 2 meta servers separated by \",\", got \"%s\"",
+				c.PassthroughOpts.DefaultMetaAddrs)
+		} else {
+			for _, addr := range addrs {
+				v.hostPort("passthrough.default_meta_addrs", addr)
+			}
+		}
+	}
+
+	if c.ConfigCacheOpts.Enable {
+		v.positive("config_cache.ttl", c.ConfigCacheOpts.TTL)
+		v.positive("config_cache.capacity", c.ConfigCacheOpts.Capacity)
+	}
+
+	v.positive("meta.check_interval", c.MetaOpts.CheckInterval)
+	v.positive("meta.check_timeout", c.MetaOpts.CheckTimeout)
+	v.positive("failover.check_interval", c.FailoverOpts.CheckInterval)
+	v.positive("failover.check_timeout", c.FailoverOpts.CheckTimeout)
+	v.positive("failover.failure_threshold", c.FailoverOpts.FailureThreshold)
+	v.positive("failover.recovery_threshold", c.FailoverOpts.RecoveryThreshold)
+
+	if len(c.MetricsOpts.Types) == 0 {
+		v.addf("metric.types", "must not be empty")
+	}
+	enabled := make(map[string]bool)
+	for i, mtype := range c.MetricsOpts.Types {
+		path := fmt.Sprintf("metric.types[%d]", i)
+		v.oneOf(path, mtype, metricTypes...)
+		if enabled[mtype] {
+			v.addf(path, "\"%s\" is duplicated", mtype)
+		}
+		enabled[mtype] = true
+	}
+	for i, tag := range c.MetricsOpts.Tags {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			v.addf(fmt.Sprintf("metric.tags[%d]", i), "must be \"key=value\", got \"%s\"", tag)
+		}
+	}
+	if enabled["prometheus"] {
+		v.hostPort("metric.prometheus_address", c.MetricsOpts.PromAddress)
+	}
+	if enabled["statsd"] {
+		v.hostPort("metric.statsd.address", c.MetricsOpts.Statsd.Address)
+		v.positive("metric.statsd.flush_interval", c.MetricsOpts.Statsd.FlushInterval)
+		if size := c.MetricsOpts.Statsd.MaxPacketSize; size <= 0 || size > maxUDPPayload {
+			v.addf("metric.statsd.max_packet_size", "must be in (0, %d], got %d", maxUDPPayload, size)
+		}
+	}
+	names := make([]string, 0, len(c.MetricsOpts.HistogramBuckets))
+	for name := range c.MetricsOpts.HistogramBuckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buckets := c.MetricsOpts.HistogramBuckets[name]
+		path := "metric.histogram_buckets." + name
+		if len(buckets) == 0 {
+			v.addf(path, "must not be empty")
+		}
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				v.addf(path, "must be in increasing order, got %v", buckets)
+				break
+			}
+		}
+	}
+
+	v.oneOf("tracing.exporter", c.TracingOpts.Exporter, "none", "otlp", "stdout", "file")
+	switch c.TracingOpts.Exporter {
+	case "otlp":
+		v.hostPort("tracing.endpoint", c.TracingOpts.Endpoint)
+	case "file":
+		if c.TracingOpts.File == "" {
+			v.addf("tracing.file", "must not be empty if tracing.exporter is \"file\"")
+		}
+	}
+	if ratio := c.TracingOpts.SampleRatio; ratio <= 0 || ratio > 1 {
+		v.addf("tracing.sample_ratio", "must be in (0, 1], got %v", ratio)
+	}
+
+	if len(v.errors) > 0 {
+		return &ValidationError{Errors: v.errors}
+	}
+	return nil
+}
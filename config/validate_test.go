@@ -0,0 +1,112 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cfg, err := Load("yaml/meta-proxy-example.yml")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, cfg.Validate())
+
+	cfg.ServerOpts.Listeners = append(cfg.ServerOpts.Listeners, listenerOpts{Network: "udp", Address: "0.0.0.0"})
+	cfg.ServerOpts.MaxRequestTimeout = 1000
+	cfg.AdminOpts.Address = "9092"
+	cfg.ZookeeperOpts.Address = nil
+	cfg.ZookeeperOpts.Root = "pegasus-cluster"
+	cfg.ZookeeperOpts.WatcherCount = 0
+	cfg.PassthroughOpts.DefaultMetaAddrs = "127.0.0.1:34601"
+	cfg.FailoverOpts.FailureThreshold = -1
+	cfg.MetricsOpts.Types = []string{"falcon", "falcon", "opentsdb"}
+	cfg.MetricsOpts.Tags = []string{"region=local_tst", "region"}
+	cfg.MetricsOpts.HistogramBuckets["zk_request_latency"] = []float64{1000, 100}
+
+	err = cfg.Validate()
+	var paths []string
+	for _, fieldErr := range err.(*ValidationError).Errors {
+		paths = append(paths, fieldErr.Path)
+	}
+	assert.Equal(t, []string{
+		"server.listeners[2].network",
+		"server.max_request_timeout",
+		"admin.address",
+		"zookeeper.table_watcher_cache_capacity",
+		"zookeeper.address",
+		"zookeeper.root",
+		"passthrough.default_meta_addrs",
+		"failover.failure_threshold",
+		"metric.types[1]",
+		"metric.types[2]",
+		"metric.tags[1]",
+		"metric.histogram_buckets.zk_request_latency",
+	}, paths)
+	assert.Equal(t, true, strings.Contains(err.Error(), "metric.tags[1]: must be \"key=value\", got \"region\""))
+
+	// the etcd options are only checked if route type is etcd
+	cfg, _ = Load("yaml/meta-proxy-example.yml")
+	cfg.EtcdOpts.Endpoints = nil
+	assert.Equal(t, nil, cfg.Validate())
+	cfg.RouteOpts.Type = "etcd"
+	assert.Equal(t, "1 problems found in config:\n  etcd.endpoints: must not be empty", cfg.Validate().Error())
+
+	// the statsd options are only checked if statsd is enabled
+	cfg, _ = Load("yaml/meta-proxy-example.yml")
+	cfg.MetricsOpts.Statsd.MaxPacketSize = 65536
+	assert.Equal(t, nil, cfg.Validate())
+	cfg.MetricsOpts.Types = append(cfg.MetricsOpts.Types, "statsd")
+	assert.Equal(t, "1 problems found in config:\n  metric.statsd.max_packet_size: must be in (0, 65507], got 65536",
+		cfg.Validate().Error())
+
+	cfg, _ = Load("yaml/meta-proxy-example.yml")
+	cfg.TracingOpts.Exporter = "file"
+	cfg.TracingOpts.File = ""
+	cfg.TracingOpts.SampleRatio = 1.5
+	assert.Equal(t, "2 problems found in config:\n  tracing.file: must not be empty if tracing.exporter is \"file\"\n"+
+		"  tracing.sample_ratio: must be in (0, 1], got 1.5", cfg.Validate().Error())
+}
+
+func TestLoadInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta-proxy-config")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "meta-proxy.yml")
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(`
+zookeeper:
+  address: [127.0.0.1:22181]
+  root: /pegasus-cluster
+  table_watcher_cache_capacity: 0
+metric:
+  type: falcon
+  tags: [region]
+`), 0644))
+
+	_, err = Load(path)
+	assert.Equal(t, true, err != nil)
+	assert.Equal(t, true, strings.Contains(err.Error(), "zookeeper.table_watcher_cache_capacity: must be positive"))
+	assert.Equal(t, true, strings.Contains(err.Error(), "metric.tags[0]"))
+}
@@ -1,19 +1,30 @@
 module github.com/pegasus-kv/meta-proxy
 
-go 1.14
+go 1.16
 
 require (
 	github.com/XiaoMi/pegasus-go-client v0.0.0-20210324071735-89707a7d0888
 	github.com/bluele/gcache v0.0.0-20190518031135-bc40bd653833
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/go-zookeeper/zk v1.0.2
+	github.com/golang/protobuf v1.5.2
 	github.com/magiconair/properties v1.8.1
 	github.com/niean/go-metrics-lite v0.0.0-20151230091537-b5d30971b578 // indirect
 	github.com/niean/goperfcounter v0.0.0-20160108100052-24860a8d3fac
 	github.com/niean/gotools v0.0.0-20151221085310-ff3f51fc5c60 // indirect
 	github.com/pegasus-kv/thrift v0.13.0
-	github.com/prometheus/client_golang v1.9.0
-	github.com/sirupsen/logrus v1.6.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/viper v1.7.1
-	github.com/stretchr/testify v1.6.1
+	github.com/stretchr/testify v1.8.1
+	go.etcd.io/etcd/api/v3 v3.5.4
+	go.etcd.io/etcd/client/v3 v3.5.4
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -20,29 +20,129 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/pegasus-kv/meta-proxy/admin"
 	"github.com/pegasus-kv/meta-proxy/config"
 	"github.com/pegasus-kv/meta-proxy/meta"
 	"github.com/pegasus-kv/meta-proxy/metrics"
 	"github.com/pegasus-kv/meta-proxy/rpc"
+	"github.com/pegasus-kv/meta-proxy/tracing"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 func main() {
+	opts, err := parseArgs(os.Args[1:], os.Stderr)
+	if err == errHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n\n%s", err, usage)
+		os.Exit(2)
+	}
+
+	switch opts.command {
+	case "version":
+		fmt.Printf("meta-proxy %s\n", version)
+	case "validate-config":
+		if _, err := config.Load(opts.configFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("config file \"%s\" is valid\n", opts.configFile)
+	default:
+		if opts.dryRun {
+			if err := dryRun(opts.configFile, os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+		if err := initLog(opts.logFile, opts.logLevel); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		serve(opts.configFile)
+	}
+}
+
+// initLog writes the log into the file, or stdout if the file is empty or "-".
+func initLog(file string, level string) error {
+	logLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(logLevel)
+	if file == "" || file == "-" {
+		logrus.SetOutput(os.Stdout)
+		return nil
+	}
 	logrus.SetOutput(&lumberjack.Logger{
-		Filename:  os.Args[2],
+		Filename:  file,
 		MaxSize:   500, // MB
 		MaxAge:    7,   // days
 		LocalTime: true,
 	})
+	return nil
+}
 
-	config.Init(os.Args[1])
+// dryRun validates the config file and writes the effective config, including the default values, into out.
+func dryRun(configFile string, out io.Writer) error {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(cfg)
+}
+
+func serve(configFile string) {
+	config.Init(configFile)
+	if err := tracing.Init(); err != nil {
+		logrus.Fatalf("init tracing error: %s", err)
+	}
 	meta.Init()
-	err := rpc.Serve()
+	server, err := rpc.Serve()
 	if err != nil {
 		logrus.Fatalf("start server error: %s", err)
 	}
 	metrics.Init() // metrics must init at last to make sure other package metric counter register completed
+	admin.Init()
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	if err := config.Watch(watchCtx); err != nil {
+		logrus.Errorf("failed to watch config file, it can only be reloaded by restart: %s", err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	logrus.Infof("receive signal %s, start shutting down", sig)
+
+	timeout := time.Duration(config.GlobalConfig.ServerOpts.ShutdownTimeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.Errorf("shutdown server error: %s", err)
+	}
+	meta.Close()
+	if err := admin.Close(ctx); err != nil {
+		logrus.Errorf("close admin server error: %s", err)
+	}
+	if err := metrics.Close(ctx); err != nil {
+		logrus.Errorf("close metrics error: %s", err)
+	}
+	if err := tracing.Close(ctx); err != nil {
+		logrus.Errorf("close tracing error: %s", err)
+	}
+	logrus.Info("meta-proxy exits")
 }
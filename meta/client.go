@@ -21,32 +21,67 @@ package meta
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/XiaoMi/pegasus-go-client/idl/base"
 	"github.com/XiaoMi/pegasus-go-client/session"
 	"github.com/bluele/gcache"
-	"github.com/go-zookeeper/zk"
+	"github.com/pegasus-kv/meta-proxy/admin"
 	"github.com/pegasus-kv/meta-proxy/config"
 	"github.com/pegasus-kv/meta-proxy/metrics"
+	"github.com/pegasus-kv/meta-proxy/tracing"
 	"github.com/sirupsen/logrus"
 )
 
-var zkRequestCount metrics.Meter
+var (
+	zkRequestCount   metrics.Meter
+	zkRequestLatency metrics.Timer
+)
+
+var (
+	metaConnectionCount  metrics.Gauge
+	metaServerDownCount  metrics.Gauge
+	metaProbeFailedCount metrics.Meter
+)
+
+const (
+	minRewatchBackoff = 100 * time.Millisecond
+	maxRewatchBackoff = 10 * time.Second
+)
 
 var globalClusterManager *ClusterManager
 
 type ClusterManager struct {
-	Mut    sync.RWMutex
-	ZkConn *zk.Conn
+	Mut   sync.RWMutex
+	Store RouteStore
 	// table->TableInfoWatcher
 	Tables gcache.Cache
 	// metaAddrs->metaManager
 	Metas map[string]*session.MetaManager
+	// metaAddrs->metaConn, the state of the meta managers in Metas
+	metaConns map[string]*metaConn
+
+	// ready is 1 if the table routes are loaded when warm-up is enabled, otherwise it's always 1
+	ready int32
+	// degraded is 1 if the route store is unavailable at start and the table routes are loaded from snapshot
+	degraded     int32
+	snapshotFile string
+	// snapshotTables is the table routes written into the snapshot last time, guarded by Mut
+	snapshotTables map[string]*ClusterInfo
+	// cancel stops the background goroutines, e.g. warm-up and snapshot
+	cancel context.CancelFunc
+
+	clusterMut sync.Mutex
+	// clusterName->clusterWatcher, the clusters referenced by the cached tables
+	clusters map[string]*clusterWatcher
+
+	// failover routes the tables to their backup clusters, nil means always routing to the primary clusters
+	failover *failover
 }
 
 // zkContext cancels the goroutine that's watching the zkNode, when the watcher
@@ -60,40 +95,171 @@ type TableInfoWatcher struct {
 	tableName   string
 	clusterName string
 	metaAddrs   string
-	event       <-chan zk.Event
+	event       <-chan RouteEvent
 	ctx         zkContext
+	// the unix nano time since when the cluster info can't be refreshed from route store, 0 if it's up to date
+	staleSince int64
+	// cluster is the watcher of the referenced cluster if the table doesn't specify meta_addrs, otherwise nil
+	cluster *clusterWatcher
+	// backup is the cluster the table is switched to once the primary cluster is unhealthy, nil if not set
+	backup *backupCluster
+	// the unix nano time when the table is last looked up or watched, the cache is refilled in this order on resizing
+	lastUsed int64
+	// metaRefs is the set of the clusters whose meta managers the watcher holds references on, guarded by
+	// ClusterManager.Mut. It's nil once the references are released.
+	metaRefs map[string]bool
 }
 
-func initClusterManager() {
-	zkRequestCount = metrics.RegisterMeterWithTags("zk_request_count", []string{"table"})
+// getMetaAddrs returns the meta servers of the primary cluster of the table, which are resolved from the
+// referenced cluster if any.
+func (w *TableInfoWatcher) getMetaAddrs() string {
+	if w.cluster != nil {
+		return w.cluster.getMetaAddrs()
+	}
+	return w.metaAddrs
+}
+
+// staleTime returns the time since when the cluster info is stale, or zero time if it's up to date.
+func (w *TableInfoWatcher) staleTime() time.Time {
+	staleSince := atomic.LoadInt64(&w.staleSince)
+	if staleSince == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, staleSince)
+}
+
+// routedTo returns whether the table is routed to the cluster, as either the primary or the backup cluster.
+func (w *TableInfoWatcher) routedTo(metaAddrs string) bool {
+	return metaAddrs == w.getMetaAddrs() || (w.backup != nil && metaAddrs == w.backup.getMetaAddrs())
+}
 
-	zkAddrs := config.GlobalConfig.ZookeeperOpts.Address
-	zkConn, _, err := zk.Connect(config.GlobalConfig.ZookeeperOpts.Address,
-		time.Duration(config.GlobalConfig.ZookeeperOpts.Timeout*1000000)) // the config value unit is ms, but zk request ns)
+// routedAddrsLocked returns all the clusters the table may have been routed to, including the current primary
+// and backup clusters and the ones the watcher holds references on. It must be called with ClusterManager.Mut held.
+func (w *TableInfoWatcher) routedAddrsLocked() []string {
+	addrsSet := map[string]bool{w.getMetaAddrs(): true}
+	if w.backup != nil {
+		addrsSet[w.backup.getMetaAddrs()] = true
+	}
+	for addrs := range w.metaRefs {
+		addrsSet[addrs] = true
+	}
+	result := make([]string, 0, len(addrsSet))
+	for addrs := range addrsSet {
+		result = append(result, addrs)
+	}
+	return result
+}
+
+func (w *TableInfoWatcher) touch() {
+	atomic.StoreInt64(&w.lastUsed, time.Now().UnixNano())
+}
+
+func initClusterManager() {
+	store, err := newRouteStore()
 	if err != nil {
-		logrus.Panicf("failed to connect to zookeeper \"%s\": %s", zkAddrs, err)
+		logrus.Panicf("failed to init route store: %s", err)
 	}
 
-	tables := gcache.New(config.GlobalConfig.ZookeeperOpts.WatcherCount).LRU().EvictedFunc(func(key interface{}, value interface{}) {
-		value.(*TableInfoWatcher).ctx.cancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	globalClusterManager = &ClusterManager{
+		Store:    store,
+		Tables:   newTableCache(config.GlobalConfig.ZookeeperOpts.WatcherCount),
+		Metas:    make(map[string]*session.MetaManager),
+		cancel:   cancel,
+		failover: newFailover(),
+	}
+	admin.Register("/tables", handleListTables)
+	admin.Register("/tables/refresh", handleRefreshTable)
+	admin.Register("/tables/evict", handleEvictTable)
+	admin.Register("/ready", handleReady)
+	admin.Register("/failover", handleFailover)
+	admin.Register("/failover/pin", handleFailoverPin)
+	admin.Register("/failover/unpin", handleFailoverUnpin)
+	admin.Register("/metas", handleListMetas)
+	go globalClusterManager.failover.run(ctx, globalClusterManager)
+	config.Subscribe(globalClusterManager.reloadConfig)
+
+	metaOpts := config.GlobalConfig.MetaOpts
+	go globalClusterManager.maintainMetas(ctx, time.Duration(metaOpts.CheckInterval)*time.Millisecond,
+		time.Duration(metaOpts.CheckTimeout)*time.Millisecond)
+
+	opts := config.GlobalConfig.RouteOpts
+	if opts.SnapshotFile != "" {
+		globalClusterManager.startSnapshot(ctx, opts.SnapshotFile, time.Duration(opts.SnapshotInterval)*time.Millisecond)
+	}
+	if opts.WarmUp {
+		go globalClusterManager.warmUp(ctx)
+	} else {
+		globalClusterManager.ready = 1
+	}
+}
+
+// newTableCache creates the LRU cache of the table watchers, the watcher is stopped once it's evicted. The cache
+// is only updated with ClusterManager.Mut held.
+func newTableCache(capacity int) gcache.Cache {
+	return gcache.New(capacity).LRU().EvictedFunc(func(key interface{}, value interface{}) {
+		tableInfo := value.(*TableInfoWatcher)
+		tableInfo.ctx.cancel()
+		globalConfigCache.invalidateTable(tableInfo)
 		logrus.Debugf("[%s] zk watcher is evicted", key.(string))
 	}).Build() // TODO(jiashuo1) consider set expire time
-	globalClusterManager = &ClusterManager{
-		ZkConn: zkConn,
-		Tables: tables,
-		Metas:  make(map[string]*session.MetaManager),
+}
+
+// tableCache returns the cache of the table watchers for the callers without m.Mut held, the cache is replaced
+// once its capacity is changed by reloading the config.
+func (m *ClusterManager) tableCache() gcache.Cache {
+	m.Mut.RLock()
+	defer m.Mut.RUnlock()
+	return m.Tables
+}
+
+// close stops all the table watchers and closes the route store and the connections to meta servers.
+func (m *ClusterManager) close() {
+	if m.cancel != nil {
+		m.cancel()
 	}
+	if m.snapshotFile != "" && !m.isDegraded() {
+		if err := m.writeSnapshot(); err != nil {
+			logrus.Errorf("failed to write route snapshot: %s", err)
+		}
+	}
+
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+
+	for _, tableInfo := range m.Tables.GetALL(false) {
+		tableInfo.(*TableInfoWatcher).ctx.cancel()
+	}
+	m.Tables.Purge()
+	for addrs := range m.Metas {
+		m.closeMetaLocked(addrs)
+	}
+	m.Store.Close()
 }
 
-// return (metaAddr, metaManager, error)
-func (m *ClusterManager) getMeta(table string) (string, *session.MetaManager, error) {
-	var addrs string
-	var meta *session.MetaManager
+// getMeta returns the meta servers the table is routed to and the meta manager of them. The meta manager is
+// referenced by the request until it's released by releaseMeta(addrs), so it's not closed in use even if the
+// table is evicted or routed to another cluster meanwhile.
+func (m *ClusterManager) getMeta(ctx context.Context, table string) (addrs string, meta *session.MetaManager,
+	err error) {
+	ctx, span := tracing.Start(ctx, "getMeta", tracing.TableKey.String(table))
+	defer func() {
+		span.SetAttributes(tracing.MetaAddrsKey.String(addrs))
+		tracing.End(span, err)
+	}()
 
-	tableInfo, err := m.Tables.Get(table)
+	tableInfo, err := m.tableCache().Get(table)
 	if err == nil {
-		addrs = tableInfo.(*TableInfoWatcher).metaAddrs
-		meta = m.Metas[tableInfo.(*TableInfoWatcher).metaAddrs]
+		tableInfoW := tableInfo.(*TableInfoWatcher)
+		tableInfoW.touch()
+		addrs = m.failover.route(tableInfoW)
+		m.Mut.RLock()
+		if conn := m.metaConns[addrs]; conn != nil && tableInfoW.metaRefs[addrs] {
+			meta = m.Metas[addrs]
+			atomic.AddInt32(&conn.refs, 1)
+			conn.touch()
+		}
+		m.Mut.RUnlock()
 		if meta != nil {
 			return addrs, meta, nil
 		}
@@ -104,7 +270,7 @@ func (m *ClusterManager) getMeta(table string) (string, *session.MetaManager, er
 	defer m.Mut.Unlock()
 	tableInfo, err = m.Tables.Get(table)
 	if err != nil {
-		tableInfo, err = m.newTableInfo(table)
+		tableInfo, err = m.newTableInfo(ctx, table)
 		if err != nil {
 			logrus.Errorf("[%s] failed to get cluster info: %s", table, err)
 			return "", nil, err
@@ -116,108 +282,289 @@ func (m *ClusterManager) getMeta(table string) (string, *session.MetaManager, er
 		}
 	}
 	tableInfoW := tableInfo.(*TableInfoWatcher)
-	addrs = tableInfoW.metaAddrs
-	meta = m.Metas[addrs]
+	tableInfoW.touch()
+	addrs = m.failover.route(tableInfoW)
+	meta, err = m.refMetaLocked(tableInfoW, addrs)
+	if err != nil {
+		logrus.Errorf("[%s] cluster addr[%s] format is err: %s", table, addrs, err)
+		return "", nil, base.ERR_INVALID_DATA
+	}
+	atomic.AddInt32(&m.metaConns[addrs].refs, 1)
+
+	return addrs, meta, nil
+}
+
+// getMetaAddrs returns the meta servers the table is routed to, the meta manager isn't referenced.
+func (m *ClusterManager) getMetaAddrs(ctx context.Context, table string) (string, error) {
+	addrs, _, err := m.getMeta(ctx, table)
+	if err != nil {
+		return "", err
+	}
+	m.releaseMeta(addrs)
+	return addrs, nil
+}
+
+// getMetaManagerLocked returns the cached meta manager of the cluster, or creates a new one if not exists.
+// It must be called with m.Mut held.
+func (m *ClusterManager) getMetaManagerLocked(addrs string) (*session.MetaManager, error) {
+	meta := m.Metas[addrs]
 	if meta == nil {
 		metaList, err := parseToMetaList(addrs)
 		if err != nil {
-			logrus.Errorf("[%s] cluster addr[%s] format is err: %s", table, addrs, err)
-			return "", nil, base.ERR_INVALID_DATA
+			return nil, err
 		}
 		meta = session.NewMetaManager(metaList, session.NewNodeSession)
 		m.Metas[addrs] = meta
+		if m.metaConns == nil {
+			m.metaConns = make(map[string]*metaConn)
+		}
+		m.metaConns[addrs] = newMetaConn(addrs, metaList)
+		metaConnectionCount.Inc()
+		logrus.Infof("meta manager[%s] is created", addrs)
+	} else if conn := m.metaConns[addrs]; conn != nil {
+		conn.touch()
 	}
-
-	return addrs, meta, nil
+	return meta, nil
 }
 
-// get table cluster info and watch it based table name from zk
-// The zookeeper path layout:
-// /<RegionPathRoot>/<table> =>
-//                         {
-//                           "cluster_name" : "clusterName",
-//                           "meta_addrs" : "metaAddr1,metaAddr2,metaAddr3"
-//                         }
-func (m *ClusterManager) newTableInfo(table string) (*TableInfoWatcher, error) {
+// newTableInfo gets the cluster info of the table from route store and watches it. The ctx is only used for
+// tracing, the watch lives until the table is removed from the local cache.
+func (m *ClusterManager) newTableInfo(traceCtx context.Context, table string) (tableInfo *TableInfoWatcher,
+	err error) {
 	zkRequestCount.UpdateWithTags([]string{table})
+	_, span := tracing.Start(traceCtx, "newTableInfo", tracing.TableKey.String(table))
+	defer func() {
+		tracing.End(span, err)
+	}()
 
-	path := fmt.Sprintf("%s/%s", config.GlobalConfig.ZookeeperOpts.Root, table)
-	value, _, watcherEvent, err := m.ZkConn.GetW(path)
-	zkAddrs := config.GlobalConfig.ZookeeperOpts.Address
-	if err != nil {
-		if err == zk.ErrNoNode {
-			logrus.Errorf("[%s] cluster info doesn't exist on zk[%s(%s)], err: %s", table, zkAddrs, path, err)
-			return nil, base.ERR_OBJECT_NOT_FOUND
-		}
-		logrus.Errorf("[%s] failed to get cluster info from zk[%s(%s)]: %s", table, zkAddrs, path, err)
-		return nil, base.ERR_ZOOKEEPER_OPERATION
-	}
-
-	type clusterInfoStruct struct {
-		Name      string `json:"cluster_name"`
-		MetaAddrs string `json:"meta_addrs"`
-	}
-	var cluster = &clusterInfoStruct{}
-	err = json.Unmarshal(value, cluster)
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	cluster, events, err := m.Store.Watch(ctx, table)
+	zkRequestLatency.UpdateSinceWithTags([]string{table}, start)
 	if err != nil {
-		logrus.Errorf("[%s] cluster info on zk[%s(%s)] format is invalid, err = %s", table, zkAddrs, path, err)
-		return nil, base.ERR_INVALID_DATA
+		cancel()
+		return nil, err
 	}
+	span.SetAttributes(tracing.ClusterKey.String(cluster.Name), tracing.MetaAddrsKey.String(cluster.MetaAddrs))
 
-	ctx, cancel := context.WithCancel(context.Background())
-	tableInfo := &TableInfoWatcher{
+	tableInfo = &TableInfoWatcher{
 		tableName:   table,
 		clusterName: cluster.Name,
 		metaAddrs:   cluster.MetaAddrs,
-		event:       watcherEvent,
+		event:       events,
 		ctx: zkContext{
 			ctx:    ctx,
 			cancel: cancel,
 		},
+		lastUsed: time.Now().UnixNano(),
+		metaRefs: make(map[string]bool),
+	}
+	// the table or its backup may reference the shared cluster record by name
+	var clusters []*clusterWatcher
+	release := func() {
+		cancel()
+		for _, clusterWatcher := range clusters {
+			m.releaseCluster(clusterWatcher)
+		}
+	}
+	if cluster.MetaAddrs == "" {
+		clusterWatcher, err := m.acquireCluster(cluster.Name)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		tableInfo.cluster = clusterWatcher
+		clusters = append(clusters, clusterWatcher)
+	}
+	if backup := cluster.Backup; backup != nil {
+		tableInfo.backup = &backupCluster{clusterName: backup.Name, metaAddrs: backup.MetaAddrs}
+		if backup.MetaAddrs == "" {
+			clusterWatcher, err := m.acquireCluster(backup.Name)
+			if err != nil {
+				release()
+				return nil, err
+			}
+			tableInfo.backup.cluster = clusterWatcher
+			clusters = append(clusters, clusterWatcher)
+		}
+	}
+	if len(clusters) > 0 {
+		tableInfo.ctx.cancel = m.withClustersReleased(cancel, clusters)
 	}
 	go m.watchTableInfoChanged(tableInfo)
 
 	return tableInfo, nil
 }
 
+// watchTableInfoChanged waits for the route event of the table and refreshes the local cache. The watch is
+// re-established after the event, including the one notifying that the watch is lost (e.g. zookeeper session
+// expired). If the route store is unavailable, it retries with backoff and the last-known cluster info keeps
+// serving, the table is marked as stale until the refresh succeeds.
 func (m *ClusterManager) watchTableInfoChanged(watcher *TableInfoWatcher) {
+	// the watcher is replaced or removed after the event is handled, release its watch and meta managers
+	defer m.releaseTableMetas(watcher)
+	defer watcher.ctx.cancel()
+
+	var event RouteEvent
 	select {
-	case event := <-watcher.event:
-		tableName, err := parseToTableName(event.Path)
-		if err != nil {
-			logrus.Panicf("zk path \"%s\" is corrupt, unable to parse table name: %s", event.Path, err)
+	case event = <-watcher.event:
+	case <-watcher.ctx.ctx.Done():
+		return
+	}
+
+	tableName := watcher.tableName
+	m.Mut.RLock()
+	globalConfigCache.invalidateTable(watcher)
+	m.Mut.RUnlock()
+	switch event.Type {
+	case RouteDeleted:
+		m.removeTableInfo(watcher)
+		return
+	case RouteChanged:
+	default:
+		logrus.Warnf("[%s] table watcher is lost by event %s(%v), re-watch it", tableName, event.Type.String(), event.Err)
+	}
+
+	backoff := minRewatchBackoff
+	for {
+		tableInfo, err := m.newTableInfo(context.Background(), tableName)
+		if err == nil {
+			m.replaceTableInfo(watcher, tableInfo)
+			return
 		}
-		if event.Type == zk.EventNodeDataChanged {
-			tableInfo, err := m.newTableInfo(tableName)
-			if err != nil {
-				logrus.Panicf("[%s] failed to get cluster info when trigger watcher: %s", tableName, err)
+		if err == base.ERR_OBJECT_NOT_FOUND {
+			m.removeTableInfo(watcher)
+			return
+		}
+		if atomic.CompareAndSwapInt64(&watcher.staleSince, 0, time.Now().UnixNano()) {
+			logrus.Warnf("[%s] local cache cluster info %s(%s) becomes stale", tableName,
+				watcher.clusterName, watcher.getMetaAddrs())
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-watcher.ctx.ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxRewatchBackoff {
+			backoff = maxRewatchBackoff
+		}
+	}
+}
+
+// replaceTableInfo updates the local cache to the refreshed cluster info, unless the old watcher has been
+// evicted or removed during the refresh.
+func (m *ClusterManager) replaceTableInfo(old *TableInfoWatcher, tableInfo *TableInfoWatcher) {
+	tableName := old.tableName
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	if cached, err := m.Tables.Get(tableName); err != nil || cached != old {
+		tableInfo.ctx.cancel()
+		logrus.Infof("[%s] local cache cluster info is no longer watched", tableName)
+		return
+	}
+	if err := m.Tables.Set(tableName, tableInfo); err != nil {
+		tableInfo.ctx.cancel()
+		logrus.Errorf("[%s] failed to update local cache cluster info to %s(%s): %s",
+			tableName, tableInfo.clusterName, tableInfo.getMetaAddrs(), err)
+		return
+	}
+	m.inheritMetaRefsLocked(old, tableInfo)
+	if staleSince := old.staleTime(); !staleSince.IsZero() {
+		logrus.Infof("[%s] local cache cluster info is recovered from stale since %s", tableName, staleSince)
+	}
+	logrus.Infof("[%s] local cache cluster info is updated to %s(%s)", tableName,
+		tableInfo.clusterName, tableInfo.getMetaAddrs())
+}
+
+// removeTableInfo removes the cluster info of the table from local cache, if it's still watched by the watcher.
+func (m *ClusterManager) removeTableInfo(watcher *TableInfoWatcher) {
+	tableName := watcher.tableName
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	if cached, err := m.Tables.Get(tableName); err == nil && cached == watcher {
+		m.Tables.Remove(tableName)
+		delete(m.snapshotTables, tableName)
+		logrus.Infof("[%s] local cache cluster info is removed", tableName)
+	}
+}
+
+// warmUp loads all the table routes into local cache, and keeps loading the tables added later. The cluster
+// manager becomes ready once the table routes are loaded for the first time.
+func (m *ClusterManager) warmUp(ctx context.Context) {
+	backoff := minRewatchBackoff
+	for {
+		tables, events, err := m.Store.WatchList(ctx)
+		if err == nil {
+			loaded := m.loadTables(tables)
+			if atomic.CompareAndSwapInt32(&m.ready, 0, 1) {
+				logrus.Infof("%d of %d tables are loaded, cluster manager is ready", loaded, len(tables))
 			}
-			m.Mut.Lock()
-			err = m.Tables.Set(tableName, tableInfo)
-			m.Mut.Unlock()
-			if err != nil {
-				logrus.Panicf("[%s] failed to update local cache cluster info to %s(%s): %s",
-					tableName, tableInfo.clusterName, tableInfo.metaAddrs, err)
+			backoff = minRewatchBackoff
+			select {
+			case event := <-events:
+				logrus.Infof("table list is changed by event %s(%v), reload it", event.Type.String(), event.Err)
+				continue
+			case <-ctx.Done():
+				return
 			}
-			logrus.Infof("[%s] local cache cluster info is updated to %s(%s)", tableName,
-				tableInfo.clusterName, tableInfo.metaAddrs)
-		} else if event.Type == zk.EventNodeDeleted {
-			m.Mut.Lock()
-			if m.Tables.Has(tableName) {
-				success := m.Tables.Remove(tableName)
-				if !success {
-					logrus.Panicf("[%s] failed to remove local cache cluster info", tableName)
-				}
+		}
+
+		logrus.Warnf("failed to load table list, retry after %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxRewatchBackoff {
+			backoff = maxRewatchBackoff
+		}
+	}
+}
+
+// loadTables loads and watches the tables which are not in local cache, it returns the number of the loaded tables.
+func (m *ClusterManager) loadTables(tables map[string]*ClusterInfo) int {
+	if capacity := config.Current().ZookeeperOpts.WatcherCount; len(tables) > capacity {
+		logrus.Warnf("table count %d exceeds the cache capacity %d, some tables will be evicted", len(tables), capacity)
+	}
+
+	loaded := 0
+	for table := range tables {
+		m.Mut.Lock()
+		if !m.Tables.Has(table) {
+			tableInfo, err := m.newTableInfo(context.Background(), table)
+			if err == nil {
+				err = m.Tables.Set(table, tableInfo)
+			}
+			if err != nil {
+				logrus.Warnf("[%s] failed to load cluster info: %s", table, err)
+				m.Mut.Unlock()
+				continue
 			}
-			m.Mut.Unlock()
-			logrus.Infof("[%s] local cache cluster info is removed", tableName)
-		} else {
-			logrus.Errorf("[%s] unexpected zk event, type = %s.", tableName, event.Type.String())
 		}
+		m.Mut.Unlock()
+		loaded++
+	}
+	return loaded
+}
 
-	case <-watcher.ctx.ctx.Done():
-		return
+func (m *ClusterManager) isReady() bool {
+	return atomic.LoadInt32(&m.ready) == 1
+}
+
+// handleReady is the admin handler for readiness probe, it responds 503 until the cluster manager is ready.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	ready := globalClusterManager.isReady()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
 	}
+	admin.RenderJSONWithStatus(w, status, map[string]interface{}{
+		"ready":    ready,
+		"degraded": globalClusterManager.isDegraded(),
+	})
 }
 
 func parseToMetaList(metaAddrs string) ([]string, error) {
@@ -227,17 +574,3 @@ func parseToMetaList(metaAddrs string) ([]string, error) {
 	}
 	return result, nil
 }
-
-// parseToTableName extracts table name from the zookeeper path.
-// The zookeeper path layout:
-// /<RegionPathRoot>
-//            /<table1> => {JSON}
-//            /<table2> => {JSON}
-func parseToTableName(path string) (string, error) {
-	result := strings.Split(path, "/")
-	if len(result) < 3 {
-		return "", fmt.Errorf("the path[%s] is invalid", path)
-	}
-
-	return result[len(result)-1], nil
-}
@@ -20,9 +20,12 @@
 package meta
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -80,6 +83,11 @@ var updates = []update{
 	},
 }
 
+// zkConn returns the zookeeper connection of the global route store.
+func zkConn() *zk.Conn {
+	return globalClusterManager.Store.(*zkRouteStore).getConn()
+}
+
 func initTestLog() {
 	writers := []io.Writer{
 		&lumberjack.Logger{
@@ -90,50 +98,69 @@ func initTestLog() {
 	logrus.SetOutput(io.MultiWriter(writers...))
 }
 
-// init the zk data
-func init() {
+func TestMain(m *testing.M) {
 	initTestLog()
 	config.Init("../config/yaml/meta-proxy-example.yml")
-	config.GlobalConfig.ZookeeperOpts.WatcherCount = 2
-	initClusterManager()
+	registerMetrics()
+	initConfigCache()
+	os.Exit(m.Run())
+}
 
-	acls := zk.WorldACL(zk.PermAll)
-	zkRoot := config.GlobalConfig.ZookeeperOpts.Root
-	ret, _, _ := globalClusterManager.ZkConn.Exists(zkRoot)
-	if !ret {
-		_, err := globalClusterManager.ZkConn.Create(zkRoot, []byte{}, 0, zk.WorldACL(zk.PermAll))
-		if err != nil {
-			panic(err)
-		}
+var zkSetupOnce sync.Once
+
+// setupZookeeper inits the global cluster manager on the zookeeper of the example config and creates the test
+// tables on it once, the test is skipped if the zookeeper is unreachable.
+func setupZookeeper(t *testing.T) {
+	zkAddr := config.GlobalConfig.ZookeeperOpts.Address[0]
+	conn, err := net.DialTimeout("tcp", zkAddr, time.Second)
+	if err != nil {
+		t.Skipf("zookeeper[%s] is unreachable: %s", zkAddr, err)
 	}
+	_ = conn.Close()
 
-	for _, test := range tests {
-		ret, stat, _ := globalClusterManager.ZkConn.Exists(test.path)
-		if ret {
-			_ = globalClusterManager.ZkConn.Delete(test.path, stat.Version)
+	zkSetupOnce.Do(func() {
+		config.GlobalConfig.ZookeeperOpts.WatcherCount = 2
+		initClusterManager()
+
+		acls := zk.WorldACL(zk.PermAll)
+		zkRoot := config.GlobalConfig.ZookeeperOpts.Root
+		ret, _, _ := zkConn().Exists(zkRoot)
+		if !ret {
+			_, err := zkConn().Create(zkRoot, []byte{}, 0, zk.WorldACL(zk.PermAll))
+			if err != nil {
+				t.Fatalf("failed to create zookeeper root: %s", err)
+			}
 		}
-		_, err := globalClusterManager.ZkConn.Create(test.path, []byte(test.data), 0, acls)
-		if err != nil {
-			panic(err)
+
+		for _, test := range tests {
+			ret, stat, _ := zkConn().Exists(test.path)
+			if ret {
+				_ = zkConn().Delete(test.path, stat.Version)
+			}
+			_, err := zkConn().Create(test.path, []byte(test.data), 0, acls)
+			if err != nil {
+				t.Fatalf("failed to create zookeeper node %s: %s", test.path, err)
+			}
 		}
-	}
+	})
 }
 
 func TestGetTable(t *testing.T) {
+	setupZookeeper(t)
 	// pass zkAddr can't be connected
 	config.GlobalConfig.ZookeeperOpts.Address = []string{"128.0.0.1:22171"}
 	initClusterManager()
-	_, err := globalClusterManager.newTableInfo("notExist")
+	_, err := globalClusterManager.newTableInfo(context.Background(), "notExist")
 	assert.Equal(t, err, base.ERR_ZOOKEEPER_OPERATION)
 
 	config.GlobalConfig.ZookeeperOpts.Address = []string{"127.0.0.1:22181"}
 	initClusterManager()
 	// pass not existed table name
-	_, err = globalClusterManager.newTableInfo("notExist")
+	_, err = globalClusterManager.newTableInfo(context.Background(), "notExist")
 	assert.Equal(t, err, base.ERR_OBJECT_NOT_FOUND)
 	// pass exist table
 	for _, test := range tests {
-		addrs, err := globalClusterManager.newTableInfo(test.table)
+		addrs, err := globalClusterManager.newTableInfo(context.Background(), test.table)
 		if err != nil {
 			logrus.Panic(err)
 		}
@@ -142,12 +169,13 @@ func TestGetTable(t *testing.T) {
 }
 
 func TestGetMetaConnector(t *testing.T) {
+	setupZookeeper(t)
 	config.GlobalConfig.ZookeeperOpts.Address = []string{"127.0.0.1:22181"}
 	initClusterManager()
 
 	// first get connector which will init the cache and only store `stat` and `test` table watcher
 	for _, test := range tests {
-		_, _, _ = globalClusterManager.getMeta(test.table)
+		_, _ = globalClusterManager.getMetaAddrs(context.Background(), test.table)
 		cacheWatcher, _ := globalClusterManager.Tables.Get(test.table)
 		assert.Equal(t, test.addr, cacheWatcher.(*TableInfoWatcher).metaAddrs)
 	}
@@ -163,20 +191,22 @@ func TestGetMetaConnector(t *testing.T) {
 		} else {
 			assert.Equal(t, test.addr, cacheWatcher.(*TableInfoWatcher).metaAddrs)
 			assert.NotNil(t, globalClusterManager.Metas[test.addr])
-			_, meta, _ := globalClusterManager.getMeta(test.table)
+			addrs, meta, _ := globalClusterManager.getMeta(context.Background(), test.table)
 			assert.NotNil(t, meta)
+			globalClusterManager.releaseMeta(addrs)
 		}
 	}
 }
 
 func TestZookeeperUpdate(t *testing.T) {
+	setupZookeeper(t)
 	zkRoot := config.GlobalConfig.ZookeeperOpts.Root
 	for _, test := range tests {
-		_, _, _ = globalClusterManager.getMeta(test.table)
+		_, _ = globalClusterManager.getMetaAddrs(context.Background(), test.table)
 		// update zookeeper node data and trigger the watch event update local cache
 		for _, update := range updates {
-			_, stat, _ := globalClusterManager.ZkConn.Get(test.path)
-			_, err := globalClusterManager.ZkConn.Set(test.path, []byte(update.data), stat.Version)
+			_, stat, _ := zkConn().Get(test.path)
+			_, err := zkConn().Set(test.path, []byte(update.data), stat.Version)
 			if err != nil {
 				panic(err)
 			}
@@ -189,45 +219,176 @@ func TestZookeeperUpdate(t *testing.T) {
 	}
 
 	// delete the zk node data and the local local cache is also removed
-	_, stat, _ := globalClusterManager.ZkConn.Get(zkRoot + "/test")
-	_ = globalClusterManager.ZkConn.Delete(zkRoot+"/test", stat.Version)
+	_, stat, _ := zkConn().Get(zkRoot + "/test")
+	_ = zkConn().Delete(zkRoot+"/test", stat.Version)
 	time.Sleep(time.Duration(10000000))
 	cacheWatcher, _ := globalClusterManager.Tables.Get("test")
 	assert.Nil(t, cacheWatcher)
 }
 
-func TestParseTablePath(t *testing.T) {
-	zkRoot := config.GlobalConfig.ZookeeperOpts.Root
-	type table struct {
-		path   string
-		result error
-	}
-
-	tablePaths := []table{
-		{
-			path:   zkRoot,
-			result: fmt.Errorf("the path[%s] is invalid", zkRoot),
-		},
-		{
-			path:   zkRoot + "/name",
-			result: nil,
-		},
-		{
-			path:   zkRoot + "//name",
-			result: nil,
-		},
-		{
-			path:   zkRoot + "/table/name",
-			result: nil,
+// newTestWatcher returns a watcher of the table whose route events are sent by the returned channel.
+func newTestWatcher(table string, addrs string) (*TableInfoWatcher, chan RouteEvent) {
+	events := make(chan RouteEvent, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TableInfoWatcher{
+		tableName:   table,
+		clusterName: "onebox",
+		metaAddrs:   addrs,
+		event:       events,
+		ctx: zkContext{
+			ctx:    ctx,
+			cancel: cancel,
 		},
+	}, events
+}
+
+func TestZookeeperRewatch(t *testing.T) {
+	setupZookeeper(t)
+	test := tests[1]
+	_, _ = globalClusterManager.getMetaAddrs(context.Background(), test.table)
+	cached, _ := globalClusterManager.Tables.Get(test.table)
+	cached.(*TableInfoWatcher).ctx.cancel()
+
+	watcher, events := newTestWatcher(test.table, test.addr)
+	_ = globalClusterManager.Tables.Set(test.table, watcher)
+	go globalClusterManager.watchTableInfoChanged(watcher)
+
+	// the watch is lost when the zk session expires, it will be re-established
+	events <- RouteEvent{Type: RouteWatchLost, Err: zk.ErrSessionExpired}
+	time.Sleep(100 * time.Millisecond)
+	cached, _ = globalClusterManager.Tables.Get(test.table)
+	assert.NotEqual(t, watcher, cached)
+	assert.Equal(t, test.addr, cached.(*TableInfoWatcher).metaAddrs)
+	assert.True(t, cached.(*TableInfoWatcher).staleTime().IsZero())
+}
+
+func TestZookeeperReconnect(t *testing.T) {
+	setupZookeeper(t)
+	test := tests[0]
+	_, _ = globalClusterManager.getMetaAddrs(context.Background(), test.table)
+	old, _ := globalClusterManager.Tables.Get(test.table)
+
+	// the table is re-watched on the new connection once the zookeeper options are reloaded
+	oldCfg := config.Current()
+	cfg := *oldCfg
+	cfg.ZookeeperOpts.Timeout = oldCfg.ZookeeperOpts.Timeout * 2
+	globalClusterManager.reloadConfig(oldCfg, &cfg)
+	assert.Eventually(t, func() bool {
+		cached, err := globalClusterManager.tableCache().Get(test.table)
+		return err == nil && cached != old
+	}, 3*time.Second, 10*time.Millisecond)
+	addrs, err := globalClusterManager.getMetaAddrs(context.Background(), test.table)
+	assert.Nil(t, err)
+	assert.Equal(t, test.addr, addrs)
+}
+
+func TestZookeeperUnavailable(t *testing.T) {
+	zkConn, _, err := zk.Connect([]string{"127.0.0.1:1"}, time.Second)
+	assert.Nil(t, err)
+	defer zkConn.Close()
+	m := newTestClusterManager(&zkRouteStore{conn: zkConn, addrs: []string{"127.0.0.1:1"}, root: zkRootTest})
+
+	watcher, events := newTestWatcher("temp", "127.0.0.1:34601,127.0.0.1:34602")
+	_ = m.Tables.Set("temp", watcher)
+	done := make(chan struct{})
+	go func() {
+		m.watchTableInfoChanged(watcher)
+		close(done)
+	}()
+	assert.Equal(t, []TableInfo{{Table: "temp", ClusterName: "onebox", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602",
+		State: tableWatching}}, m.listTableInfos())
+
+	// the last-known cluster info keeps serving while zookeeper is unavailable
+	events <- RouteEvent{Type: RouteChanged}
+	time.Sleep(300 * time.Millisecond)
+	cached, _ := m.Tables.Get("temp")
+	assert.Equal(t, watcher, cached)
+	tables := m.listTableInfos()
+	assert.Equal(t, 1, len(tables))
+	assert.NotNil(t, tables[0].StaleSince)
+	assert.Equal(t, tableStale, tables[0].State)
+
+	// the retry stops once the watcher is evicted
+	m.evictTable("temp")
+	watcher.ctx.cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the watcher is still retrying")
 	}
+	assert.Empty(t, m.listTableInfos())
+}
 
-	for _, tb := range tablePaths {
-		ret, err := parseToTableName(tb.path)
-		assert.Equal(t, err, tb.result)
-		if err == nil {
-			assert.Equal(t, "name", ret)
+func TestZookeeperWarmUp(t *testing.T) {
+	setupZookeeper(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	m := newTestClusterManager(globalClusterManager.Store)
+	m.cancel = cancel
+	defer cancel()
+
+	go m.warmUp(ctx)
+	assert.Eventually(t, m.isReady, 3*time.Second, 10*time.Millisecond)
+	assert.True(t, m.Tables.Has("temp"))
+	assert.True(t, m.Tables.Has("stat"))
+
+	// the table added later is also loaded
+	path := zkRootTest + "/warmup"
+	_, err := zkConn().Create(path, []byte(tests[0].data), 0, zk.WorldACL(zk.PermAll))
+	assert.Nil(t, err)
+	defer func() {
+		_ = zkConn().Delete(path, -1)
+	}()
+	assert.Eventually(t, func() bool {
+		return m.Tables.Has("warmup")
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestZookeeperClusterRecord(t *testing.T) {
+	setupZookeeper(t)
+	acls := zk.WorldACL(zk.PermAll)
+	clustersPath := zkRootTest + "/" + zkClustersNode
+	nodes := []struct {
+		path string
+		data string
+	}{
+		{clustersPath, ""},
+		{clustersPath + "/shared", "{\"meta_addrs\": \"127.0.0.1:34601,127.0.0.1:34602\"}"},
+		{clustersPath + "/shared_alias", "{\"alias\": \"shared\"}"},
+		{zkRootTest + "/shared1", "{\"cluster_name\": \"shared\"}"},
+		{zkRootTest + "/shared2", "{\"cluster_name\": \"shared_alias\"}"},
+	}
+	for _, node := range nodes {
+		_, err := zkConn().Create(node.path, []byte(node.data), 0, acls)
+		assert.Nil(t, err)
+	}
+	defer func() {
+		for i := len(nodes) - 1; i >= 0; i-- {
+			_ = zkConn().Delete(nodes[i].path, -1)
 		}
+	}()
+
+	m := newTestClusterManager(globalClusterManager.Store)
+	tables, err := m.Store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", tables["shared2"].MetaAddrs)
+	assert.NotContains(t, tables, zkClustersNode)
+
+	for _, table := range []string{"shared1", "shared2"} {
+		addrs, err := m.getMetaAddrs(context.Background(), table)
+		assert.Nil(t, err)
+		assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", addrs)
+	}
+
+	// one update on the cluster node re-routes all the tables referencing it
+	_, err = zkConn().Set(clustersPath+"/shared", []byte("{\"meta_addrs\": \"127.0.1.1:34601,127.0.1.1:34602\"}"), -1)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		addrs1, _ := m.getMetaAddrs(context.Background(), "shared1")
+		addrs2, _ := m.getMetaAddrs(context.Background(), "shared2")
+		return addrs1 == "127.0.1.1:34601,127.0.1.1:34602" && addrs2 == addrs1
+	}, 3*time.Second, 10*time.Millisecond)
+	for _, tableInfo := range m.Tables.GetALL(false) {
+		tableInfo.(*TableInfoWatcher).ctx.cancel()
 	}
 }
 
@@ -0,0 +1,147 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/sirupsen/logrus"
+)
+
+// clusterWatcher watches the cluster record shared by the tables referencing the cluster by name, so that
+// all of them are re-routed at once when the meta servers of the cluster are changed.
+type clusterWatcher struct {
+	name string
+	// metaAddrs is the last-known meta servers of the cluster, string
+	metaAddrs atomic.Value
+	// refs is the number of the table watchers referencing the cluster, guarded by ClusterManager.clusterMut
+	refs int
+	ctx  zkContext
+}
+
+func (c *clusterWatcher) getMetaAddrs() string {
+	return c.metaAddrs.Load().(string)
+}
+
+// acquireCluster returns the watcher of the cluster, the cluster is watched if it's not referenced yet.
+// The watcher must be released by releaseCluster.
+func (m *ClusterManager) acquireCluster(name string) (*clusterWatcher, error) {
+	store, ok := m.Store.(ClusterStore)
+	if !ok {
+		logrus.Errorf("[%s] route store doesn't support the cluster reference, meta_addrs is required", name)
+		return nil, base.ERR_INVALID_DATA
+	}
+
+	m.clusterMut.Lock()
+	defer m.clusterMut.Unlock()
+	if cluster := m.clusters[name]; cluster != nil {
+		cluster.refs++
+		return cluster, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	metaAddrs, events, err := store.WatchCluster(ctx, name)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	cluster := &clusterWatcher{
+		name: name,
+		refs: 1,
+		ctx: zkContext{
+			ctx:    ctx,
+			cancel: cancel,
+		},
+	}
+	cluster.metaAddrs.Store(metaAddrs)
+	if m.clusters == nil {
+		m.clusters = make(map[string]*clusterWatcher)
+	}
+	m.clusters[name] = cluster
+	go m.watchClusterChanged(store, cluster, events)
+	return cluster, nil
+}
+
+// releaseCluster releases the reference of the cluster, the cluster is no longer watched if it's not referenced.
+func (m *ClusterManager) releaseCluster(cluster *clusterWatcher) {
+	m.clusterMut.Lock()
+	defer m.clusterMut.Unlock()
+	cluster.refs--
+	if cluster.refs == 0 {
+		cluster.ctx.cancel()
+		delete(m.clusters, cluster.name)
+	}
+}
+
+// watchClusterChanged refreshes the meta servers of the cluster once it's changed. If the cluster record can't
+// be read, it retries with backoff and the last-known meta servers keep serving.
+func (m *ClusterManager) watchClusterChanged(store ClusterStore, cluster *clusterWatcher, events <-chan RouteEvent) {
+	for {
+		select {
+		case event := <-events:
+			logrus.Infof("[cluster %s] cluster record is changed by event %s(%v), re-watch it",
+				cluster.name, event.Type.String(), event.Err)
+		case <-cluster.ctx.ctx.Done():
+			return
+		}
+
+		backoff := minRewatchBackoff
+		for {
+			metaAddrs, newEvents, err := store.WatchCluster(cluster.ctx.ctx, cluster.name)
+			if err == nil {
+				if old := cluster.getMetaAddrs(); old != metaAddrs {
+					cluster.metaAddrs.Store(metaAddrs)
+					logrus.Infof("[cluster %s] meta servers are updated from %s to %s", cluster.name, old, metaAddrs)
+				}
+				events = newEvents
+				break
+			}
+			logrus.Warnf("[cluster %s] failed to refresh cluster record, keep %s and retry after %s: %s",
+				cluster.name, cluster.getMetaAddrs(), backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-cluster.ctx.ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > maxRewatchBackoff {
+				backoff = maxRewatchBackoff
+			}
+		}
+	}
+}
+
+// withClustersReleased wraps the cancel of the table watcher, so that the clusters are released only once
+// when the table watcher is canceled.
+func (m *ClusterManager) withClustersReleased(cancel context.CancelFunc, clusters []*clusterWatcher) context.CancelFunc {
+	var once sync.Once
+	return func() {
+		cancel()
+		once.Do(func() {
+			for _, cluster := range clusters {
+				m.releaseCluster(cluster)
+			}
+		})
+	}
+}
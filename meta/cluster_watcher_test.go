@@ -0,0 +1,146 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/stretchr/testify/assert"
+)
+
+const testClusterRouteFile = `
+tables:
+  temp:
+    cluster_name: onebox
+  other:
+    cluster_name: onebox
+  stat:
+    cluster_name: onebox_alias
+  override:
+    cluster_name: onebox
+    meta_addrs: 127.0.0.2:34601,127.0.0.2:34602
+clusters:
+  onebox:
+    meta_addrs: 127.0.0.1:34601,127.0.0.1:34602
+  onebox_alias:
+    alias: onebox
+`
+
+const testClusterRouteFileUpdated = `
+tables:
+  temp:
+    cluster_name: onebox
+  other:
+    cluster_name: onebox
+  stat:
+    cluster_name: onebox_alias
+  override:
+    cluster_name: onebox
+    meta_addrs: 127.0.0.2:34601,127.0.0.2:34602
+clusters:
+  onebox:
+    meta_addrs: 127.0.1.1:34601,127.0.1.1:34602
+  onebox_alias:
+    alias: onebox
+`
+
+func TestResolveCluster(t *testing.T) {
+	clusters := map[string]*clusterRecord{
+		"c1":    {MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"},
+		"a1":    {Alias: "c1"},
+		"a2":    {Alias: "a1"},
+		"loop1": {Alias: "loop2"},
+		"loop2": {Alias: "loop1"},
+		"bad":   {Alias: "notExist"},
+	}
+	get := func(name string) (*clusterRecord, error) {
+		record, ok := clusters[name]
+		if !ok {
+			return nil, base.ERR_OBJECT_NOT_FOUND
+		}
+		return record, nil
+	}
+
+	metaAddrs, chain, err := resolveCluster("a2", get)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", metaAddrs)
+	assert.Equal(t, []string{"a2", "a1", "c1"}, chain)
+	_, _, err = resolveCluster("loop1", get)
+	assert.Equal(t, base.ERR_INVALID_DATA, err)
+	_, _, err = resolveCluster("bad", get)
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND, err)
+
+	_, err = parseClusterRecord([]byte(`{"meta_addrs": "127.0.0.1:34601", "alias": "c1"}`))
+	assert.NotNil(t, err)
+	_, err = parseClusterRecord([]byte(`{}`))
+	assert.NotNil(t, err)
+}
+
+func TestClusterManagerWithClusterRecords(t *testing.T) {
+	// the table referencing the undefined cluster is rejected
+	path := newTestRouteFile(t, "tables:\n  temp:\n    cluster_name: onebox\nclusters:\n  other:\n    alias: onebox\n")
+	_, err := newFileRouteStore(path)
+	assert.NotNil(t, err)
+
+	m, path := newTestFileClusterManager(t, testClusterRouteFile)
+	tables, err := m.Store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", tables["stat"].MetaAddrs)
+
+	for _, table := range []string{"temp", "stat"} {
+		addrs, err := m.getMetaAddrs(context.Background(), table)
+		assert.Nil(t, err)
+		assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", addrs)
+	}
+	addrs, err := m.getMetaAddrs(context.Background(), "override")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.2:34601,127.0.0.2:34602", addrs)
+	// the tables referencing the same cluster share one cluster watcher
+	addrs, err = m.getMetaAddrs(context.Background(), "other")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", addrs)
+	m.clusterMut.Lock()
+	assert.Equal(t, 2, len(m.clusters))
+	assert.Equal(t, 2, m.clusters["onebox"].refs)
+	assert.Equal(t, 1, m.clusters["onebox_alias"].refs)
+	m.clusterMut.Unlock()
+
+	// updating the cluster record re-routes all the tables referencing it, the overridden one is kept
+	writeRouteFile(t, path, testClusterRouteFileUpdated)
+	assert.Eventually(t, func() bool {
+		temp, _ := m.getMetaAddrs(context.Background(), "temp")
+		stat, _ := m.getMetaAddrs(context.Background(), "stat")
+		other, _ := m.getMetaAddrs(context.Background(), "other")
+		return temp == "127.0.1.1:34601,127.0.1.1:34602" && stat == temp && other == temp
+	}, 3*time.Second, 10*time.Millisecond)
+	addrs, _ = m.getMetaAddrs(context.Background(), "override")
+	assert.Equal(t, "127.0.0.2:34601,127.0.0.2:34602", addrs)
+
+	// the cluster is no longer watched once no table references it
+	m.evictTable("temp")
+	m.evictTable("stat")
+	m.evictTable("other")
+	m.clusterMut.Lock()
+	assert.Equal(t, 0, len(m.clusters))
+	m.clusterMut.Unlock()
+}
@@ -0,0 +1,175 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/XiaoMi/pegasus-go-client/idl/replication"
+	"github.com/bluele/gcache"
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/pegasus-kv/meta-proxy/metrics"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	configCacheHitCount       metrics.Meter
+	configCacheMissCount      metrics.Meter
+	configCacheCoalescedCount metrics.Meter
+)
+
+// globalConfigCache is nil if the config cache is disabled.
+var globalConfigCache *configCache
+
+type configCacheKey struct {
+	metaAddrs string
+	table     string
+}
+
+// queryConfigFunc queries the partition configuration of the table from meta server.
+type queryConfigFunc func(ctx context.Context, table string) (*replication.QueryCfgResponse, error)
+
+// configCall is an in-flight query to meta server, the concurrent identical queries wait for it
+// instead of requesting the meta server again.
+type configCall struct {
+	done chan struct{}
+	resp *replication.QueryCfgResponse
+	err  error
+	// the result of an invalidated call is still returned to the waiters, but it's not cached
+	invalidated bool
+}
+
+// configCache caches the partition configuration responses of meta servers, keyed by (cluster, table).
+// It shields the meta servers from the query storm when lots of clients restart at the same time.
+type configCache struct {
+	cache gcache.Cache
+	// timeout bounds the shared query to meta server, which is detached from the context of any caller
+	timeout time.Duration
+
+	mu    sync.Mutex
+	calls map[configCacheKey]*configCall
+}
+
+func initConfigCache() {
+	opts := config.GlobalConfig.ConfigCacheOpts
+	if !opts.Enable {
+		return
+	}
+	timeout := time.Duration(config.GlobalConfig.ServerOpts.MaxRequestTimeout) * time.Millisecond
+	globalConfigCache = newConfigCache(opts.Capacity, time.Duration(opts.TTL)*time.Millisecond, timeout)
+	logrus.Infof("config cache is enabled, capacity = %d, ttl = %dms", opts.Capacity, opts.TTL)
+}
+
+func newConfigCache(capacity int, ttl time.Duration, timeout time.Duration) *configCache {
+	return &configCache{
+		cache:   gcache.New(capacity).LRU().Expiration(ttl).Build(),
+		timeout: timeout,
+		calls:   make(map[configCacheKey]*configCall),
+	}
+}
+
+// query returns the cached response if exists, otherwise queries the meta server by `queryFn`. Only one
+// query is sent to meta server for the concurrent identical queries, and only the successful response
+// is cached. The shared query runs on its own context bounded by `c.timeout`, so that a caller giving up
+// doesn't fail the others waiting for the same query. If the cache is nil, it simply calls `queryFn`.
+func (c *configCache) query(ctx context.Context, metaAddrs string, table string,
+	queryFn queryConfigFunc) (*replication.QueryCfgResponse, error) {
+	if c == nil {
+		return queryFn(ctx, table)
+	}
+
+	key := configCacheKey{metaAddrs: metaAddrs, table: table}
+	if resp, err := c.cache.Get(key); err == nil {
+		configCacheHitCount.UpdateWithTags([]string{table})
+		return resp.(*replication.QueryCfgResponse), nil
+	}
+
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if ok {
+		configCacheCoalescedCount.UpdateWithTags([]string{table})
+	} else {
+		call = &configCall{done: make(chan struct{})}
+		c.calls[key] = call
+		configCacheMissCount.UpdateWithTags([]string{table})
+		// the span of the first caller is kept to trace the shared query
+		queryCtx := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+		go c.doQuery(queryCtx, key, call, queryFn)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.resp, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *configCache) doQuery(ctx context.Context, key configCacheKey, call *configCall, queryFn queryConfigFunc) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	call.resp, call.err = queryFn(ctx, key.table)
+
+	c.mu.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	if !call.invalidated && call.err == nil && call.resp.GetErr().Errno == base.ERR_OK.String() {
+		if err := c.cache.Set(key, call.resp); err != nil {
+			logrus.Warnf("[%s] failed to cache the config from [%s]: %s", key.table, key.metaAddrs, err)
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// invalidate removes the cached response of the table, and the result of the in-flight query won't be cached.
+// It's called when the cluster info of the table is changed on zookeeper.
+func (c *configCache) invalidate(metaAddrs string, table string) {
+	if c == nil {
+		return
+	}
+
+	key := configCacheKey{metaAddrs: metaAddrs, table: table}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		call.invalidated = true
+		delete(c.calls, key)
+	}
+	c.cache.Remove(key)
+}
+
+// invalidateTable invalidates the cached responses of the table from all the clusters the watcher is routed to,
+// so that the ones cached while the table is switched to the backup cluster are also removed. It must be called
+// with ClusterManager.Mut held.
+func (c *configCache) invalidateTable(watcher *TableInfoWatcher) {
+	if c == nil {
+		return
+	}
+	for _, addrs := range watcher.routedAddrsLocked() {
+		c.invalidate(addrs, watcher.tableName)
+	}
+}
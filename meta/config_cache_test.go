@@ -0,0 +1,229 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/XiaoMi/pegasus-go-client/idl/replication"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeQueryConfig returns a queryConfigFunc which counts the calls and blocks until `release` is closed.
+func newFakeQueryConfig(calls *int32, errno base.DsnErrCode, release <-chan struct{}) queryConfigFunc {
+	return func(ctx context.Context, table string) (*replication.QueryCfgResponse, error) {
+		atomic.AddInt32(calls, 1)
+		<-release
+		return &replication.QueryCfgResponse{
+			Err:            &base.ErrorCode{Errno: errno.String()},
+			PartitionCount: 8,
+		}, nil
+	}
+}
+
+func closedChan() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func TestConfigCacheQuery(t *testing.T) {
+	ctx := context.Background()
+	c := newConfigCache(16, time.Minute, time.Second)
+	var calls int32
+	queryFn := newFakeQueryConfig(&calls, base.ERR_OK, closedChan())
+
+	resp, err := c.query(ctx, "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(8), resp.PartitionCount)
+	resp, err = c.query(ctx, "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(8), resp.PartitionCount)
+	assert.Equal(t, int32(1), calls)
+
+	// the same table in another cluster is cached separately
+	_, _ = c.query(ctx, "127.0.0.1:34603,127.0.0.1:34604", "temp", queryFn)
+	assert.Equal(t, int32(2), calls)
+
+	c.invalidate("127.0.0.1:34601,127.0.0.1:34602", "temp")
+	_, _ = c.query(ctx, "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	assert.Equal(t, int32(3), calls)
+
+	// the failed response is not cached
+	var failedCalls int32
+	failedFn := newFakeQueryConfig(&failedCalls, base.ERR_OBJECT_NOT_FOUND, closedChan())
+	for i := 0; i < 2; i++ {
+		resp, err = c.query(ctx, "127.0.0.1:34601,127.0.0.1:34602", "notExist", failedFn)
+		assert.Nil(t, err)
+		assert.Equal(t, base.ERR_OBJECT_NOT_FOUND.String(), resp.Err.Errno)
+	}
+	assert.Equal(t, int32(2), failedCalls)
+
+	// a nil cache always queries meta server
+	var nilCalls int32
+	var nilCache *configCache
+	nilFn := newFakeQueryConfig(&nilCalls, base.ERR_OK, closedChan())
+	_, _ = nilCache.query(ctx, "127.0.0.1:34601,127.0.0.1:34602", "temp", nilFn)
+	_, _ = nilCache.query(ctx, "127.0.0.1:34601,127.0.0.1:34602", "temp", nilFn)
+	nilCache.invalidate("127.0.0.1:34601,127.0.0.1:34602", "temp")
+	assert.Equal(t, int32(2), nilCalls)
+}
+
+func TestConfigCacheExpire(t *testing.T) {
+	c := newConfigCache(16, 50*time.Millisecond, time.Second)
+	var calls int32
+	queryFn := newFakeQueryConfig(&calls, base.ERR_OK, closedChan())
+
+	_, _ = c.query(context.Background(), "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	time.Sleep(100 * time.Millisecond)
+	_, _ = c.query(context.Background(), "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestConfigCacheCoalesce(t *testing.T) {
+	c := newConfigCache(16, time.Minute, time.Second)
+	var calls int32
+	release := make(chan struct{})
+	queryFn := newFakeQueryConfig(&calls, base.ERR_OK, release)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.query(context.Background(), "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+			assert.Nil(t, err)
+			assert.Equal(t, int32(8), resp.PartitionCount)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the waiting query returns once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.query(ctx, "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestConfigCacheInvalidateInFlight(t *testing.T) {
+	c := newConfigCache(16, time.Minute, time.Second)
+	var calls int32
+	release := make(chan struct{})
+	queryFn := newFakeQueryConfig(&calls, base.ERR_OK, release)
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = c.query(context.Background(), "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.invalidate("127.0.0.1:34601,127.0.0.1:34602", "temp")
+	close(release)
+	<-done
+
+	// the response of the invalidated query is not cached
+	_, _ = c.query(context.Background(), "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestConfigCacheLeaderCancel(t *testing.T) {
+	c := newConfigCache(16, time.Minute, time.Second)
+	var calls int32
+	release := make(chan struct{})
+	queryFn := func(ctx context.Context, table string) (*replication.QueryCfgResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return &replication.QueryCfgResponse{Err: &base.ErrorCode{Errno: base.ERR_OK.String()}, PartitionCount: 8}, nil
+	}
+
+	// the first caller gives up before the query finishes
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := c.query(ctx, "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the shared query isn't cancelled with it, and the waiter still gets the response
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := c.query(context.Background(), "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(8), resp.PartitionCount)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	<-done
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestConfigCacheQueryTimeout(t *testing.T) {
+	c := newConfigCache(16, time.Minute, 20*time.Millisecond)
+	// the shared query is bounded by the timeout of the cache even if the caller waits forever
+	queryFn := func(ctx context.Context, table string) (*replication.QueryCfgResponse, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	_, err := c.query(context.Background(), "127.0.0.1:34601,127.0.0.1:34602", "temp", queryFn)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestConfigCacheInvalidateTable(t *testing.T) {
+	ctx := context.Background()
+	c := newConfigCache(16, time.Minute, time.Second)
+	var calls int32
+	queryFn := newFakeQueryConfig(&calls, base.ERR_OK, closedChan())
+
+	watcher := &TableInfoWatcher{
+		tableName: "temp",
+		metaAddrs: "127.0.0.1:34601,127.0.0.1:34602",
+		backup:    &backupCluster{clusterName: "backup", metaAddrs: "127.0.0.1:34603,127.0.0.1:34604"},
+		// the meta servers of the table are changed since it's queried
+		metaRefs: map[string]bool{"127.0.0.1:34605,127.0.0.1:34606": true},
+	}
+	addrsList := []string{"127.0.0.1:34601,127.0.0.1:34602", "127.0.0.1:34603,127.0.0.1:34604",
+		"127.0.0.1:34605,127.0.0.1:34606"}
+	for _, addrs := range addrsList {
+		_, _ = c.query(ctx, addrs, "temp", queryFn)
+	}
+	assert.Equal(t, int32(3), calls)
+
+	// the responses cached from the backup cluster and the previous clusters are invalidated as well
+	c.invalidateTable(watcher)
+	for _, addrs := range addrsList {
+		_, _ = c.query(ctx, addrs, "temp", queryFn)
+	}
+	assert.Equal(t, int32(6), calls)
+
+	var nilCache *configCache
+	nilCache.invalidateTable(watcher)
+}
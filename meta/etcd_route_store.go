@@ -0,0 +1,326 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdRouteStore is the RouteStore based on etcd, it supports the cluster references like zkRouteStore.
+// The etcd key layout:
+// <Root>/<table> =>
+//                 {
+//                   "cluster_name" : "clusterName",
+//                   "meta_addrs" : "metaAddr1,metaAddr2,metaAddr3"
+//                 }
+// <Root>/clusters/<cluster> => {"meta_addrs" : "metaAddr1,metaAddr2,metaAddr3"} or {"alias" : "clusterName"}
+type etcdRouteStore struct {
+	client    *clientv3.Client
+	endpoints []string
+	root      string
+	timeout   time.Duration
+}
+
+// newEtcdRouteStore connects to etcd, the unit of timeout is ms.
+func newEtcdRouteStore(endpoints []string, root string, timeout int) (*etcdRouteStore, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: time.Duration(timeout) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd \"%s\": %s", endpoints, err)
+	}
+	return &etcdRouteStore{
+		client:    client,
+		endpoints: endpoints,
+		root:      strings.TrimSuffix(root, "/"),
+		timeout:   time.Duration(timeout) * time.Millisecond,
+	}, nil
+}
+
+func (s *etcdRouteStore) Get(table string) (*ClusterInfo, error) {
+	cluster, _, err := s.get(table)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.MetaAddrs == "" {
+		if cluster.MetaAddrs, _, err = resolveCluster(cluster.Name, s.getClusterRecord); err != nil {
+			return nil, err
+		}
+	}
+	return cluster, nil
+}
+
+// get returns the cluster of the table and the etcd revision when it's read, the cluster reference is not resolved.
+func (s *etcdRouteStore) get(table string) (*ClusterInfo, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	key := s.tableKey(table)
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		logrus.Errorf("[%s] failed to get cluster info from etcd[%s(%s)]: %s", table, s.endpoints, key, err)
+		return nil, 0, base.ERR_NETWORK_FAILURE
+	}
+	if len(resp.Kvs) == 0 {
+		logrus.Errorf("[%s] cluster info doesn't exist on etcd[%s(%s)]", table, s.endpoints, key)
+		return nil, 0, base.ERR_OBJECT_NOT_FOUND
+	}
+	cluster, err := parseClusterInfo(resp.Kvs[0].Value)
+	if err != nil {
+		logrus.Errorf("[%s] cluster info on etcd[%s(%s)] format is invalid, err = %s", table, s.endpoints, key, err)
+		return nil, 0, base.ERR_INVALID_DATA
+	}
+	return cluster, resp.Header.Revision, nil
+}
+
+func (s *etcdRouteStore) Watch(ctx context.Context, table string) (*ClusterInfo, <-chan RouteEvent, error) {
+	cluster, revision, err := s.get(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make(chan RouteEvent, 1)
+	go s.watch(ctx, s.tableKey(table), revision+1, events)
+	return cluster, events, nil
+}
+
+func (s *etcdRouteStore) WatchCluster(ctx context.Context, cluster string) (string, <-chan RouteEvent, error) {
+	keys := make(map[string]int64)
+	metaAddrs, _, err := resolveCluster(cluster, func(name string) (*clusterRecord, error) {
+		record, revision, err := s.getCluster(name)
+		if err != nil {
+			return nil, err
+		}
+		keys[s.clusterKey(name)] = revision
+		return record, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// every key on the alias chain is watched, the channel is large enough to never block the watchers
+	events := make(chan RouteEvent, len(keys))
+	for key, revision := range keys {
+		go s.watch(ctx, key, revision+1, events)
+	}
+	return metaAddrs, events, nil
+}
+
+// getClusterRecord returns the cluster record, it's used to resolve the cluster references.
+func (s *etcdRouteStore) getClusterRecord(name string) (*clusterRecord, error) {
+	record, _, err := s.getCluster(name)
+	return record, err
+}
+
+// getCluster returns the cluster record and the etcd revision when it's read.
+func (s *etcdRouteStore) getCluster(name string) (*clusterRecord, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	key := s.clusterKey(name)
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		logrus.Errorf("[%s] failed to get cluster record from etcd[%s(%s)]: %s", name, s.endpoints, key, err)
+		return nil, 0, base.ERR_NETWORK_FAILURE
+	}
+	if len(resp.Kvs) == 0 {
+		logrus.Errorf("[%s] cluster record doesn't exist on etcd[%s(%s)]", name, s.endpoints, key)
+		return nil, 0, base.ERR_OBJECT_NOT_FOUND
+	}
+	record, err := parseClusterRecord(resp.Kvs[0].Value)
+	if err != nil {
+		logrus.Errorf("[%s] cluster record on etcd[%s(%s)] format is invalid, err = %s", name, s.endpoints, key, err)
+		return nil, 0, base.ERR_INVALID_DATA
+	}
+	return record, resp.Header.Revision, nil
+}
+
+// watch waits for the first change of the key since the revision.
+func (s *etcdRouteStore) watch(ctx context.Context, key string, revision int64, events chan<- RouteEvent) {
+	s.watchKey(ctx, key, revision, events, func(event *clientv3.Event) (RouteEvent, bool) {
+		if event.Type == mvccpb.DELETE {
+			return RouteEvent{Type: RouteDeleted}, true
+		}
+		return RouteEvent{Type: RouteChanged}, true
+	})
+}
+
+// watchList waits for the first table added or removed since the revision.
+func (s *etcdRouteStore) watchList(ctx context.Context, revision int64, events chan<- RouteEvent) {
+	prefix := s.root + "/"
+	s.watchKey(ctx, prefix, revision, events, func(event *clientv3.Event) (RouteEvent, bool) {
+		if !isTableKey(prefix, string(event.Kv.Key)) || (event.Type != mvccpb.DELETE && !event.IsCreate()) {
+			return RouteEvent{}, false
+		}
+		return RouteEvent{Type: RouteChanged}, true
+	}, clientv3.WithPrefix())
+}
+
+// watchKey waits for the first etcd event accepted by `convert` since the revision and sends it. If the watch
+// is broken (e.g. the etcd member lost its leader), it's resumed from the last revision so that no change is
+// missed. If the revision has been compacted, RouteWatchLost is sent and the key should be read and watched again.
+func (s *etcdRouteStore) watchKey(ctx context.Context, key string, revision int64, events chan<- RouteEvent,
+	convert func(event *clientv3.Event) (RouteEvent, bool), opts ...clientv3.OpOption) {
+	backoff := minRewatchBackoff
+	for {
+		watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		for resp := range s.client.Watch(watchCtx, key, append(opts, clientv3.WithRev(revision))...) {
+			if resp.CompactRevision != 0 {
+				cancel()
+				events <- RouteEvent{Type: RouteWatchLost, Err: resp.Err()}
+				return
+			}
+			if err := resp.Err(); err != nil {
+				logrus.Warnf("etcd watcher of \"%s\" is broken since revision %d: %s", key, revision, err)
+				break
+			}
+			for _, event := range resp.Events {
+				if routeEvent, ok := convert(event); ok {
+					cancel()
+					events <- routeEvent
+					return
+				}
+			}
+			if resp.Header.Revision >= revision {
+				revision = resp.Header.Revision + 1
+			}
+		}
+		cancel()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxRewatchBackoff {
+			backoff = maxRewatchBackoff
+		}
+	}
+}
+
+func (s *etcdRouteStore) List() (map[string]*ClusterInfo, error) {
+	tables, _, err := s.list()
+	return tables, err
+}
+
+func (s *etcdRouteStore) WatchList(ctx context.Context) (map[string]*ClusterInfo, <-chan RouteEvent, error) {
+	tables, revision, err := s.list()
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make(chan RouteEvent, 1)
+	go s.watchList(ctx, revision+1, events)
+	return tables, events, nil
+}
+
+// list returns the clusters of all the tables and the etcd revision when they're read. The cluster references
+// are resolved by the cluster records read along with the tables, so that they're of the same revision.
+func (s *etcdRouteStore) list() (map[string]*ClusterInfo, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	prefix := s.root + "/"
+	resp, err := s.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		logrus.Errorf("failed to list tables from etcd[%s(%s)]: %s", s.endpoints, s.root, err)
+		return nil, 0, base.ERR_NETWORK_FAILURE
+	}
+
+	clustersPrefix := s.clusterKey("")
+	records := make(map[string][]byte)
+	for _, kv := range resp.Kvs {
+		if isTableKey(clustersPrefix, string(kv.Key)) {
+			records[strings.TrimPrefix(string(kv.Key), clustersPrefix)] = kv.Value
+		}
+	}
+	getRecord := func(name string) (*clusterRecord, error) {
+		value, ok := records[name]
+		if !ok {
+			return nil, base.ERR_OBJECT_NOT_FOUND
+		}
+		record, err := parseClusterRecord(value)
+		if err != nil {
+			return nil, base.ERR_INVALID_DATA
+		}
+		return record, nil
+	}
+
+	result := make(map[string]*ClusterInfo)
+	for _, kv := range resp.Kvs {
+		if !isTableKey(prefix, string(kv.Key)) {
+			continue
+		}
+		table := strings.TrimPrefix(string(kv.Key), prefix)
+		cluster, err := parseClusterInfo(kv.Value)
+		if err != nil {
+			logrus.Warnf("[%s] cluster info on etcd(%s) format is invalid, err = %s", table, kv.Key, err)
+			continue
+		}
+		if cluster.MetaAddrs == "" {
+			if cluster.MetaAddrs, _, err = resolveCluster(cluster.Name, getRecord); err != nil {
+				logrus.Warnf("[%s] skip the table referencing the unresolvable cluster %s", table, cluster.Name)
+				continue
+			}
+		}
+		result[table] = cluster
+	}
+	return result, resp.Header.Revision, nil
+}
+
+// isTableKey returns whether the key is "<prefix><table>", the keys in deeper levels are not tables.
+func isTableKey(prefix string, key string) bool {
+	table := strings.TrimPrefix(key, prefix)
+	return table != "" && table != key && !strings.Contains(table, "/")
+}
+
+// Ping counts the root key on etcd, no value is read.
+func (s *etcdRouteStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if _, err := s.client.Get(ctx, s.root, clientv3.WithCountOnly()); err != nil {
+		logrus.Errorf("failed to check the root of etcd[%s(%s)]: %s", s.endpoints, s.root, err)
+		return base.ERR_NETWORK_FAILURE
+	}
+	return nil
+}
+
+func (s *etcdRouteStore) Close() {
+	if err := s.client.Close(); err != nil {
+		logrus.Warnf("failed to close etcd client[%s]: %s", s.endpoints, err)
+	}
+}
+
+func (s *etcdRouteStore) tableKey(table string) string {
+	return fmt.Sprintf("%s/%s", s.root, table)
+}
+
+func (s *etcdRouteStore) clusterKey(cluster string) string {
+	return fmt.Sprintf("%s/%s/%s", s.root, zkClustersNode, cluster)
+}
@@ -0,0 +1,257 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/stretchr/testify/assert"
+)
+
+const testEtcdRoot = "/pegasus-cluster"
+
+// testEtcd runs the etcd binary, which can be restarted on the same address and data dir. The binary is found
+// by $ETCD_BIN or $PATH, the etcd tests are skipped if it's not found.
+type testEtcd struct {
+	bin        string
+	dir        string
+	clientURL  string
+	peerURL    string
+	cmd        *exec.Cmd
+	t          *testing.T
+	clientAddr string
+}
+
+func freeLocalAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func startTestEtcd(t *testing.T) *testEtcd {
+	bin := os.Getenv("ETCD_BIN")
+	if bin == "" {
+		bin, _ = exec.LookPath("etcd")
+	}
+	if bin == "" {
+		t.Skip("etcd binary is not found, set ETCD_BIN to run the etcd tests")
+	}
+	dir, err := ioutil.TempDir("", "meta-proxy-etcd")
+	assert.Nil(t, err)
+	e := &testEtcd{
+		bin:        bin,
+		dir:        dir,
+		clientAddr: freeLocalAddr(t),
+		t:          t,
+	}
+	e.clientURL = "http://" + e.clientAddr
+	e.peerURL = "http://" + freeLocalAddr(t)
+	e.start()
+	return e
+}
+
+func (e *testEtcd) start() {
+	e.cmd = exec.Command(e.bin,
+		"--data-dir", e.dir,
+		"--log-level", "error",
+		"--listen-client-urls", e.clientURL,
+		"--advertise-client-urls", e.clientURL,
+		"--listen-peer-urls", e.peerURL,
+		"--initial-advertise-peer-urls", e.peerURL,
+		"--initial-cluster", "default="+e.peerURL)
+	if !assert.Nil(e.t, e.cmd.Start()) {
+		e.t.FailNow()
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(e.clientURL + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	e.stop()
+	e.t.Fatal("etcd is not ready")
+}
+
+func (e *testEtcd) stop() {
+	_ = e.cmd.Process.Signal(syscall.SIGTERM)
+	_ = e.cmd.Wait()
+}
+
+func (e *testEtcd) close() {
+	e.stop()
+	_ = os.RemoveAll(e.dir)
+}
+
+func newTestEtcdRouteStore(t *testing.T, e *testEtcd) *etcdRouteStore {
+	store, err := newEtcdRouteStore([]string{e.clientAddr}, testEtcdRoot, 3000)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return store
+}
+
+func putRoute(t *testing.T, store *etcdRouteStore, table string, value string) int64 {
+	resp, err := store.client.Put(context.Background(), store.tableKey(table), value)
+	assert.Nil(t, err)
+	return resp.Header.Revision
+}
+
+func TestEtcdRouteStore(t *testing.T) {
+	e := startTestEtcd(t)
+	defer e.close()
+	store := newTestEtcdRouteStore(t, e)
+	defer store.Close()
+
+	for _, test := range tests {
+		putRoute(t, store, test.table, test.data)
+	}
+	putRoute(t, store, "invalid", "{")
+
+	cluster, err := store.Get("temp")
+	assert.Nil(t, err)
+	assert.Equal(t, &ClusterInfo{Name: "onebox", MetaAddrs: tests[0].addr}, cluster)
+	_, err = store.Get("notExist")
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND, err)
+	_, err = store.Get("invalid")
+	assert.Equal(t, base.ERR_INVALID_DATA, err)
+	tables, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, len(tests), len(tables))
+
+	_, tempEvents, err := store.Watch(context.Background(), "temp")
+	assert.Nil(t, err)
+	_, statEvents, err := store.Watch(context.Background(), "stat")
+	assert.Nil(t, err)
+	tables, listEvents, err := store.WatchList(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, len(tests), len(tables))
+	ctx, cancel := context.WithCancel(context.Background())
+	_, testEvents, err := store.Watch(ctx, "test")
+	assert.Nil(t, err)
+	cancel()
+
+	putRoute(t, store, "temp", updates[0].data)
+	assert.Equal(t, RouteChanged, waitRouteEvent(t, tempEvents).Type)
+	_, err = store.client.Delete(context.Background(), store.tableKey("stat"))
+	assert.Nil(t, err)
+	assert.Equal(t, RouteDeleted, waitRouteEvent(t, statEvents).Type)
+	// the list watch only cares about the added or removed tables
+	assert.Equal(t, RouteChanged, waitRouteEvent(t, listEvents).Type)
+	_, listEvents, err = store.WatchList(context.Background())
+	assert.Nil(t, err)
+	putRoute(t, store, "temp", updates[1].data)
+	putRoute(t, store, "new", tests[0].data)
+	assert.Equal(t, RouteChanged, waitRouteEvent(t, listEvents).Type)
+
+	// the canceled watch receives nothing
+	putRoute(t, store, "test", updates[0].data)
+	select {
+	case <-testEvents:
+		assert.Fail(t, "the canceled watch receives event")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEtcdRouteStoreResume(t *testing.T) {
+	e := startTestEtcd(t)
+	defer e.close()
+	store := newTestEtcdRouteStore(t, e)
+	defer store.Close()
+
+	putRoute(t, store, "temp", tests[0].data)
+	_, events, err := store.Watch(context.Background(), "temp")
+	assert.Nil(t, err)
+
+	// the watch is resumed after etcd is restarted
+	e.stop()
+	time.Sleep(100 * time.Millisecond)
+	e.start()
+	putRoute(t, store, "temp", updates[0].data)
+	assert.Equal(t, RouteChanged, waitRouteEvent(t, events).Type)
+
+	// the watch can't be resumed from a compacted revision
+	revision := putRoute(t, store, "temp", updates[1].data)
+	putRoute(t, store, "temp", updates[2].data)
+	_, err = store.client.Compact(context.Background(), revision+1)
+	assert.Nil(t, err)
+	compactedEvents := make(chan RouteEvent, 1)
+	go store.watch(context.Background(), store.tableKey("temp"), revision, compactedEvents)
+	assert.Equal(t, RouteWatchLost, waitRouteEvent(t, compactedEvents).Type)
+}
+
+func TestEtcdWatchCluster(t *testing.T) {
+	e := startTestEtcd(t)
+	defer e.close()
+	store := newTestEtcdRouteStore(t, e)
+	defer store.Close()
+
+	putCluster := func(name string, value string) {
+		_, err := store.client.Put(context.Background(), store.clusterKey(name), value)
+		assert.Nil(t, err)
+	}
+	putCluster("onebox", `{"meta_addrs": "127.0.0.1:34601,127.0.0.1:34602"}`)
+	putCluster("onebox_alias", `{"alias": "onebox"}`)
+	putCluster("loop1", `{"alias": "loop2"}`)
+	putCluster("loop2", `{"alias": "loop1"}`)
+	putRoute(t, store, "temp", `{"cluster_name": "onebox_alias"}`)
+	putRoute(t, store, "loop", `{"cluster_name": "loop1"}`)
+
+	// the cluster records are not listed as tables, and the cluster references are resolved
+	tables, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]*ClusterInfo{
+		"temp": {Name: "onebox_alias", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"},
+	}, tables)
+	cluster, err := store.Get("temp")
+	assert.Nil(t, err)
+	assert.Equal(t, &ClusterInfo{Name: "onebox_alias", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"}, cluster)
+	_, err = store.Get("loop")
+	assert.Equal(t, base.ERR_INVALID_DATA, err)
+
+	metaAddrs, events, err := store.WatchCluster(context.Background(), "onebox_alias")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", metaAddrs)
+	_, _, err = store.WatchCluster(context.Background(), "notExist")
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND, err)
+	_, _, err = store.WatchCluster(context.Background(), "loop1")
+	assert.Equal(t, base.ERR_INVALID_DATA, err)
+
+	// the change of the cluster at the end of the alias chain is notified
+	putCluster("onebox", `{"meta_addrs": "127.0.1.1:34601,127.0.1.1:34602"}`)
+	assert.Equal(t, RouteChanged, waitRouteEvent(t, events).Type)
+	metaAddrs, _, err = store.WatchCluster(context.Background(), "onebox_alias")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.1.1:34601,127.0.1.1:34602", metaAddrs)
+}
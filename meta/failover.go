@@ -0,0 +1,381 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pegasus-kv/meta-proxy/admin"
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/pegasus-kv/meta-proxy/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+var failoverSwitchCount metrics.Meter
+
+const (
+	failoverPrimary = "primary"
+	failoverBackup  = "backup"
+)
+
+// backupCluster is the cluster the table is switched to once its primary cluster is unhealthy.
+type backupCluster struct {
+	clusterName string
+	metaAddrs   string
+	// cluster is the watcher of the referenced cluster if the backup doesn't specify meta_addrs, otherwise nil
+	cluster *clusterWatcher
+}
+
+func (b *backupCluster) getMetaAddrs() string {
+	if b.cluster != nil {
+		return b.cluster.getMetaAddrs()
+	}
+	return b.metaAddrs
+}
+
+// clusterHealth is the health of a primary cluster, which is checked periodically.
+type clusterHealth struct {
+	// the number of consecutive failed and successful checks
+	failures  int
+	successes int
+	// failed is true if the tables on the cluster are switched to their backup clusters
+	failed  bool
+	lastErr error
+}
+
+// failover checks the health of the primary clusters of the tables which have backup clusters, and routes
+// the tables to their backup clusters once the primary clusters are unhealthy. The route of a table can also
+// be pinned to the primary or backup cluster manually.
+type failover struct {
+	interval          time.Duration
+	timeout           time.Duration
+	failureThreshold  int
+	recoveryThreshold int
+	// probe checks whether the meta server is reachable
+	probe func(addr string, timeout time.Duration) error
+
+	mu sync.RWMutex
+	// primary metaAddrs->clusterHealth
+	clusters map[string]*clusterHealth
+	// table->pinned target, failoverPrimary or failoverBackup
+	pins map[string]string
+}
+
+func newFailover() *failover {
+	opts := config.GlobalConfig.FailoverOpts
+	return &failover{
+		interval:          time.Duration(opts.CheckInterval) * time.Millisecond,
+		timeout:           time.Duration(opts.CheckTimeout) * time.Millisecond,
+		failureThreshold:  opts.FailureThreshold,
+		recoveryThreshold: opts.RecoveryThreshold,
+		probe:             probeMetaServer,
+		clusters:          make(map[string]*clusterHealth),
+		pins:              make(map[string]string),
+	}
+}
+
+// probeMetaServer checks the meta server by connecting to it.
+func probeMetaServer(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// route returns the meta servers the table is routed to. It's safe to call on a nil failover, which always
+// routes to the primary cluster.
+func (f *failover) route(w *TableInfoWatcher) string {
+	if f == nil || w.backup == nil {
+		return w.getMetaAddrs()
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.targetLocked(w) == failoverBackup {
+		return w.backup.getMetaAddrs()
+	}
+	return w.getMetaAddrs()
+}
+
+// target returns which cluster the table is routed to, empty if the table has no backup or f is nil.
+func (f *failover) target(w *TableInfoWatcher) string {
+	if f == nil || w.backup == nil {
+		return ""
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.targetLocked(w)
+}
+
+// targetLocked returns which cluster the table is routed to, failoverPrimary or failoverBackup.
+func (f *failover) targetLocked(w *TableInfoWatcher) string {
+	if target, ok := f.pins[w.tableName]; ok {
+		return target
+	}
+	if health := f.clusters[w.getMetaAddrs()]; health != nil && health.failed {
+		return failoverBackup
+	}
+	return failoverPrimary
+}
+
+// run checks the health of the primary clusters periodically until ctx is done.
+func (f *failover) run(ctx context.Context, m *ClusterManager) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.check(m.backupTables())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check probes the primary clusters of the tables, and switches the tables whose routes are changed.
+func (f *failover) check(tables []*TableInfoWatcher) {
+	primaries := make(map[string][]*TableInfoWatcher)
+	for _, w := range tables {
+		addrs := w.getMetaAddrs()
+		primaries[addrs] = append(primaries[addrs], w)
+	}
+
+	var wg sync.WaitGroup
+	var resultMu sync.Mutex
+	results := make(map[string]error, len(primaries))
+	for addrs := range primaries {
+		wg.Add(1)
+		go func(addrs string) {
+			defer wg.Done()
+			err := f.probeCluster(addrs)
+			resultMu.Lock()
+			results[addrs] = err
+			resultMu.Unlock()
+		}(addrs)
+	}
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addrs := range f.clusters {
+		if _, ok := primaries[addrs]; !ok {
+			delete(f.clusters, addrs) // no table with backup is on the cluster any more
+		}
+	}
+	for addrs, err := range results {
+		health := f.clusters[addrs]
+		if health == nil {
+			health = &clusterHealth{}
+			f.clusters[addrs] = health
+		}
+		before := make([]string, len(primaries[addrs]))
+		for i, w := range primaries[addrs] {
+			before[i] = f.targetLocked(w)
+		}
+		f.updateHealth(addrs, health, err)
+		for i, w := range primaries[addrs] {
+			f.logSwitch(w, before[i], f.targetLocked(w), fmt.Sprintf("health check of %s", addrs))
+		}
+	}
+}
+
+// probeCluster returns nil if any meta server of the cluster is reachable.
+func (f *failover) probeCluster(addrs string) error {
+	metaList, err := parseToMetaList(addrs)
+	if err != nil {
+		return err
+	}
+	for _, addr := range metaList {
+		if err = f.probe(addr, f.timeout); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (f *failover) updateHealth(addrs string, health *clusterHealth, err error) {
+	health.lastErr = err
+	if err != nil {
+		health.failures++
+		health.successes = 0
+		logrus.Warnf("health check of primary cluster[%s] failed %d times: %s", addrs, health.failures, err)
+		if !health.failed && health.failures >= f.failureThreshold {
+			health.failed = true
+			logrus.Errorf("primary cluster[%s] is unhealthy after %d failed checks", addrs, health.failures)
+		}
+		return
+	}
+	health.successes++
+	health.failures = 0
+	if health.failed && health.successes >= f.recoveryThreshold {
+		health.failed = false
+		logrus.Infof("primary cluster[%s] is recovered after %d successful checks", addrs, health.successes)
+	}
+}
+
+// pin routes the table to the target cluster regardless of the health of its primary cluster.
+func (f *failover) pin(w *TableInfoWatcher, target string) error {
+	if target != failoverPrimary && target != failoverBackup {
+		return fmt.Errorf("invalid target \"%s\", should be \"%s\" or \"%s\"", target, failoverPrimary, failoverBackup)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	before := f.targetLocked(w)
+	f.pins[w.tableName] = target
+	logrus.Infof("[%s] route is pinned to %s cluster", w.tableName, target)
+	f.logSwitch(w, before, target, "pinned manually")
+	return nil
+}
+
+// unpin routes the table by the health of its primary cluster again.
+func (f *failover) unpin(w *TableInfoWatcher) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	before := f.targetLocked(w)
+	delete(f.pins, w.tableName)
+	logrus.Infof("[%s] route is unpinned", w.tableName)
+	f.logSwitch(w, before, f.targetLocked(w), "unpinned manually")
+}
+
+func (f *failover) logSwitch(w *TableInfoWatcher, from string, to string, reason string) {
+	if from == to {
+		return
+	}
+	targetAddrs := map[string]string{
+		failoverPrimary: w.getMetaAddrs(),
+		failoverBackup:  w.backup.getMetaAddrs(),
+	}
+	logrus.Warnf("[%s] route is switched from %s cluster(%s) to %s cluster(%s) by %s", w.tableName,
+		from, targetAddrs[from], to, targetAddrs[to], reason)
+	failoverSwitchCount.UpdateWithTags([]string{w.tableName, to})
+}
+
+// backupTables returns the cached tables which have backup clusters.
+func (m *ClusterManager) backupTables() []*TableInfoWatcher {
+	var result []*TableInfoWatcher
+	for _, value := range m.tableCache().GetALL(false) {
+		if w := value.(*TableInfoWatcher); w.backup != nil {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// FailoverInfo is the failover state of a table which has a backup cluster.
+type FailoverInfo struct {
+	Table            string `json:"table"`
+	PrimaryCluster   string `json:"primary_cluster"`
+	PrimaryMetaAddrs string `json:"primary_meta_addrs"`
+	BackupCluster    string `json:"backup_cluster"`
+	BackupMetaAddrs  string `json:"backup_meta_addrs"`
+	// Active is the cluster the table is routed to, "primary" or "backup".
+	Active string `json:"active"`
+	// Pinned is the cluster the table is pinned to manually, empty if not pinned.
+	Pinned         string `json:"pinned,omitempty"`
+	PrimaryHealthy bool   `json:"primary_healthy"`
+	Failures       int    `json:"consecutive_failures"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// listFailoverInfos returns the failover state of the cached tables which have backup clusters, sorted by table.
+func (m *ClusterManager) listFailoverInfos() []FailoverInfo {
+	// the tables are collected before locking the failover state, since getMeta locks them in the reverse order
+	tables := m.backupTables()
+	f := m.failover
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	result := make([]FailoverInfo, 0)
+	for _, w := range tables {
+		info := FailoverInfo{
+			Table:            w.tableName,
+			PrimaryCluster:   w.clusterName,
+			PrimaryMetaAddrs: w.getMetaAddrs(),
+			BackupCluster:    w.backup.clusterName,
+			BackupMetaAddrs:  w.backup.getMetaAddrs(),
+			Active:           f.targetLocked(w),
+			Pinned:           f.pins[w.tableName],
+			PrimaryHealthy:   true,
+		}
+		if health := f.clusters[info.PrimaryMetaAddrs]; health != nil {
+			info.PrimaryHealthy = !health.failed
+			info.Failures = health.failures
+			if health.lastErr != nil {
+				info.LastError = health.lastErr.Error()
+			}
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Table < result[j].Table
+	})
+	return result
+}
+
+// handleFailover is the admin handler to show the failover state of the tables.
+func handleFailover(w http.ResponseWriter, r *http.Request) {
+	tables := globalClusterManager.listFailoverInfos()
+	admin.RenderJSON(w, map[string]interface{}{
+		"count":  len(tables),
+		"tables": tables,
+	})
+}
+
+// handleFailoverPin is the admin handler to pin the route of the table, e.g. POST /failover/pin?table=t&target=backup.
+func handleFailoverPin(w http.ResponseWriter, r *http.Request) {
+	handleFailoverUpdate(w, r, func(f *failover, tableInfo *TableInfoWatcher) error {
+		return f.pin(tableInfo, r.URL.Query().Get("target"))
+	})
+}
+
+// handleFailoverUnpin is the admin handler to unpin the route of the table, e.g. POST /failover/unpin?table=t.
+func handleFailoverUnpin(w http.ResponseWriter, r *http.Request) {
+	handleFailoverUpdate(w, r, func(f *failover, tableInfo *TableInfoWatcher) error {
+		f.unpin(tableInfo)
+		return nil
+	})
+}
+
+func handleFailoverUpdate(w http.ResponseWriter, r *http.Request, update func(*failover, *TableInfoWatcher) error) {
+	table, ok := parseAdminTableRequest(w, r)
+	if !ok {
+		return
+	}
+	m := globalClusterManager
+	if _, err := m.getMetaAddrs(r.Context(), table); err != nil {
+		admin.RenderError(w, http.StatusNotFound, "failed to get route of table \"%s\": %s", table, err)
+		return
+	}
+	value, err := m.tableCache().Get(table)
+	if err != nil || value.(*TableInfoWatcher).backup == nil {
+		admin.RenderError(w, http.StatusBadRequest, "table \"%s\" has no backup cluster", table)
+		return
+	}
+	if err := update(m.failover, value.(*TableInfoWatcher)); err != nil {
+		admin.RenderError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	handleFailover(w, r)
+}
@@ -0,0 +1,209 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFailoverRouteFile = `
+tables:
+  temp:
+    cluster_name: onebox
+    meta_addrs: 127.0.0.1:34601,127.0.0.1:34602
+    backup:
+      cluster_name: onebox_backup
+  stat:
+    cluster_name: onebox
+    meta_addrs: 127.0.0.1:34601,127.0.0.1:34602
+clusters:
+  onebox_backup:
+    meta_addrs: 127.0.1.1:34601,127.0.1.1:34602
+`
+
+const (
+	testPrimaryAddrs = "127.0.0.1:34601,127.0.0.1:34602"
+	testBackupAddrs  = "127.0.1.1:34601,127.0.1.1:34602"
+)
+
+// newTestFailoverManager returns a cluster manager whose primary cluster is healthy unless `healthy` is set to 0.
+func newTestFailoverManager(t *testing.T, healthy *int32) *ClusterManager {
+	m, _ := newTestFileClusterManager(t, testFailoverRouteFile)
+	f := newFailover()
+	f.failureThreshold = 2
+	f.recoveryThreshold = 2
+	f.probe = func(addr string, timeout time.Duration) error {
+		if atomic.LoadInt32(healthy) == 0 {
+			return fmt.Errorf("connect %s: connection refused", addr)
+		}
+		return nil
+	}
+	m.failover = f
+	return m
+}
+
+func TestFailover(t *testing.T) {
+	healthy := int32(1)
+	m := newTestFailoverManager(t, &healthy)
+
+	assertRoute := func(table string, expected string) {
+		addrs, err := m.getMetaAddrs(context.Background(), table)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, addrs)
+	}
+	assertRoute("temp", testPrimaryAddrs)
+	assertRoute("stat", testPrimaryAddrs)
+
+	// switch to backup after consecutive failures, the table without backup is not affected
+	atomic.StoreInt32(&healthy, 0)
+	m.failover.check(m.backupTables())
+	assertRoute("temp", testPrimaryAddrs)
+	m.failover.check(m.backupTables())
+	assertRoute("temp", testBackupAddrs)
+	assertRoute("stat", testPrimaryAddrs)
+	infos := m.listFailoverInfos()
+	assert.Equal(t, 1, len(infos))
+	assert.Equal(t, "temp", infos[0].Table)
+	assert.Equal(t, "onebox_backup", infos[0].BackupCluster)
+	assert.Equal(t, failoverBackup, infos[0].Active)
+	assert.False(t, infos[0].PrimaryHealthy)
+	assert.Equal(t, 2, infos[0].Failures)
+	assert.NotEmpty(t, infos[0].LastError)
+
+	// switch back after consecutive successes
+	atomic.StoreInt32(&healthy, 1)
+	m.failover.check(m.backupTables())
+	assertRoute("temp", testBackupAddrs)
+	m.failover.check(m.backupTables())
+	assertRoute("temp", testPrimaryAddrs)
+
+	// the pinned route ignores the health of the primary cluster
+	tableInfo, _ := m.Tables.Get("temp")
+	assert.Nil(t, m.failover.pin(tableInfo.(*TableInfoWatcher), failoverBackup))
+	assertRoute("temp", testBackupAddrs)
+	assert.NotNil(t, m.failover.pin(tableInfo.(*TableInfoWatcher), "other"))
+	m.failover.unpin(tableInfo.(*TableInfoWatcher))
+	assertRoute("temp", testPrimaryAddrs)
+}
+
+func TestFailoverAdmin(t *testing.T) {
+	healthy := int32(1)
+	m := newTestFailoverManager(t, &healthy)
+	oldManager := globalClusterManager
+	globalClusterManager = m
+	defer func() { globalClusterManager = oldManager }()
+
+	request := func(handler http.HandlerFunc, method string, url string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, url, nil))
+		var body map[string]interface{}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body
+	}
+
+	code, body := request(handleFailover, http.MethodGet, "/failover")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(0), body["count"])
+
+	code, body = request(handleFailoverPin, http.MethodPost, "/failover/pin?table=temp&target=backup")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(1), body["count"])
+	table := body["tables"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "backup", table["active"])
+	assert.Equal(t, "backup", table["pinned"])
+	addrs, _ := m.getMetaAddrs(context.Background(), "temp")
+	assert.Equal(t, testBackupAddrs, addrs)
+
+	code, _ = request(handleFailoverPin, http.MethodGet, "/failover/pin?table=temp&target=backup")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = request(handleFailoverPin, http.MethodPost, "/failover/pin?table=temp&target=other")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = request(handleFailoverPin, http.MethodPost, "/failover/pin?table=stat&target=backup")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = request(handleFailoverPin, http.MethodPost, "/failover/pin?table=notExist&target=backup")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = request(handleFailoverUnpin, http.MethodPost, "/failover/unpin?table=temp")
+	assert.Equal(t, http.StatusOK, code)
+	table = body["tables"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "primary", table["active"])
+	assert.Nil(t, table["pinned"])
+}
+
+func TestFailoverConcurrentAccess(t *testing.T) {
+	healthy := int32(1)
+	m := newTestFailoverManager(t, &healthy)
+	oldManager := globalClusterManager
+	globalClusterManager = m
+	defer func() { globalClusterManager = oldManager }()
+
+	// /failover, the health checks and the routing lock the cluster manager and the failover state together
+	const rounds = 200
+	var wg sync.WaitGroup
+	run := func(action func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				action(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		m.evictTable("temp") // getMeta goes through the slow path
+		_, err := m.getMetaAddrs(context.Background(), "temp")
+		assert.Nil(t, err)
+	})
+	run(func(i int) {
+		rec := httptest.NewRecorder()
+		handleFailover(rec, httptest.NewRequest(http.MethodGet, "/failover", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+	run(func(i int) {
+		atomic.StoreInt32(&healthy, int32(i%2))
+		m.failover.check(m.backupTables())
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		// the deadlocked manager can't be closed on cleanup, dump the goroutines and exit instead
+		_ = pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+		fmt.Fprintln(os.Stderr, "deadlock between /failover and getMeta")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,365 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// fileRouteStore is the RouteStore based on a static yaml file, which is reloaded once it's modified.
+// The file layout:
+// tables:
+//   <table>:
+//     cluster_name: clusterName
+//     meta_addrs: metaAddr1,metaAddr2,metaAddr3
+//     backup: # optional, the cluster the table is switched to once the primary cluster is unhealthy
+//       cluster_name: backupClusterName
+//   <otherTable>:
+//     cluster_name: clusterName # meta_addrs is omitted, defined by the cluster record below
+// clusters:
+//   <clusterName>:
+//     meta_addrs: metaAddr1,metaAddr2,metaAddr3
+//   <aliasName>:
+//     alias: clusterName
+type fileRouteStore struct {
+	path    string
+	watcher *fsnotify.Watcher
+
+	mu       sync.Mutex
+	tables   map[string]*ClusterInfo
+	clusters map[string]*clusterRecord
+	watches  map[string][]chan RouteEvent
+	// the watches on the cluster records, a watch is registered on every cluster of its alias chain
+	clusterWatches map[string][]chan RouteEvent
+	// the watches on the table list
+	listWatches []chan RouteEvent
+	done        chan struct{}
+}
+
+type routeFile struct {
+	Tables   map[string]*ClusterInfo   `yaml:"tables"`
+	Clusters map[string]*clusterRecord `yaml:"clusters"`
+}
+
+func newFileRouteStore(path string) (*fileRouteStore, error) {
+	file, err := loadRouteFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// watch the directory rather than the file, so that the file replaced by renaming can still be watched
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, fmt.Errorf("failed to watch route file \"%s\": %s", path, err)
+	}
+
+	s := &fileRouteStore{
+		path:           path,
+		watcher:        watcher,
+		tables:         file.Tables,
+		clusters:       file.Clusters,
+		watches:        make(map[string][]chan RouteEvent),
+		clusterWatches: make(map[string][]chan RouteEvent),
+		done:           make(chan struct{}),
+	}
+	go s.watchFile()
+	return s, nil
+}
+
+func loadRouteFile(path string) (*routeFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read route file \"%s\": %s", path, err)
+	}
+	var file routeFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse route file \"%s\": %s", path, err)
+	}
+	if file.Tables == nil {
+		file.Tables = make(map[string]*ClusterInfo)
+	}
+	if file.Clusters == nil {
+		file.Clusters = make(map[string]*clusterRecord)
+	}
+	for name, record := range file.Clusters {
+		if record == nil {
+			return nil, fmt.Errorf("cluster \"%s\" is empty in route file \"%s\"", name, path)
+		}
+		if err := record.validate(); err != nil {
+			return nil, fmt.Errorf("cluster \"%s\" is invalid in route file \"%s\": %s", name, path, err)
+		}
+	}
+	for table, cluster := range file.Tables {
+		if cluster == nil {
+			return nil, fmt.Errorf("meta_addrs of table \"%s\" is empty in route file \"%s\"", table, path)
+		}
+		if err := cluster.validate(); err != nil {
+			return nil, fmt.Errorf("table \"%s\" is invalid in route file \"%s\": %s", table, path, err)
+		}
+		for _, c := range []*ClusterInfo{cluster, cluster.Backup} {
+			if c == nil || c.MetaAddrs != "" {
+				continue
+			}
+			if _, _, err := resolveCluster(c.Name, file.getCluster); err != nil {
+				return nil, fmt.Errorf("cluster \"%s\" of table \"%s\" can't be resolved in route file \"%s\": %s",
+					c.Name, table, path, err)
+			}
+		}
+	}
+	return &file, nil
+}
+
+func (f *routeFile) getCluster(name string) (*clusterRecord, error) {
+	record, ok := f.Clusters[name]
+	if !ok {
+		return nil, base.ERR_OBJECT_NOT_FOUND
+	}
+	return record, nil
+}
+
+func (s *fileRouteStore) getCluster(name string) (*clusterRecord, error) {
+	record, ok := s.clusters[name]
+	if !ok {
+		return nil, base.ERR_OBJECT_NOT_FOUND
+	}
+	return record, nil
+}
+
+// resolveLocked returns the cluster info with the meta servers of the referenced cluster filled.
+func (s *fileRouteStore) resolveLocked(cluster *ClusterInfo) *ClusterInfo {
+	if cluster.MetaAddrs != "" {
+		return cluster
+	}
+	// the references have been validated on loading
+	metaAddrs, _, _ := resolveCluster(cluster.Name, s.getCluster)
+	return &ClusterInfo{Name: cluster.Name, MetaAddrs: metaAddrs, Backup: cluster.Backup}
+}
+
+func (s *fileRouteStore) Get(table string) (*ClusterInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cluster, ok := s.tables[table]
+	if !ok {
+		return nil, base.ERR_OBJECT_NOT_FOUND
+	}
+	return s.resolveLocked(cluster), nil
+}
+
+func (s *fileRouteStore) Watch(ctx context.Context, table string) (*ClusterInfo, <-chan RouteEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cluster, ok := s.tables[table]
+	if !ok {
+		return nil, nil, base.ERR_OBJECT_NOT_FOUND
+	}
+	events := make(chan RouteEvent, 1)
+	s.watches[table] = append(s.watches[table], events)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.unwatch(table, events)
+		case <-s.done:
+		}
+	}()
+	return cluster, events, nil
+}
+
+func (s *fileRouteStore) WatchCluster(ctx context.Context, cluster string) (string, <-chan RouteEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metaAddrs, chain, err := resolveCluster(cluster, s.getCluster)
+	if err != nil {
+		return "", nil, err
+	}
+	events := make(chan RouteEvent, 1)
+	for _, name := range chain {
+		s.clusterWatches[name] = append(s.clusterWatches[name], events)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, name := range chain {
+				removeWatchFrom(s.clusterWatches, name, events)
+			}
+		case <-s.done:
+		}
+	}()
+	return metaAddrs, events, nil
+}
+
+func (s *fileRouteStore) unwatch(table string, events chan RouteEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removeWatchFrom(s.watches, table, events)
+}
+
+func removeWatchFrom(watches map[string][]chan RouteEvent, key string, events chan RouteEvent) {
+	remaining := removeRouteWatch(watches[key], events)
+	if len(remaining) == 0 {
+		delete(watches, key)
+	} else {
+		watches[key] = remaining
+	}
+}
+
+func removeRouteWatch(watches []chan RouteEvent, events chan RouteEvent) []chan RouteEvent {
+	for i, ch := range watches {
+		if ch == events {
+			return append(watches[:i], watches[i+1:]...)
+		}
+	}
+	return watches
+}
+
+func (s *fileRouteStore) List() (map[string]*ClusterInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string]*ClusterInfo, len(s.tables))
+	for table, cluster := range s.tables {
+		result[table] = s.resolveLocked(cluster)
+	}
+	return result, nil
+}
+
+func (s *fileRouteStore) WatchList(ctx context.Context) (map[string]*ClusterInfo, <-chan RouteEvent, error) {
+	tables, _ := s.List()
+	events := make(chan RouteEvent, 1)
+	s.mu.Lock()
+	s.listWatches = append(s.listWatches, events)
+	s.mu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.listWatches = removeRouteWatch(s.listWatches, events)
+			s.mu.Unlock()
+		case <-s.done:
+		}
+	}()
+	return tables, events, nil
+}
+
+// Ping always succeeds since the routes are loaded into memory, the invalid route file is ignored on reloading.
+func (s *fileRouteStore) Ping() error {
+	return nil
+}
+
+func (s *fileRouteStore) Close() {
+	close(s.done)
+	_ = s.watcher.Close()
+}
+
+func (s *fileRouteStore) watchFile() {
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(s.path) || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			file, err := loadRouteFile(s.path)
+			if err != nil {
+				logrus.Errorf("failed to reload route file, keep the previous routes: %s", err)
+				continue
+			}
+			s.reload(file)
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("failed to watch route file \"%s\": %s", s.path, err)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reload replaces the routes and notifies the watches of the changed tables and clusters.
+func (s *fileRouteStore) reload(file *routeFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tables := file.Tables
+	for table, watches := range s.watches {
+		cluster, ok := tables[table]
+		var event RouteEvent
+		if !ok {
+			event = RouteEvent{Type: RouteDeleted}
+		} else if !cluster.equal(s.tables[table]) {
+			event = RouteEvent{Type: RouteChanged}
+		} else {
+			continue
+		}
+		for _, events := range watches {
+			events <- event
+		}
+		delete(s.watches, table)
+	}
+	for name, watches := range s.clusterWatches {
+		record, ok := file.Clusters[name]
+		if ok && *record == *s.clusters[name] {
+			continue
+		}
+		for _, events := range watches {
+			// the watch may be registered on several clusters of the alias chain, only one event is needed
+			select {
+			case events <- RouteEvent{Type: RouteChanged}:
+			default:
+			}
+		}
+		delete(s.clusterWatches, name)
+	}
+	if !sameTableSet(s.tables, tables) {
+		for _, events := range s.listWatches {
+			events <- RouteEvent{Type: RouteChanged}
+		}
+		s.listWatches = nil
+	}
+	s.tables = tables
+	s.clusters = file.Clusters
+	logrus.Infof("route file \"%s\" is reloaded, %d tables, %d clusters", s.path, len(tables), len(file.Clusters))
+}
+
+func sameTableSet(a map[string]*ClusterInfo, b map[string]*ClusterInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for table := range a {
+		if _, ok := b[table]; !ok {
+			return false
+		}
+	}
+	return true
+}
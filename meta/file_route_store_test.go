@@ -0,0 +1,255 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/XiaoMi/pegasus-go-client/session"
+	"github.com/pegasus-kv/meta-proxy/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testRouteFile = `
+tables:
+  temp:
+    cluster_name: onebox
+    meta_addrs: 127.0.0.1:34601,127.0.0.1:34602
+  stat:
+    cluster_name: onebox
+    meta_addrs: 127.0.0.1:34601,127.0.0.1:34602
+`
+
+const testRouteFileUpdated = `
+tables:
+  temp:
+    cluster_name: onebox2
+    meta_addrs: 127.0.1.1:34601,127.0.1.1:34602
+`
+
+// writeRouteFile replaces the route file by renaming, which is how most editors and config managers update files.
+func writeRouteFile(t *testing.T, path string, content string) {
+	tmp := path + ".tmp"
+	assert.Nil(t, ioutil.WriteFile(tmp, []byte(content), 0644))
+	assert.Nil(t, os.Rename(tmp, path))
+}
+
+func waitRouteEvent(t *testing.T, events <-chan RouteEvent) RouteEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "no route event is received")
+		return RouteEvent{Type: -1}
+	}
+}
+
+// newTestClusterManager returns the cluster manager on the route store, its table cache is created as in
+// production so that the evicted watchers are stopped.
+func newTestClusterManager(store RouteStore) *ClusterManager {
+	return &ClusterManager{
+		Store:  store,
+		Tables: newTableCache(10),
+		Metas:  make(map[string]*session.MetaManager),
+	}
+}
+
+// newTestRouteFile writes the routes into a route file in a temporary directory, which is removed once the test
+// finishes, and returns its path.
+func newTestRouteFile(t *testing.T, routes string) string {
+	path := filepath.Join(t.TempDir(), "routes.yml")
+	writeRouteFile(t, path, routes)
+	return path
+}
+
+// newTestFileClusterManager returns the cluster manager on the file route store of the routes and the path of the
+// route file, the manager is closed once the test finishes.
+func newTestFileClusterManager(t *testing.T, routes string) (*ClusterManager, string) {
+	path := newTestRouteFile(t, routes)
+	store, err := newFileRouteStore(path)
+	if err != nil {
+		t.Fatalf("failed to create the file route store: %s", err)
+	}
+	m := newTestClusterManager(store)
+	t.Cleanup(m.close)
+	return m, path
+}
+
+func TestFileRouteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yml")
+
+	_, err := newFileRouteStore(path)
+	assert.NotNil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, []byte("tables:\n  temp:\n    cluster_name: onebox\n"), 0644))
+	_, err = newFileRouteStore(path)
+	assert.NotNil(t, err)
+
+	writeRouteFile(t, path, testRouteFile)
+	store, err := newFileRouteStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	cluster, err := store.Get("temp")
+	assert.Nil(t, err)
+	assert.Equal(t, &ClusterInfo{Name: "onebox", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"}, cluster)
+	_, err = store.Get("notExist")
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND, err)
+	_, _, err = store.Watch(context.Background(), "notExist")
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND, err)
+	tables, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tables))
+
+	_, tempEvents, err := store.Watch(context.Background(), "temp")
+	assert.Nil(t, err)
+	_, statEvents, err := store.Watch(context.Background(), "stat")
+	assert.Nil(t, err)
+	tables, listEvents, err := store.WatchList(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tables))
+
+	// the invalid file is ignored and the previous routes are kept
+	writeRouteFile(t, path, "tables: [")
+	time.Sleep(100 * time.Millisecond)
+	cluster, _ = store.Get("temp")
+	assert.Equal(t, "onebox", cluster.Name)
+
+	writeRouteFile(t, path, testRouteFileUpdated)
+	assert.Equal(t, RouteChanged, waitRouteEvent(t, tempEvents).Type)
+	assert.Equal(t, RouteDeleted, waitRouteEvent(t, statEvents).Type)
+	assert.Equal(t, RouteChanged, waitRouteEvent(t, listEvents).Type)
+	cluster, _ = store.Get("temp")
+	assert.Equal(t, &ClusterInfo{Name: "onebox2", MetaAddrs: "127.0.1.1:34601,127.0.1.1:34602"}, cluster)
+	_, err = store.Get("stat")
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND, err)
+}
+
+func TestClusterManagerWithFileRouteStore(t *testing.T) {
+	m, path := newTestFileClusterManager(t, testRouteFile)
+
+	addrs, meta, err := m.getMeta(context.Background(), "temp")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", addrs)
+	assert.NotNil(t, meta)
+	m.releaseMeta(addrs)
+	_, err = m.getMetaAddrs(context.Background(), "notExist")
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND, err)
+
+	// the cached table is updated once the route file is modified
+	writeRouteFile(t, path, testRouteFileUpdated)
+	time.Sleep(500 * time.Millisecond)
+	addrs, err = m.getMetaAddrs(context.Background(), "temp")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.1.1:34601,127.0.1.1:34602", addrs)
+}
+
+func TestClusterManagerTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(provider)
+
+	m, _ := newTestFileClusterManager(t, testRouteFile)
+
+	ctx, root := tracing.Start(context.Background(), "request")
+	addrs, err := m.getMetaAddrs(ctx, "temp")
+	assert.Nil(t, err)
+	var calls int32
+	queryFn := tracedQueryConfig(addrs, newFakeQueryConfig(&calls, base.ERR_OBJECT_NOT_FOUND, closedChan()))
+	_, err = queryFn(ctx, "temp")
+	assert.Nil(t, err)
+	// the table is cached, so the route store is not requested again
+	_, err = m.getMetaAddrs(ctx, "temp")
+	assert.Nil(t, err)
+	_, err = m.getMetaAddrs(ctx, "notExist")
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND, err)
+	root.End()
+
+	var names []string
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		names = append(names, span.Name())
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	assert.Equal(t, []string{"newTableInfo", "getMeta", "meta.QueryConfig", "getMeta", "newTableInfo", "getMeta",
+		"request"}, names)
+	rootID := root.SpanContext().SpanID()
+	for _, span := range spans["getMeta"] {
+		assert.Equal(t, rootID, span.Parent().SpanID())
+	}
+	assert.Equal(t, spans["getMeta"][0].SpanContext().SpanID(), spans["newTableInfo"][0].Parent().SpanID())
+	assert.Contains(t, spans["newTableInfo"][0].Attributes(), tracing.ClusterKey.String("onebox"))
+	assert.Contains(t, spans["getMeta"][0].Attributes(), tracing.MetaAddrsKey.String(addrs))
+	assert.Equal(t, codes.Unset, spans["getMeta"][1].Status().Code)
+
+	queryConfig := spans["meta.QueryConfig"][0]
+	assert.Equal(t, rootID, queryConfig.Parent().SpanID())
+	assert.Contains(t, queryConfig.Attributes(), tracing.TableKey.String("temp"))
+	assert.Equal(t, codes.Error, queryConfig.Status().Code)
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND.String(), queryConfig.Status().Description)
+
+	// the failure is recorded in the spans of the table not found
+	assert.Equal(t, codes.Error, spans["newTableInfo"][1].Status().Code)
+	assert.Equal(t, codes.Error, spans["getMeta"][2].Status().Code)
+}
+
+func TestClusterManagerWarmUp(t *testing.T) {
+	m, path := newTestFileClusterManager(t, testRouteFile)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	oldManager := globalClusterManager
+	globalClusterManager = m
+	defer func() { globalClusterManager = oldManager }()
+
+	rec := httptest.NewRecorder()
+	handleReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	go m.warmUp(ctx)
+	assert.Eventually(t, m.isReady, 3*time.Second, 10*time.Millisecond)
+	assert.True(t, m.Tables.Has("temp"))
+	assert.True(t, m.Tables.Has("stat"))
+	rec = httptest.NewRecorder()
+	handleReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"ready": true, "degraded": false}`, rec.Body.String())
+
+	// the newly added table is loaded, and the removed one is removed from cache
+	writeRouteFile(t, path, testRouteFileUpdated+`
+  new:
+    cluster_name: onebox
+    meta_addrs: 127.0.0.1:34601,127.0.0.1:34602
+`)
+	assert.Eventually(t, func() bool {
+		return m.Tables.Has("new") && !m.Tables.Has("stat")
+	}, 3*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,279 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/pegasus-kv/thrift/lib/go/thrift"
+	"github.com/sirupsen/logrus"
+)
+
+var globalMetaForwarder = newMetaForwarder()
+
+// the max number of idle connections kept for each meta server
+const maxIdleForwardConns = 8
+
+// metaForwarder relays the raw requests to meta servers. Each connection serves only one request at
+// a time, so that the responses never mismatch even if different clients use the same seqID.
+type metaForwarder struct {
+	mu     sync.Mutex
+	idle   map[string][]net.Conn
+	closed bool
+}
+
+func newMetaForwarder() *metaForwarder {
+	return &metaForwarder{idle: make(map[string][]net.Conn)}
+}
+
+// forwardRequest passes through the request of any method that the proxy doesn't handle itself, to
+// the meta server of the cluster where the table of request locates. If the table is unknown,
+// the request is forwarded to `passthrough.default_meta_addrs`.
+func forwardRequest(ctx context.Context, methodName string, body []byte) ([]byte, error) {
+	metaList, err := resolveForwardMetaList(ctx, parseAppName(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := globalMetaForwarder.forward(ctx, metaList, body)
+	if err != nil {
+		logrus.Errorf("failed to forward %s to meta %s: %s", methodName, metaList, err)
+		return nil, base.ERR_NETWORK_FAILURE
+	}
+	return resp, nil
+}
+
+func resolveForwardMetaList(ctx context.Context, appName string) ([]string, error) {
+	defaultAddrs := config.GlobalConfig.PassthroughOpts.DefaultMetaAddrs
+	if appName != "" {
+		addrs, err := globalClusterManager.getMetaAddrs(ctx, appName)
+		if err == nil {
+			return parseToMetaList(addrs)
+		}
+		if err != base.ERR_OBJECT_NOT_FOUND || defaultAddrs == "" {
+			return nil, err
+		}
+	}
+	if defaultAddrs == "" {
+		return nil, base.ERR_CLUSTER_NOT_FOUND
+	}
+	return parseToMetaList(defaultAddrs)
+}
+
+// parseAppName extracts the table name from the thrift message of request. By convention of rDSN,
+// the arguments of the table-level meta rpc wrap a request struct, whose first field is the table
+// name, e.g configuration_create_app_request.app_name. Empty string is returned if there's no such field.
+func parseAppName(body []byte) string {
+	iprot := thrift.NewTBinaryProtocolTransport(thrift.NewStreamTransportR(bytes.NewBuffer(body)))
+	if _, _, _, err := iprot.ReadMessageBegin(); err != nil {
+		return ""
+	}
+	if _, err := iprot.ReadStructBegin(); err != nil {
+		return ""
+	}
+	_, fieldType, fieldID, err := iprot.ReadFieldBegin()
+	if err != nil || fieldType != thrift.STRUCT || fieldID != 1 {
+		return ""
+	}
+	if _, err := iprot.ReadStructBegin(); err != nil {
+		return ""
+	}
+	_, fieldType, fieldID, err = iprot.ReadFieldBegin()
+	if err != nil || fieldType != thrift.STRING || fieldID != 1 {
+		return ""
+	}
+	appName, err := iprot.ReadString()
+	if err != nil {
+		return ""
+	}
+	return appName
+}
+
+// forward tries the meta servers in order until one of them responds. Like session.MetaManager, the
+// next meta server is tried if the current one isn't the leader, that is, it replies ERR_FORWARD_TO_OTHERS
+// or ERR_SERVICE_NOT_ACTIVE. The last such response is returned if none of them is the leader.
+func (f *metaForwarder) forward(ctx context.Context, metaList []string, body []byte) ([]byte, error) {
+	var notLeaderResp []byte
+	var err error
+	for _, addr := range metaList {
+		var resp []byte
+		resp, err = f.call(ctx, addr, body)
+		if err == nil {
+			errno := parseResponseErrno(resp)
+			if errno != base.ERR_FORWARD_TO_OTHERS && errno != base.ERR_SERVICE_NOT_ACTIVE {
+				return resp, nil
+			}
+			logrus.Warnf("meta %s is not the leader: %s", addr, errno)
+			notLeaderResp = resp
+			continue
+		}
+		logrus.Warnf("failed to forward request to meta %s: %s", addr, err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	if notLeaderResp != nil {
+		return notLeaderResp, nil
+	}
+	return nil, err
+}
+
+// parseResponseErrno extracts the error code from the response frame. It's the rpc-level error code
+// in the header if not ERR_OK, otherwise the `err` of the response struct. By convention of rDSN, the
+// result of meta rpc wraps a response struct whose first field is the error code, e.g
+// configuration_create_app_response.err. ERR_OK is returned if there's no such field.
+func parseResponseErrno(resp []byte) base.DsnErrCode {
+	iprot := thrift.NewTBinaryProtocolTransport(thrift.NewStreamTransportR(bytes.NewBuffer(resp[4:])))
+	ec := &base.ErrorCode{}
+	if err := ec.Read(iprot); err != nil {
+		return base.ERR_OK
+	}
+	if ec.Errno != base.ERR_OK.String() {
+		errno, _ := base.DsnErrCodeString(ec.Errno)
+		return errno
+	}
+
+	if _, _, _, err := iprot.ReadMessageBegin(); err != nil {
+		return base.ERR_OK
+	}
+	if _, err := iprot.ReadStructBegin(); err != nil {
+		return base.ERR_OK
+	}
+	_, fieldType, fieldID, err := iprot.ReadFieldBegin()
+	if err != nil || fieldType != thrift.STRUCT || fieldID != 0 {
+		return base.ERR_OK
+	}
+	if _, err := iprot.ReadStructBegin(); err != nil {
+		return base.ERR_OK
+	}
+	_, fieldType, fieldID, err = iprot.ReadFieldBegin()
+	if err != nil || fieldType != thrift.STRUCT || fieldID != 1 {
+		return base.ERR_OK
+	}
+	if err := ec.Read(iprot); err != nil {
+		return base.ERR_OK
+	}
+	errno, _ := base.DsnErrCodeString(ec.Errno)
+	return errno
+}
+
+// call sends the request to the meta server and reads the complete response frame.
+func (f *metaForwarder) call(ctx context.Context, addr string, body []byte) ([]byte, error) {
+	conn, err := f.getConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	resp, err := roundTrip(conn, encodeRequestHeader(body, deadline), body)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	f.putConn(addr, conn)
+	return resp, nil
+}
+
+func roundTrip(conn net.Conn, header []byte, body []byte) ([]byte, error) {
+	if _, err := conn.Write(append(header, body...)); err != nil {
+		return nil, err
+	}
+
+	// |- length(including itself) -|- error code + thrift message -|
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, err
+	}
+	respLen := binary.BigEndian.Uint32(lenBuf)
+	if respLen < 4 {
+		return nil, fmt.Errorf("response length(%d) smaller than 4 bytes", respLen)
+	}
+	resp := make([]byte, respLen)
+	copy(resp, lenBuf)
+	if _, err := io.ReadFull(conn, resp[4:]); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// encodeRequestHeader encodes the v0 request header, see requestDecoder for the layout.
+func encodeRequestHeader(body []byte, deadline time.Time) []byte {
+	var clientTimeout uint32
+	if !deadline.IsZero() {
+		clientTimeout = uint32(time.Until(deadline) / time.Millisecond)
+	}
+	header := make([]byte, 48)
+	copy(header[0:4], "THFT")
+	binary.BigEndian.PutUint32(header[4:8], 0)   // header version
+	binary.BigEndian.PutUint32(header[8:12], 48) // header length
+	binary.BigEndian.PutUint32(header[16:20], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[32:36], clientTimeout)
+	return header
+}
+
+func (f *metaForwarder) getConn(ctx context.Context, addr string) (net.Conn, error) {
+	f.mu.Lock()
+	if conns := f.idle[addr]; len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		f.idle[addr] = conns[:len(conns)-1]
+		f.mu.Unlock()
+		return conn, nil
+	}
+	f.mu.Unlock()
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (f *metaForwarder) putConn(addr string, conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed || len(f.idle[addr]) >= maxIdleForwardConns {
+		_ = conn.Close()
+		return
+	}
+	f.idle[addr] = append(f.idle[addr], conn)
+}
+
+// close releases all the idle connections.
+func (f *metaForwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for _, conns := range f.idle {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	f.idle = make(map[string][]net.Conn)
+}
@@ -0,0 +1,167 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/admin"
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/XiaoMi/pegasus-go-client/session"
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/pegasus-kv/thrift/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func marshalRequestBody(t *testing.T, args session.RpcRequestArgs, name string) []byte {
+	rcall, err := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, args, name)
+	assert.Nil(t, err)
+	return rcall.RawReq[48:] // skip the v0 header
+}
+
+func TestParseAppName(t *testing.T) {
+	createArgs := &admin.AdminClientCreateAppArgs{
+		Req: &admin.CreateAppRequest{AppName: "test_app", Options: &admin.CreateAppOptions{}},
+	}
+	assert.Equal(t, "test_app", parseAppName(marshalRequestBody(t, createArgs, "RPC_CM_CREATE_APP")))
+
+	listArgs := &admin.AdminClientListAppsArgs{Req: &admin.ListAppsRequest{}}
+	assert.Equal(t, "", parseAppName(marshalRequestBody(t, listArgs, "RPC_CM_LIST_APPS")))
+
+	assert.Equal(t, "", parseAppName([]byte("invalid")))
+}
+
+// startFakeMeta starts a meta server which replies `resp` to every request, it returns the address
+// and the number of accepted connections.
+func startFakeMeta(t *testing.T, resp []byte) (string, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				for {
+					header := make([]byte, 48)
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					body := make([]byte, binary.BigEndian.Uint32(header[16:20]))
+					if _, err := io.ReadFull(conn, body); err != nil {
+						return
+					}
+					_, _ = conn.Write(resp)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func TestForwardRequest(t *testing.T) {
+	resp := []byte{0, 0, 0, 8, 'a', 'b', 'c', 'd'}
+	addr, accepted := startFakeMeta(t, resp)
+
+	// the first meta server is unreachable, so the request is forwarded to the second one
+	defaultAddrs := config.GlobalConfig.PassthroughOpts.DefaultMetaAddrs
+	defer func() {
+		config.GlobalConfig.PassthroughOpts.DefaultMetaAddrs = defaultAddrs
+	}()
+	config.GlobalConfig.PassthroughOpts.DefaultMetaAddrs = "127.0.0.1:1," + addr
+
+	body := marshalRequestBody(t, &admin.AdminClientListAppsArgs{Req: &admin.ListAppsRequest{}}, "RPC_CM_LIST_APPS")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		result, err := forwardRequest(ctx, "RPC_CM_LIST_APPS", body)
+		assert.Nil(t, err)
+		assert.Equal(t, resp, result)
+	}
+	// the connection is reused
+	assert.Equal(t, int32(1), atomic.LoadInt32(accepted))
+
+	config.GlobalConfig.PassthroughOpts.DefaultMetaAddrs = ""
+	_, err := forwardRequest(ctx, "RPC_CM_LIST_APPS", body)
+	assert.Equal(t, base.ERR_CLUSTER_NOT_FOUND, err)
+}
+
+// marshalListAppsResponse encodes the response frame of RPC_CM_LIST_APPS, the rpc-level error code is
+// `header` and the error code in the response struct is `errno`.
+func marshalListAppsResponse(t *testing.T, header base.DsnErrCode, errno base.DsnErrCode) []byte {
+	buf := thrift.NewTMemoryBuffer()
+	oprot := thrift.NewTBinaryProtocolTransport(buf)
+	assert.Nil(t, oprot.WriteI32(0))
+	assert.Nil(t, oprot.WriteString(header.String()))
+	assert.Nil(t, oprot.WriteMessageBegin("RPC_CM_LIST_APPS_ACK", thrift.REPLY, 1))
+	if header == base.ERR_OK {
+		result := &admin.AdminClientListAppsResult{
+			Success: &admin.ListAppsResponse{Err: &base.ErrorCode{Errno: errno.String()}},
+		}
+		assert.Nil(t, result.Write(oprot))
+	}
+	assert.Nil(t, oprot.WriteMessageEnd())
+	resp := buf.Bytes()
+	binary.BigEndian.PutUint32(resp, uint32(len(resp)))
+	return resp
+}
+
+func TestParseResponseErrno(t *testing.T) {
+	assert.Equal(t, base.ERR_OK, parseResponseErrno(marshalListAppsResponse(t, base.ERR_OK, base.ERR_OK)))
+	assert.Equal(t, base.ERR_FORWARD_TO_OTHERS,
+		parseResponseErrno(marshalListAppsResponse(t, base.ERR_OK, base.ERR_FORWARD_TO_OTHERS)))
+	assert.Equal(t, base.ERR_SERVICE_NOT_ACTIVE,
+		parseResponseErrno(marshalListAppsResponse(t, base.ERR_SERVICE_NOT_ACTIVE, base.ERR_OK)))
+	assert.Equal(t, base.ERR_OK, parseResponseErrno([]byte{0, 0, 0, 8, 'a', 'b', 'c', 'd'}))
+}
+
+func TestForwardToLeader(t *testing.T) {
+	forwardResp := marshalListAppsResponse(t, base.ERR_OK, base.ERR_FORWARD_TO_OTHERS)
+	forwardAddr, _ := startFakeMeta(t, forwardResp)
+	notActiveAddr, _ := startFakeMeta(t, marshalListAppsResponse(t, base.ERR_SERVICE_NOT_ACTIVE, base.ERR_OK))
+	leaderResp := marshalListAppsResponse(t, base.ERR_OK, base.ERR_OK)
+	leaderAddr, _ := startFakeMeta(t, leaderResp)
+
+	f := newMetaForwarder()
+	defer f.close()
+	body := marshalRequestBody(t, &admin.AdminClientListAppsArgs{Req: &admin.ListAppsRequest{}}, "RPC_CM_LIST_APPS")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// the meta servers which are not the leader are skipped
+	resp, err := f.forward(ctx, []string{forwardAddr, notActiveAddr, leaderAddr}, body)
+	assert.Nil(t, err)
+	assert.Equal(t, leaderResp, resp)
+
+	// the response is returned as is if there's no leader
+	resp, err = f.forward(ctx, []string{notActiveAddr, forwardAddr}, body)
+	assert.Nil(t, err)
+	assert.Equal(t, forwardResp, resp)
+}
@@ -21,20 +21,31 @@ package meta
 
 import (
 	"context"
+	"time"
 
+	"github.com/XiaoMi/pegasus-go-client/idl/admin"
 	"github.com/XiaoMi/pegasus-go-client/idl/base"
 	"github.com/XiaoMi/pegasus-go-client/idl/replication"
 	"github.com/XiaoMi/pegasus-go-client/idl/rrdb"
+	"github.com/pegasus-kv/meta-proxy/config"
 	"github.com/pegasus-kv/meta-proxy/metrics"
 	"github.com/pegasus-kv/meta-proxy/rpc"
+	"github.com/pegasus-kv/meta-proxy/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var clientQueryConfigCount metrics.Meter
+var (
+	clientQueryConfigCount   metrics.Meter
+	clientQueryConfigLatency metrics.Timer
+	metaQueryConfigLatency   metrics.Timer
+)
 
 func Init() {
-	clientQueryConfigCount = metrics.RegisterMeterWithTags("client_query_config_count", []string{"table"})
+	registerMetrics()
 	initClusterManager()
+	initConfigCache()
 
 	rpc.Register("RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX", &rpc.MethodDefinition{
 		RequestCreator: func() rpc.RequestArgs {
@@ -44,6 +55,41 @@ func Init() {
 		},
 		Handler: queryConfig,
 	})
+	rpc.Register("RPC_CM_LIST_APPS", &rpc.MethodDefinition{
+		RequestCreator: func() rpc.RequestArgs {
+			return &admin.AdminClientListAppsArgs{
+				Req: admin.NewListAppsRequest(),
+			}
+		},
+		Handler: listApps,
+	})
+
+	if config.GlobalConfig.PassthroughOpts.Enable {
+		rpc.RegisterFallback(forwardRequest)
+	}
+}
+
+// registerMetrics registers all the metrics of the meta package.
+func registerMetrics() {
+	clientQueryConfigCount = metrics.RegisterMeterWithTags("client_query_config_count", []string{"table"})
+	clientQueryConfigLatency = metrics.RegisterTimerWithTags("client_query_config_latency", []string{"table"})
+	metaQueryConfigLatency = metrics.RegisterTimerWithTags("meta_query_config_latency", []string{"table"})
+	listAppsFailedCount = metrics.RegisterMeterWithTags("list_apps_failed_count", []string{"cluster"})
+	zkRequestCount = metrics.RegisterMeterWithTags("zk_request_count", []string{"table"})
+	zkRequestLatency = metrics.RegisterTimerWithTags("zk_request_latency", []string{"table"})
+	failoverSwitchCount = metrics.RegisterMeterWithTags("failover_switch_count", []string{"table", "to"})
+	metaConnectionCount = metrics.RegisterGauge("meta_connection_count")
+	metaServerDownCount = metrics.RegisterGaugeWithTags("meta_server_down_count", []string{"meta"})
+	metaProbeFailedCount = metrics.RegisterMeterWithTags("meta_probe_failed_count", []string{"meta"})
+	configCacheHitCount = metrics.RegisterMeterWithTags("config_cache_hit_count", []string{"table"})
+	configCacheMissCount = metrics.RegisterMeterWithTags("config_cache_miss_count", []string{"table"})
+	configCacheCoalescedCount = metrics.RegisterMeterWithTags("config_cache_coalesced_count", []string{"table"})
+}
+
+// Close releases the zookeeper watchers and the meta server connections. It's called when the proxy exits.
+func Close() {
+	globalClusterManager.close()
+	globalMetaForwarder.close()
 }
 
 func queryConfig(ctx context.Context, args rpc.RequestArgs) rpc.ResponseResult {
@@ -51,8 +97,11 @@ func queryConfig(ctx context.Context, args rpc.RequestArgs) rpc.ResponseResult {
 	queryCfgArgs := args.(*rrdb.MetaQueryCfgArgs)
 	tableName := queryCfgArgs.Query.AppName
 	clientQueryConfigCount.UpdateWithTags([]string{tableName})
+	defer clientQueryConfigLatency.UpdateSinceWithTags([]string{tableName}, time.Now())
+
+	trace.SpanFromContext(ctx).SetAttributes(tracing.TableKey.String(tableName))
 
-	addrs, meta, err := globalClusterManager.getMeta(tableName)
+	addrs, meta, err := globalClusterManager.getMeta(ctx, tableName)
 	if err != nil {
 		errorCode = parseToErrorCode(err)
 		return &rrdb.MetaQueryCfgResult{
@@ -61,8 +110,10 @@ func queryConfig(ctx context.Context, args rpc.RequestArgs) rpc.ResponseResult {
 			},
 		}
 	}
+	defer globalClusterManager.releaseMeta(addrs)
 
-	resp, err := meta.QueryConfig(ctx, tableName)
+	queryFn := timedQueryConfig(tracedQueryConfig(addrs, meta.QueryConfig))
+	resp, err := globalConfigCache.query(ctx, addrs, tableName, queryFn)
 	if err != nil {
 		errorCode = parseToErrorCode(err)
 		return &rrdb.MetaQueryCfgResult{
@@ -81,6 +132,28 @@ func queryConfig(ctx context.Context, args rpc.RequestArgs) rpc.ResponseResult {
 	}
 }
 
+// timedQueryConfig measures the latency of the queries to meta server, the ones served by config cache are excluded.
+func timedQueryConfig(queryFn queryConfigFunc) queryConfigFunc {
+	return func(ctx context.Context, table string) (*replication.QueryCfgResponse, error) {
+		defer metaQueryConfigLatency.UpdateSinceWithTags([]string{table}, time.Now())
+		return queryFn(ctx, table)
+	}
+}
+
+// tracedQueryConfig records the span of the query to meta server.
+func tracedQueryConfig(addrs string, queryFn queryConfigFunc) queryConfigFunc {
+	return func(ctx context.Context, table string) (*replication.QueryCfgResponse, error) {
+		ctx, span := tracing.Start(ctx, "meta.QueryConfig", tracing.TableKey.String(table),
+			tracing.MetaAddrsKey.String(addrs))
+		resp, err := queryFn(ctx, table)
+		if err == nil && resp.GetErr().Errno != base.ERR_OK.String() {
+			span.SetStatus(codes.Error, resp.GetErr().Errno)
+		}
+		tracing.End(span, err)
+		return resp, err
+	}
+}
+
 func parseToErrorCode(err error) *base.ErrorCode {
 	if dsnErr, ok := err.(base.DsnErrCode); ok {
 		return &base.ErrorCode{Errno: dsnErr.String()}
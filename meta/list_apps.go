@@ -0,0 +1,167 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/admin"
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/pegasus-kv/meta-proxy/metrics"
+	"github.com/pegasus-kv/meta-proxy/rpc"
+	"github.com/sirupsen/logrus"
+)
+
+var listAppsFailedCount metrics.Meter
+
+// clusterNameEnvKey is the env key of AppInfo which tells the cluster where the table locates.
+const clusterNameEnvKey = "cluster_name"
+
+// clusterApps is the result of listing tables from one cluster.
+type clusterApps struct {
+	name      string
+	metaAddrs string
+	apps      []*admin.AppInfo
+	err       *base.ErrorCode // nil if succeed
+	cause     error           // the error err is derived from
+}
+
+// listApps lists the tables from all the clusters which has tables registered in route store, and
+// only the registered tables are returned. The cluster name is set in the envs of each table.
+// If some of the clusters fail, the tables of the other clusters are still returned with
+// ERR_INCOMPLETE_DATA, so that the caller can tell the result is partial. The failed clusters
+// are logged and counted by name, since the response has no room for them.
+func listApps(ctx context.Context, args rpc.RequestArgs) rpc.ResponseResult {
+	req := args.(*admin.AdminClientListAppsArgs).Req
+	tables, err := globalClusterManager.Store.List()
+	if err != nil {
+		return &admin.AdminClientListAppsResult{
+			Success: &admin.ListAppsResponse{Err: parseToErrorCode(err)},
+		}
+	}
+
+	clusterNames := make(map[string]string)
+	for _, cluster := range tables {
+		clusterNames[cluster.MetaAddrs] = cluster.Name
+	}
+	var wg sync.WaitGroup
+	results := make([]*clusterApps, 0, len(clusterNames))
+	for addrs, name := range clusterNames {
+		result := &clusterApps{name: name, metaAddrs: addrs}
+		results = append(results, result)
+		wg.Add(1)
+		go func() {
+			listClusterApps(ctx, result, req)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	var failed []*clusterApps
+	var failedNames []string
+	for _, result := range results {
+		if result.err != nil {
+			logrus.Warnf("failed to list tables from cluster[%s(%s)] with %s: %s", result.name, result.metaAddrs,
+				result.err.Errno, result.cause)
+			listAppsFailedCount.UpdateWithTags([]string{result.name})
+			failed = append(failed, result)
+			failedNames = append(failedNames, result.name)
+		}
+	}
+	sort.Strings(failedNames)
+	if len(failed) > 0 && len(failed) == len(results) {
+		logrus.Errorf("failed to list tables from all clusters %v", failedNames)
+		return &admin.AdminClientListAppsResult{
+			Success: &admin.ListAppsResponse{Err: failed[0].err},
+		}
+	}
+	errno := base.ERR_OK
+	if len(failed) > 0 {
+		errno = base.ERR_INCOMPLETE_DATA
+		logrus.Warnf("list tables without clusters %v, %d of %d clusters failed", failedNames, len(failed), len(results))
+	}
+	return &admin.AdminClientListAppsResult{
+		Success: &admin.ListAppsResponse{
+			Err:   &base.ErrorCode{Errno: errno.String()},
+			Infos: mergeAppInfos(tables, results),
+		},
+	}
+}
+
+// listClusterApps lists the tables from the cluster of the result, the error is set to the result if it fails.
+func listClusterApps(ctx context.Context, result *clusterApps, req *admin.ListAppsRequest) {
+	meta, err := globalClusterManager.acquireMeta(result.metaAddrs)
+	if err != nil {
+		// the meta addrs of the cluster in route store are malformed
+		result.err, result.cause = &base.ErrorCode{Errno: base.ERR_INVALID_PARAMETERS.String()}, err
+		return
+	}
+	defer globalClusterManager.releaseMeta(result.metaAddrs)
+	resp, err := meta.ListApps(ctx, req)
+	if resp != nil && resp.GetErr().Errno != base.ERR_OK.String() {
+		result.err, result.cause = resp.GetErr(), err
+		return
+	}
+	if err != nil {
+		result.err, result.cause = callErrorCode(err), err
+		return
+	}
+	result.apps = resp.Infos
+}
+
+// callErrorCode returns the error code of the failed call to meta server.
+func callErrorCode(err error) *base.ErrorCode {
+	if dsnErr, ok := err.(base.DsnErrCode); ok {
+		return &base.ErrorCode{Errno: dsnErr.String()}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &base.ErrorCode{Errno: base.ERR_TIMEOUT.String()}
+	}
+	return &base.ErrorCode{Errno: base.ERR_NETWORK_FAILURE.String()}
+}
+
+// mergeAppInfos returns the tables of all clusters sorted by name. The tables which are not registered
+// to the cluster in route store are filtered out.
+func mergeAppInfos(tables map[string]*ClusterInfo, results []*clusterApps) []*admin.AppInfo {
+	merged := make([]*admin.AppInfo, 0)
+	for _, result := range results {
+		if result.err != nil {
+			continue
+		}
+		for _, app := range result.apps {
+			cluster, ok := tables[app.AppName]
+			if !ok || cluster.MetaAddrs != result.metaAddrs {
+				continue
+			}
+			if app.Envs == nil {
+				app.Envs = make(map[string]string)
+			}
+			app.Envs[clusterNameEnvKey] = cluster.Name
+			merged = append(merged, app)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].AppName < merged[j].AppName
+	})
+	return merged
+}
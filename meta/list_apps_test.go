@@ -0,0 +1,99 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/admin"
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeAppInfos(t *testing.T) {
+	tables := map[string]*ClusterInfo{
+		"temp":  {Name: "onebox", MetaAddrs: "127.0.0.1:34601"},
+		"stat":  {Name: "c3srv", MetaAddrs: "127.0.0.1:34602"},
+		"other": {Name: "c4srv", MetaAddrs: "127.0.0.1:34603"},
+	}
+	results := []*clusterApps{
+		{
+			metaAddrs: "127.0.0.1:34602",
+			apps: []*admin.AppInfo{
+				{AppName: "stat", Envs: map[string]string{"k": "v"}},
+				// not registered under zookeeper root
+				{AppName: "unknown"},
+			},
+		},
+		{
+			metaAddrs: "127.0.0.1:34601",
+			apps: []*admin.AppInfo{
+				{AppName: "temp"},
+				// registered to another cluster
+				{AppName: "other"},
+			},
+		},
+		{
+			metaAddrs: "127.0.0.1:34603",
+			err:       &base.ErrorCode{Errno: base.ERR_NETWORK_FAILURE.String()},
+		},
+	}
+
+	apps := mergeAppInfos(tables, results)
+	assert.Equal(t, 2, len(apps))
+	assert.Equal(t, "stat", apps[0].AppName)
+	assert.Equal(t, map[string]string{"k": "v", clusterNameEnvKey: "c3srv"}, apps[0].Envs)
+	assert.Equal(t, "temp", apps[1].AppName)
+	assert.Equal(t, map[string]string{clusterNameEnvKey: "onebox"}, apps[1].Envs)
+
+	assert.Empty(t, mergeAppInfos(tables, nil))
+}
+
+func TestListClusterApps(t *testing.T) {
+	oldManager := globalClusterManager
+	globalClusterManager = newTestClusterManager(nil)
+	defer func() {
+		globalClusterManager = oldManager
+	}()
+
+	// the malformed meta addrs are reported as invalid parameters rather than hidden
+	result := &clusterApps{name: "onebox", metaAddrs: "127.0.0.1:34601"}
+	listClusterApps(context.Background(), result, &admin.ListAppsRequest{})
+	assert.Equal(t, base.ERR_INVALID_PARAMETERS.String(), result.err.Errno)
+	assert.NotNil(t, result.cause)
+
+	// the error code of the meta server is returned as is
+	addr, _ := startFakeMeta(t, marshalListAppsResponse(t, base.ERR_OK, base.ERR_OBJECT_NOT_FOUND))
+	result = &clusterApps{name: "c3srv", metaAddrs: addr + "," + addr}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	listClusterApps(ctx, result, &admin.ListAppsRequest{})
+	assert.Equal(t, base.ERR_OBJECT_NOT_FOUND.String(), result.err.Errno)
+	assert.Empty(t, globalClusterManager.listMetaInfos())
+}
+
+func TestCallErrorCode(t *testing.T) {
+	assert.Equal(t, base.ERR_BUSY.String(), callErrorCode(base.ERR_BUSY).Errno)
+	assert.Equal(t, base.ERR_TIMEOUT.String(), callErrorCode(context.DeadlineExceeded).Errno)
+	assert.Equal(t, base.ERR_NETWORK_FAILURE.String(), callErrorCode(errors.New("connection refused")).Errno)
+}
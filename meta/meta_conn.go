@@ -0,0 +1,323 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/session"
+	"github.com/pegasus-kv/meta-proxy/admin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	metaServerUnknown = "unknown"
+	metaServerUp      = "up"
+	metaServerDown    = "down"
+)
+
+// metaConn is the state of the meta manager connected to a cluster, it's guarded by ClusterManager.Mut.
+type metaConn struct {
+	metaAddrs string
+	created   time.Time
+	// lastUsed is the unix nano time when the meta manager is used last time, updated atomically
+	lastUsed int64
+	// refs is the number of the table watchers routed to the cluster and the requests using the meta manager,
+	// the meta manager is closed once it drops to 0. It's updated atomically, since the requests take and release
+	// their references with only the read lock of ClusterManager.Mut held
+	refs    int32
+	servers []*metaServerHealth
+}
+
+// metaServerHealth is the health of a meta server, which is probed periodically.
+type metaServerHealth struct {
+	Addr      string     `json:"addr"`
+	Status    string     `json:"status"`
+	Failures  int        `json:"consecutive_failures"`
+	LastError string     `json:"last_error,omitempty"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+}
+
+func newMetaConn(metaAddrs string, metaList []string) *metaConn {
+	conn := &metaConn{
+		metaAddrs: metaAddrs,
+		created:   time.Now(),
+		lastUsed:  time.Now().UnixNano(),
+	}
+	for _, addr := range metaList {
+		conn.servers = append(conn.servers, &metaServerHealth{Addr: addr, Status: metaServerUnknown})
+	}
+	return conn
+}
+
+func (c *metaConn) touch() {
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+}
+
+func (c *metaConn) lastUsedTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastUsed))
+}
+
+// maintainMetas probes the meta servers periodically until ctx is done.
+func (m *ClusterManager) maintainMetas(ctx context.Context, interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.probeMetas(probeMetaServer, timeout)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// acquireMeta is the thread-safe wrapper of acquireMetaLocked.
+func (m *ClusterManager) acquireMeta(addrs string) (*session.MetaManager, error) {
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	return m.acquireMetaLocked(addrs)
+}
+
+// acquireMetaLocked returns the meta manager of the cluster and takes a reference on it, the meta manager is
+// created if not exists. The reference must be released by releaseMetaLocked. It must be called with m.Mut held.
+func (m *ClusterManager) acquireMetaLocked(addrs string) (*session.MetaManager, error) {
+	meta, err := m.getMetaManagerLocked(addrs)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&m.metaConns[addrs].refs, 1)
+	return meta, nil
+}
+
+// releaseMeta releases the reference taken by acquireMeta or getMeta. m.Mut is only locked exclusively to close
+// the meta manager when the last reference is released, so that the requests don't contend on it.
+func (m *ClusterManager) releaseMeta(addrs string) {
+	m.Mut.RLock()
+	conn := m.metaConns[addrs]
+	last := conn != nil && atomic.AddInt32(&conn.refs, -1) <= 0
+	m.Mut.RUnlock()
+	if !last {
+		return
+	}
+
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	// it may be referenced again meanwhile
+	if conn := m.metaConns[addrs]; conn != nil && atomic.LoadInt32(&conn.refs) <= 0 {
+		m.closeMetaLocked(addrs)
+		logrus.Infof("meta manager[%s] is closed since no table is routed to it", addrs)
+	}
+}
+
+// releaseMetaLocked releases the reference taken by acquireMetaLocked, the meta manager is closed once it's not
+// referenced any more. It must be called with m.Mut held.
+func (m *ClusterManager) releaseMetaLocked(addrs string) {
+	conn := m.metaConns[addrs]
+	if conn == nil {
+		return // closed with the cluster manager
+	}
+	if atomic.AddInt32(&conn.refs, -1) <= 0 {
+		m.closeMetaLocked(addrs)
+		logrus.Infof("meta manager[%s] is closed since no table is routed to it", addrs)
+	}
+}
+
+// refMetaLocked makes the table watcher hold a reference on the meta manager of the cluster it's routed to, the
+// references on the clusters it's no longer routed to (e.g. the meta servers of the referenced cluster are
+// changed) are released. It must be called with m.Mut held.
+func (m *ClusterManager) refMetaLocked(watcher *TableInfoWatcher, addrs string) (*session.MetaManager, error) {
+	if meta := m.Metas[addrs]; meta != nil && watcher.metaRefs[addrs] {
+		return meta, nil
+	}
+	if watcher.metaRefs == nil {
+		// the watcher has released its references since it's no longer cached, the meta manager is only referenced
+		// by the request, see getMeta
+		return m.getMetaManagerLocked(addrs)
+	}
+	meta, err := m.acquireMetaLocked(addrs)
+	if err != nil {
+		return nil, err
+	}
+	watcher.metaRefs[addrs] = true
+	for held := range watcher.metaRefs {
+		if held == addrs || watcher.routedTo(held) {
+			continue
+		}
+		delete(watcher.metaRefs, held)
+		m.releaseMetaLocked(held)
+	}
+	return meta, nil
+}
+
+// inheritMetaRefsLocked makes the watcher replacing the old one hold the references on the meta managers it's still
+// routed to, so that they're not closed and re-created on refreshing. It must be called with m.Mut held.
+func (m *ClusterManager) inheritMetaRefsLocked(old *TableInfoWatcher, watcher *TableInfoWatcher) {
+	if watcher.metaRefs == nil {
+		return
+	}
+	for addrs := range old.metaRefs {
+		if watcher.metaRefs[addrs] || !watcher.routedTo(addrs) {
+			continue
+		}
+		if _, err := m.acquireMetaLocked(addrs); err == nil {
+			watcher.metaRefs[addrs] = true
+		}
+	}
+}
+
+// releaseTableMetas releases the references of the table watcher once it's cancelled.
+func (m *ClusterManager) releaseTableMetas(watcher *TableInfoWatcher) {
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	for addrs := range watcher.metaRefs {
+		m.releaseMetaLocked(addrs)
+	}
+	watcher.metaRefs = nil
+}
+
+// closeMetaLocked closes the meta manager of the cluster, it must be called with m.Mut held.
+func (m *ClusterManager) closeMetaLocked(addrs string) {
+	if meta := m.Metas[addrs]; meta != nil {
+		if err := meta.Close(); err != nil {
+			logrus.Warnf("failed to close meta manager[%s]: %s", addrs, err)
+		}
+		delete(m.Metas, addrs)
+	}
+	if conn := m.metaConns[addrs]; conn != nil {
+		metaConnectionCount.Dec()
+		for _, server := range conn.servers {
+			if server.Status == metaServerDown {
+				metaServerDownCount.DecWithTags([]string{server.Addr})
+			}
+		}
+		delete(m.metaConns, addrs)
+	}
+}
+
+// probeMetas probes all the meta servers of the meta connections concurrently.
+func (m *ClusterManager) probeMetas(probe func(addr string, timeout time.Duration) error, timeout time.Duration) {
+	m.Mut.RLock()
+	addrSet := make(map[string]struct{})
+	for _, conn := range m.metaConns {
+		for _, server := range conn.servers {
+			addrSet[server.Addr] = struct{}{}
+		}
+	}
+	m.Mut.RUnlock()
+
+	var wg sync.WaitGroup
+	var resultMu sync.Mutex
+	results := make(map[string]error, len(addrSet))
+	for addr := range addrSet {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := probe(addr, timeout)
+			resultMu.Lock()
+			results[addr] = err
+			resultMu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	for _, conn := range m.metaConns {
+		for _, server := range conn.servers {
+			err, ok := results[server.Addr]
+			if !ok {
+				continue // added after probing
+			}
+			server.update(err, now)
+		}
+	}
+}
+
+func (h *metaServerHealth) update(err error, now time.Time) {
+	h.LastCheck = &now
+	if err != nil {
+		h.Failures++
+		h.LastError = err.Error()
+		metaProbeFailedCount.UpdateWithTags([]string{h.Addr})
+		if h.Status != metaServerDown {
+			logrus.Warnf("meta server[%s] is down: %s", h.Addr, err)
+			h.Status = metaServerDown
+			metaServerDownCount.IncWithTags([]string{h.Addr})
+		}
+		return
+	}
+	h.Failures = 0
+	h.LastError = ""
+	if h.Status == metaServerDown {
+		logrus.Infof("meta server[%s] is up again", h.Addr)
+		metaServerDownCount.DecWithTags([]string{h.Addr})
+	}
+	h.Status = metaServerUp
+}
+
+// MetaInfo is the state of a live meta connection.
+type MetaInfo struct {
+	MetaAddrs string `json:"meta_addrs"`
+	// Refs is the number of cached tables routed to the cluster, including the ones it's the backup cluster of,
+	// and the requests using the meta manager directly.
+	Refs     int32              `json:"refs"`
+	Created  time.Time          `json:"created"`
+	LastUsed time.Time          `json:"last_used"`
+	Servers  []metaServerHealth `json:"servers"`
+}
+
+// listMetaInfos returns the state of all the live meta connections sorted by meta addrs.
+func (m *ClusterManager) listMetaInfos() []MetaInfo {
+	m.Mut.RLock()
+	defer m.Mut.RUnlock()
+	result := make([]MetaInfo, 0, len(m.metaConns))
+	for _, conn := range m.metaConns {
+		info := MetaInfo{
+			MetaAddrs: conn.metaAddrs,
+			Refs:      atomic.LoadInt32(&conn.refs),
+			Created:   conn.created,
+			LastUsed:  conn.lastUsedTime(),
+		}
+		for _, server := range conn.servers {
+			info.Servers = append(info.Servers, *server)
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].MetaAddrs < result[j].MetaAddrs
+	})
+	return result
+}
+
+// handleListMetas is the admin handler to show the live meta connections.
+func handleListMetas(w http.ResponseWriter, r *http.Request) {
+	metas := globalClusterManager.listMetaInfos()
+	admin.RenderJSON(w, map[string]interface{}{
+		"count": len(metas),
+		"metas": metas,
+	})
+}
@@ -0,0 +1,131 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaConnLifecycle(t *testing.T) {
+	m, _ := newTestFileClusterManager(t, testRouteFile)
+
+	// the tables on the same cluster share one meta manager, which is referenced by the requests until released
+	addrs, meta1, err := m.getMeta(context.Background(), "temp")
+	assert.Nil(t, err)
+	_, meta2, err := m.getMeta(context.Background(), "stat")
+	assert.Nil(t, err)
+	assert.Equal(t, meta1, meta2)
+	metas := m.listMetaInfos()
+	assert.Equal(t, 1, len(metas))
+	assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", metas[0].MetaAddrs)
+	assert.Equal(t, int32(4), metas[0].Refs)
+	m.releaseMeta(addrs)
+	m.releaseMeta(addrs)
+	assert.Equal(t, int32(2), m.listMetaInfos()[0].Refs)
+	assert.Equal(t, 2, len(metas[0].Servers))
+	assert.Equal(t, metaServerUnknown, metas[0].Servers[0].Status)
+
+	// the meta manager used by a request directly is closed once it's released
+	_, err = m.acquireMeta("127.0.0.3:34601,127.0.0.3:34602")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(m.listMetaInfos()))
+	m.releaseMeta("127.0.0.3:34601,127.0.0.3:34602")
+	assert.Equal(t, 1, len(m.listMetaInfos()))
+
+	// the meta manager is closed once no cached table is routed to it
+	metaRefs := func() int32 {
+		metas := m.listMetaInfos()
+		if len(metas) == 0 {
+			return 0
+		}
+		return metas[0].Refs
+	}
+	m.evictTable("temp")
+	assert.Eventually(t, func() bool { return metaRefs() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, len(m.listMetaInfos()))
+	// the meta manager in use isn't closed until the request releases it
+	_, meta3, err := m.getMeta(context.Background(), "stat")
+	assert.Nil(t, err)
+	assert.Equal(t, meta1, meta3)
+	m.evictTable("stat")
+	assert.Eventually(t, func() bool { return metaRefs() == 1 }, time.Second, 10*time.Millisecond)
+	m.releaseMeta(addrs)
+	assert.Eventually(t, func() bool { return len(m.listMetaInfos()) == 0 }, time.Second, 10*time.Millisecond)
+	m.Mut.RLock()
+	assert.Empty(t, m.Metas)
+	m.Mut.RUnlock()
+
+	// the meta manager is created again on demand
+	_, meta4, err := m.getMeta(context.Background(), "temp")
+	assert.Nil(t, err)
+	assert.NotEqual(t, meta1, meta4)
+	m.releaseMeta(addrs)
+}
+
+func TestProbeMetas(t *testing.T) {
+	m := newTestClusterManager(nil)
+	defer func() {
+		m.Mut.Lock()
+		defer m.Mut.Unlock()
+		for addrs := range m.Metas {
+			m.closeMetaLocked(addrs)
+		}
+	}()
+	_, err := m.acquireMeta("127.0.0.1:34601,127.0.0.1:34602")
+	assert.Nil(t, err)
+
+	down := "127.0.0.1:34602"
+	probe := func(addr string, timeout time.Duration) error {
+		if addr == down {
+			return fmt.Errorf("connect %s: connection refused", addr)
+		}
+		return nil
+	}
+	m.probeMetas(probe, time.Second)
+	m.probeMetas(probe, time.Second)
+	servers := m.listMetaInfos()[0].Servers
+	assert.Equal(t, metaServerUp, servers[0].Status)
+	assert.Equal(t, metaServerDown, servers[1].Status)
+	assert.Equal(t, 2, servers[1].Failures)
+	assert.NotEmpty(t, servers[1].LastError)
+	assert.NotNil(t, servers[1].LastCheck)
+
+	down = ""
+	m.probeMetas(probe, time.Second)
+	servers = m.listMetaInfos()[0].Servers
+	assert.Equal(t, metaServerUp, servers[1].Status)
+	assert.Equal(t, 0, servers[1].Failures)
+
+	oldManager := globalClusterManager
+	globalClusterManager = m
+	defer func() { globalClusterManager = oldManager }()
+	rec := httptest.NewRecorder()
+	handleListMetas(rec, httptest.NewRequest(http.MethodGet, "/metas", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"meta_addrs":"127.0.0.1:34601,127.0.0.1:34602"`)
+	assert.Contains(t, rec.Body.String(), `"status":"up"`)
+}
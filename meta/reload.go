@@ -0,0 +1,71 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"reflect"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/sirupsen/logrus"
+)
+
+// reloadConfig is the config subscriber which applies the reloaded options to the cluster manager.
+func (m *ClusterManager) reloadConfig(old *config.Configuration, cfg *config.Configuration) {
+	if capacity := cfg.ZookeeperOpts.WatcherCount; capacity != old.ZookeeperOpts.WatcherCount {
+		m.resizeTables(capacity)
+	}
+
+	zkOpts := cfg.ZookeeperOpts
+	if reflect.DeepEqual(zkOpts.Address, old.ZookeeperOpts.Address) && zkOpts.Timeout == old.ZookeeperOpts.Timeout {
+		return
+	}
+	// the zookeeper options are unused if the routes are stored in others
+	if store, ok := m.Store.(*zkRouteStore); ok {
+		if err := store.reconnect(zkOpts.Address, zkOpts.Timeout); err != nil {
+			logrus.Errorf("failed to reconnect zookeeper, keep the previous connection: %s", err)
+		}
+	}
+}
+
+// resizeTables replaces the table cache by a new one of the capacity. The cached tables are moved into the new
+// cache from the least recently used one, so that the LRU order is kept and the ones beyond the capacity are evicted.
+func (m *ClusterManager) resizeTables(capacity int) {
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	var watchers []*TableInfoWatcher
+	for _, tableInfo := range m.Tables.GetALL(false) {
+		watchers = append(watchers, tableInfo.(*TableInfoWatcher))
+	}
+	sort.Slice(watchers, func(i, j int) bool {
+		return atomic.LoadInt64(&watchers[i].lastUsed) < atomic.LoadInt64(&watchers[j].lastUsed)
+	})
+	tables := newTableCache(capacity)
+	for _, watcher := range watchers {
+		if err := tables.Set(watcher.tableName, watcher); err != nil {
+			watcher.ctx.cancel()
+			logrus.Errorf("[%s] failed to move cluster info into the resized cache: %s", watcher.tableName, err)
+		}
+	}
+	logrus.Infof("table cache is resized to %d, %d of %d tables are kept", capacity, tables.Len(false),
+		m.Tables.Len(false))
+	m.Tables = tables
+}
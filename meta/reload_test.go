@@ -0,0 +1,68 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadTableCapacity(t *testing.T) {
+	m, _ := newTestFileClusterManager(t, testRouteFile)
+	for _, table := range []string{"temp", "stat"} {
+		_, err := m.getMetaAddrs(context.Background(), table)
+		assert.Nil(t, err)
+	}
+	temp, _ := m.Tables.Get("temp")
+	stat, _ := m.Tables.Get("stat")
+
+	// the cached tables are kept if the capacity is enlarged
+	old := &config.Configuration{}
+	old.ZookeeperOpts.WatcherCount = 10
+	cfg := &config.Configuration{}
+	cfg.ZookeeperOpts.WatcherCount = 20
+	m.reloadConfig(old, cfg)
+	assert.Equal(t, 2, m.tableCache().Len(false))
+	cached, err := m.tableCache().Get("temp")
+	assert.Nil(t, err)
+	assert.Equal(t, temp, cached)
+
+	// the least recently used tables beyond the capacity are evicted and their watchers are stopped
+	time.Sleep(time.Millisecond)
+	_, err = m.getMetaAddrs(context.Background(), "temp")
+	assert.Nil(t, err)
+	old, cfg = cfg, &config.Configuration{}
+	cfg.ZookeeperOpts.WatcherCount = 1
+	m.reloadConfig(old, cfg)
+	assert.Equal(t, 1, m.tableCache().Len(false))
+	assert.True(t, m.tableCache().Has("temp"))
+	assert.NotNil(t, stat.(*TableInfoWatcher).ctx.ctx.Err())
+	assert.Nil(t, temp.(*TableInfoWatcher).ctx.ctx.Err())
+
+	_, err = m.getMetaAddrs(context.Background(), "temp")
+	assert.Nil(t, err)
+	_, err = m.getMetaAddrs(context.Background(), "stat")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, m.tableCache().Len(false))
+}
@@ -0,0 +1,203 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/sirupsen/logrus"
+)
+
+// ClusterInfo is the cluster where a table locates. The MetaAddrs is empty if the table only references the
+// cluster by name, and the meta servers are defined by the cluster record (see ClusterStore).
+type ClusterInfo struct {
+	Name      string `json:"cluster_name" yaml:"cluster_name"`
+	MetaAddrs string `json:"meta_addrs,omitempty" yaml:"meta_addrs"`
+	// Backup is the cluster the table is switched to once the primary cluster is unhealthy, nil if not set.
+	Backup *ClusterInfo `json:"backup,omitempty" yaml:"backup"`
+}
+
+func parseClusterInfo(value []byte) (*ClusterInfo, error) {
+	var cluster = &ClusterInfo{}
+	if err := json.Unmarshal(value, cluster); err != nil {
+		return nil, err
+	}
+	if err := cluster.validate(); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+func (c *ClusterInfo) validate() error {
+	if c.Name == "" && c.MetaAddrs == "" {
+		return fmt.Errorf("neither cluster_name nor meta_addrs is set")
+	}
+	if c.Backup != nil {
+		if c.Backup.Backup != nil {
+			return fmt.Errorf("backup of the backup cluster is not supported")
+		}
+		if err := c.Backup.validate(); err != nil {
+			return fmt.Errorf("backup is invalid: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *ClusterInfo) equal(other *ClusterInfo) bool {
+	if c.Name != other.Name || c.MetaAddrs != other.MetaAddrs {
+		return false
+	}
+	if c.Backup == nil || other.Backup == nil {
+		return c.Backup == other.Backup
+	}
+	return c.Backup.equal(other.Backup)
+}
+
+// clusterRecord is the record of a cluster shared by tables, it's either the meta servers of the cluster
+// or an alias of another cluster.
+type clusterRecord struct {
+	MetaAddrs string `json:"meta_addrs,omitempty" yaml:"meta_addrs"`
+	Alias     string `json:"alias,omitempty" yaml:"alias"`
+}
+
+func parseClusterRecord(value []byte) (*clusterRecord, error) {
+	var record = &clusterRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, err
+	}
+	if err := record.validate(); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (r *clusterRecord) validate() error {
+	if (r.MetaAddrs == "") == (r.Alias == "") {
+		return fmt.Errorf("exactly one of meta_addrs and alias should be set")
+	}
+	return nil
+}
+
+// maxClusterAliasDepth limits the length of the alias chain, which also breaks the alias loop.
+const maxClusterAliasDepth = 8
+
+// resolveCluster follows the alias chain from the cluster, returns the meta servers and the clusters on the chain.
+// base.ERR_INVALID_DATA is returned if the chain is too long or loops.
+func resolveCluster(name string, get func(name string) (*clusterRecord, error)) (string, []string, error) {
+	var chain []string
+	for len(chain) < maxClusterAliasDepth {
+		chain = append(chain, name)
+		record, err := get(name)
+		if err != nil {
+			return "", chain, err
+		}
+		if record.Alias == "" {
+			return record.MetaAddrs, chain, nil
+		}
+		name = record.Alias
+	}
+	logrus.Errorf("[%s] alias chain of cluster is too long or loops: %s", chain[0], chain)
+	return "", chain, base.ERR_INVALID_DATA
+}
+
+// RouteEventType is the type of the change on a watched table route.
+type RouteEventType int
+
+const (
+	// RouteChanged means the cluster of the table is changed.
+	RouteChanged RouteEventType = iota
+	// RouteDeleted means the table route is removed.
+	RouteDeleted
+	// RouteWatchLost means the watch is no longer valid (e.g. zookeeper session expired), the table route
+	// should be watched again.
+	RouteWatchLost
+)
+
+func (t RouteEventType) String() string {
+	switch t {
+	case RouteChanged:
+		return "RouteChanged"
+	case RouteDeleted:
+		return "RouteDeleted"
+	case RouteWatchLost:
+		return "RouteWatchLost"
+	}
+	return fmt.Sprintf("RouteEventType(%d)", int(t))
+}
+
+// RouteEvent notifies the change on a watched table route.
+type RouteEvent struct {
+	Type RouteEventType
+	Err  error
+}
+
+// RouteStore stores the table routes, which map the table to the cluster where it locates.
+// The errors returned are base.DsnErrCode, base.ERR_OBJECT_NOT_FOUND is returned if the table doesn't exist.
+type RouteStore interface {
+	// Get returns the cluster of the table.
+	Get(table string) (*ClusterInfo, error)
+
+	// Watch returns the cluster of the table, and a channel which receives only one event when the route of
+	// the table is changed. The table must be watched again after the event to receive the further changes.
+	// The watch is released once ctx is done.
+	Watch(ctx context.Context, table string) (*ClusterInfo, <-chan RouteEvent, error)
+
+	// List returns the clusters of all the tables, table->ClusterInfo.
+	List() (map[string]*ClusterInfo, error)
+
+	// WatchList is like List, and also returns a channel which receives only one event when any table is
+	// added or removed. The watch is released once ctx is done.
+	WatchList(ctx context.Context) (map[string]*ClusterInfo, <-chan RouteEvent, error)
+
+	// Ping checks whether the store is available, it's much cheaper than List.
+	Ping() error
+
+	// Close releases the resources of the store.
+	Close()
+}
+
+// ClusterStore is implemented by the RouteStore which supports the tables referencing the shared cluster
+// records by cluster name.
+type ClusterStore interface {
+	// WatchCluster returns the meta servers of the cluster, the aliases are followed. The returned channel
+	// receives the event when the cluster or any alias on the chain is changed, the cluster must be watched
+	// again after the first event. The watch is released once ctx is done.
+	WatchCluster(ctx context.Context, cluster string) (string, <-chan RouteEvent, error)
+}
+
+// newRouteStore creates the RouteStore according to the route type of config.
+func newRouteStore() (RouteStore, error) {
+	routeType := config.GlobalConfig.RouteOpts.Type
+	switch routeType {
+	case "zookeeper":
+		return newZkRouteStore(config.GlobalConfig.ZookeeperOpts.Address, config.GlobalConfig.ZookeeperOpts.Root,
+			config.GlobalConfig.ZookeeperOpts.Timeout)
+	case "etcd":
+		return newEtcdRouteStore(config.GlobalConfig.EtcdOpts.Endpoints, config.GlobalConfig.EtcdOpts.Root,
+			config.GlobalConfig.EtcdOpts.Timeout)
+	case "file":
+		return newFileRouteStore(config.GlobalConfig.RouteOpts.File)
+	}
+	return nil, fmt.Errorf("unsupported route type \"%s\"", routeType)
+}
@@ -30,11 +30,8 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func init() {
-	Init()
-}
-
 func TestQueryConfig(t *testing.T) {
+	setupZookeeper(t)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
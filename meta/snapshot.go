@@ -0,0 +1,256 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// routeSnapshotVersion is the version of the snapshot format, it must be increased once the format is changed.
+const routeSnapshotVersion = 1
+
+// routeSnapshot is the content of the snapshot file.
+type routeSnapshot struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Checksum is the crc32 of Tables
+	Checksum uint32 `json:"checksum"`
+	// Tables is table->ClusterInfo in json
+	Tables json.RawMessage `json:"tables"`
+}
+
+// writeRouteSnapshot writes the table routes into the file. The file is replaced by renaming so that it's never
+// partially written.
+func writeRouteSnapshot(path string, tables map[string]*ClusterInfo) error {
+	data, err := json.Marshal(tables)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(&routeSnapshot{
+		Version:  routeSnapshotVersion,
+		Time:     time.Now(),
+		Checksum: crc32.ChecksumIEEE(data),
+		Tables:   data,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op if it has been renamed
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readRouteSnapshot reads the table routes and the time when they're written from the file.
+func readRouteSnapshot(path string) (map[string]*ClusterInfo, time.Time, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var snapshot routeSnapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, time.Time{}, fmt.Errorf("snapshot \"%s\" is corrupt: %s", path, err)
+	}
+	if snapshot.Version != routeSnapshotVersion {
+		return nil, time.Time{}, fmt.Errorf("snapshot \"%s\" version %d is unsupported", path, snapshot.Version)
+	}
+	if checksum := crc32.ChecksumIEEE(snapshot.Tables); checksum != snapshot.Checksum {
+		return nil, time.Time{}, fmt.Errorf("snapshot \"%s\" checksum mismatch: expect %d, actual %d",
+			path, snapshot.Checksum, checksum)
+	}
+	var tables map[string]*ClusterInfo
+	if err := json.Unmarshal(snapshot.Tables, &tables); err != nil {
+		return nil, time.Time{}, fmt.Errorf("snapshot \"%s\" is corrupt: %s", path, err)
+	}
+	return tables, snapshot.Time, nil
+}
+
+// startSnapshot writes the snapshot of the cached table routes periodically. If the route store is unavailable
+// at start, the cluster manager boots from the snapshot in degraded mode: only the tables in the snapshot are
+// served and the snapshot is no longer written, until the route store becomes available.
+func (m *ClusterManager) startSnapshot(ctx context.Context, path string, interval time.Duration) {
+	m.snapshotFile = path
+	if err := m.Store.Ping(); err == nil {
+		// the previous snapshot is kept in the ones written later, see writeSnapshot
+		if tables, _, err := readRouteSnapshot(path); err == nil {
+			m.Mut.Lock()
+			m.snapshotTables = tables
+			m.Mut.Unlock()
+		}
+	} else {
+		events, err := m.loadSnapshot()
+		if err != nil {
+			logrus.Errorf("route store is unavailable, and failed to load route snapshot: %s", err)
+		} else {
+			atomic.StoreInt32(&m.degraded, 1)
+			atomic.StoreInt32(&m.ready, 1)
+			logrus.Warnf("route store is unavailable, boot from snapshot \"%s\" with %d tables in degraded mode",
+				path, len(events))
+			go m.recoverFromSnapshot(ctx, events)
+		}
+	}
+	go m.snapshotLoop(ctx, interval)
+}
+
+func (m *ClusterManager) snapshotLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if m.isDegraded() {
+				continue
+			}
+			if err := m.writeSnapshot(); err != nil {
+				logrus.Errorf("failed to write route snapshot: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeSnapshot writes the table routes into the snapshot file. Since the cache only has the tables requested
+// recently, the tables in the previous snapshot which are not cached are kept, unless they're found deleted from
+// the route store. Otherwise a restarted proxy would replace a good snapshot by an almost empty one.
+func (m *ClusterManager) writeSnapshot() error {
+	m.Mut.Lock()
+	tables := make(map[string]*ClusterInfo, len(m.snapshotTables))
+	for table, cluster := range m.snapshotTables {
+		tables[table] = cluster
+	}
+	for _, value := range m.Tables.GetALL(false) {
+		watcher := value.(*TableInfoWatcher)
+		cluster := &ClusterInfo{Name: watcher.clusterName, MetaAddrs: watcher.getMetaAddrs()}
+		if backup := watcher.backup; backup != nil {
+			cluster.Backup = &ClusterInfo{Name: backup.clusterName, MetaAddrs: backup.getMetaAddrs()}
+		}
+		tables[watcher.tableName] = cluster
+	}
+	// the tables removed later are deleted from snapshotTables, so it must not share the map being written
+	m.snapshotTables = make(map[string]*ClusterInfo, len(tables))
+	for table, cluster := range tables {
+		m.snapshotTables[table] = cluster
+	}
+	m.Mut.Unlock()
+
+	if len(tables) == 0 {
+		logrus.Debugf("no table is cached, skip writing route snapshot \"%s\"", m.snapshotFile)
+		return nil
+	}
+	if err := writeRouteSnapshot(m.snapshotFile, tables); err != nil {
+		return err
+	}
+	logrus.Debugf("route snapshot \"%s\" is written with %d tables", m.snapshotFile, len(tables))
+	return nil
+}
+
+// loadSnapshot loads the table routes from the snapshot file into local cache. The loaded tables are marked as
+// stale, and they are watched once the returned channels receive the event.
+func (m *ClusterManager) loadSnapshot() ([]chan RouteEvent, error) {
+	tables, snapshotTime, err := readRouteSnapshot(m.snapshotFile)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	var allEvents []chan RouteEvent
+	for table, cluster := range tables {
+		events := make(chan RouteEvent, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		tableInfo := &TableInfoWatcher{
+			tableName:   table,
+			clusterName: cluster.Name,
+			metaAddrs:   cluster.MetaAddrs,
+			event:       events,
+			ctx: zkContext{
+				ctx:    ctx,
+				cancel: cancel,
+			},
+			staleSince: snapshotTime.UnixNano(),
+			metaRefs:   make(map[string]bool),
+		}
+		if backup := cluster.Backup; backup != nil {
+			tableInfo.backup = &backupCluster{clusterName: backup.Name, metaAddrs: backup.MetaAddrs}
+		}
+		if err := m.Tables.Set(table, tableInfo); err != nil {
+			cancel()
+			return nil, err
+		}
+		go m.watchTableInfoChanged(tableInfo)
+		allEvents = append(allEvents, events)
+	}
+	return allEvents, nil
+}
+
+// recoverFromSnapshot waits for the route store to be available, then watches the tables loaded from snapshot.
+func (m *ClusterManager) recoverFromSnapshot(ctx context.Context, events []chan RouteEvent) {
+	backoff := minRewatchBackoff
+	for {
+		if err := m.Store.Ping(); err == nil {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxRewatchBackoff {
+			backoff = maxRewatchBackoff
+		}
+	}
+
+	// the tables are refreshed from the route store and watched by watchTableInfoChanged
+	for _, ch := range events {
+		ch <- RouteEvent{Type: RouteWatchLost, Err: fmt.Errorf("route store is recovered")}
+	}
+	atomic.StoreInt32(&m.degraded, 0)
+	logrus.Infof("route store is recovered, leave degraded mode")
+}
+
+func (m *ClusterManager) isDegraded() bool {
+	return atomic.LoadInt32(&m.degraded) == 1
+}
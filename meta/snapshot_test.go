@@ -0,0 +1,193 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "routes.snapshot")
+
+	_, _, err := readRouteSnapshot(path)
+	assert.NotNil(t, err)
+
+	tables := map[string]*ClusterInfo{
+		"temp": {Name: "onebox", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"},
+		"stat": {Name: "onebox2", MetaAddrs: "127.0.1.1:34601,127.0.1.1:34602"},
+	}
+	assert.Nil(t, writeRouteSnapshot(path, tables))
+	readTables, snapshotTime, err := readRouteSnapshot(path)
+	assert.Nil(t, err)
+	assert.Equal(t, tables, readTables)
+	assert.WithinDuration(t, time.Now(), snapshotTime, time.Minute)
+	// the temporary file is renamed
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(files))
+
+	content, _ := ioutil.ReadFile(path)
+	var snapshot routeSnapshot
+	assert.Nil(t, json.Unmarshal(content, &snapshot))
+
+	corrupt := snapshot
+	corrupt.Tables = json.RawMessage(`{"temp":{"cluster_name":"onebox","meta_addrs":"127.0.0.1:1,127.0.0.1:2"}}`)
+	content, _ = json.Marshal(&corrupt)
+	assert.Nil(t, ioutil.WriteFile(path, content, 0644))
+	_, _, err = readRouteSnapshot(path)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+
+	unsupported := snapshot
+	unsupported.Version = routeSnapshotVersion + 1
+	content, _ = json.Marshal(&unsupported)
+	assert.Nil(t, ioutil.WriteFile(path, content, 0644))
+	_, _, err = readRouteSnapshot(path)
+	assert.Contains(t, err.Error(), "unsupported")
+
+	assert.Nil(t, ioutil.WriteFile(path, content[:len(content)/2], 0644))
+	_, _, err = readRouteSnapshot(path)
+	assert.Contains(t, err.Error(), "corrupt")
+}
+
+// unavailableRouteStore fails all the requests until it's available.
+type unavailableRouteStore struct {
+	RouteStore
+	available int32
+}
+
+func (s *unavailableRouteStore) isAvailable() bool {
+	return atomic.LoadInt32(&s.available) == 1
+}
+
+func (s *unavailableRouteStore) Get(table string) (*ClusterInfo, error) {
+	if !s.isAvailable() {
+		return nil, base.ERR_ZOOKEEPER_OPERATION
+	}
+	return s.RouteStore.Get(table)
+}
+
+func (s *unavailableRouteStore) Watch(ctx context.Context, table string) (*ClusterInfo, <-chan RouteEvent, error) {
+	if !s.isAvailable() {
+		return nil, nil, base.ERR_ZOOKEEPER_OPERATION
+	}
+	return s.RouteStore.Watch(ctx, table)
+}
+
+func (s *unavailableRouteStore) Ping() error {
+	if !s.isAvailable() {
+		return base.ERR_ZOOKEEPER_OPERATION
+	}
+	return s.RouteStore.Ping()
+}
+
+func (s *unavailableRouteStore) List() (map[string]*ClusterInfo, error) {
+	if !s.isAvailable() {
+		return nil, base.ERR_ZOOKEEPER_OPERATION
+	}
+	return s.RouteStore.List()
+}
+
+func TestClusterManagerBootFromSnapshot(t *testing.T) {
+	routePath := newTestRouteFile(t, testRouteFileUpdated)
+	snapshotPath := filepath.Join(filepath.Dir(routePath), "routes.snapshot")
+	assert.Nil(t, writeRouteSnapshot(snapshotPath, map[string]*ClusterInfo{
+		"temp": {Name: "onebox", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"},
+		"stat": {Name: "onebox", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"},
+	}))
+
+	fileStore, err := newFileRouteStore(routePath)
+	assert.Nil(t, err)
+	store := &unavailableRouteStore{RouteStore: fileStore}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := newTestClusterManager(store)
+	m.cancel = cancel
+	defer m.close()
+
+	// the tables in snapshot are served in degraded mode
+	m.startSnapshot(ctx, snapshotPath, 10*time.Millisecond)
+	assert.True(t, m.isDegraded())
+	assert.True(t, m.isReady())
+	addrs, err := m.getMetaAddrs(context.Background(), "temp")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:34601,127.0.0.1:34602", addrs)
+	_, err = m.getMetaAddrs(context.Background(), "new")
+	assert.Equal(t, base.ERR_ZOOKEEPER_OPERATION, err)
+	tables := m.listTableInfos()
+	assert.Equal(t, 2, len(tables))
+	assert.NotNil(t, tables[0].StaleSince)
+	// the snapshot is not overwritten in degraded mode
+	time.Sleep(50 * time.Millisecond)
+	snapshotTables, _, err := readRouteSnapshot(snapshotPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(snapshotTables))
+
+	// the tables are refreshed once the route store is recovered
+	atomic.StoreInt32(&store.available, 1)
+	assert.Eventually(t, func() bool {
+		return !m.isDegraded() && !m.Tables.Has("stat")
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		tables := m.listTableInfos()
+		return len(tables) == 1 && tables[0].StaleSince == nil && tables[0].MetaAddrs == "127.0.1.1:34601,127.0.1.1:34602"
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		snapshotTables, _, err := readRouteSnapshot(snapshotPath)
+		return err == nil && len(snapshotTables) == 1
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestClusterManagerKeepUncachedTablesInSnapshot(t *testing.T) {
+	m, routePath := newTestFileClusterManager(t, testRouteFileUpdated)
+	snapshotPath := filepath.Join(filepath.Dir(routePath), "routes.snapshot")
+
+	// nothing is written by a cold proxy without snapshot
+	m.snapshotFile = snapshotPath
+	assert.Nil(t, m.writeSnapshot())
+	_, _, err := readRouteSnapshot(snapshotPath)
+	assert.NotNil(t, err)
+
+	// the restarted proxy keeps the tables of the previous snapshot which are not cached yet
+	assert.Nil(t, writeRouteSnapshot(snapshotPath, map[string]*ClusterInfo{
+		"temp": {Name: "onebox", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"},
+		"stat": {Name: "onebox", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"},
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.startSnapshot(ctx, snapshotPath, time.Hour)
+	assert.False(t, m.isDegraded())
+	_, err = m.getMetaAddrs(context.Background(), "temp")
+	assert.Nil(t, err)
+	assert.Nil(t, m.writeSnapshot())
+	snapshotTables, _, err := readRouteSnapshot(snapshotPath)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]*ClusterInfo{
+		"temp": {Name: "onebox2", MetaAddrs: "127.0.1.1:34601,127.0.1.1:34602"},
+		"stat": {Name: "onebox", MetaAddrs: "127.0.0.1:34601,127.0.0.1:34602"},
+	}, snapshotTables)
+}
@@ -0,0 +1,182 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/pegasus-kv/meta-proxy/admin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tableWatching = "watching"
+	tableStale    = "stale"
+)
+
+// TableInfo is the cached cluster info of a table.
+type TableInfo struct {
+	Table       string `json:"table"`
+	ClusterName string `json:"cluster_name"`
+	MetaAddrs   string `json:"meta_addrs"`
+	// State is "watching" if the route is watched, or "stale" if it can't be refreshed from route store.
+	State string `json:"state"`
+	// StaleSince is the time since when the cluster info can't be refreshed from route store, nil if it's up to date.
+	StaleSince *time.Time `json:"stale_since,omitempty"`
+	// SharedCluster is true if the meta servers are resolved from the shared cluster record.
+	SharedCluster   bool   `json:"shared_cluster"`
+	BackupCluster   string `json:"backup_cluster,omitempty"`
+	BackupMetaAddrs string `json:"backup_meta_addrs,omitempty"`
+	// Active is the cluster the table is routed to, "primary" or "backup", empty if the table has no backup.
+	Active string `json:"active,omitempty"`
+}
+
+func (m *ClusterManager) tableInfoOf(watcher *TableInfoWatcher) TableInfo {
+	info := TableInfo{
+		Table:         watcher.tableName,
+		ClusterName:   watcher.clusterName,
+		MetaAddrs:     watcher.getMetaAddrs(),
+		State:         tableWatching,
+		SharedCluster: watcher.cluster != nil,
+	}
+	if staleSince := watcher.staleTime(); !staleSince.IsZero() {
+		info.State = tableStale
+		info.StaleSince = &staleSince
+	}
+	if backup := watcher.backup; backup != nil {
+		info.BackupCluster = backup.clusterName
+		info.BackupMetaAddrs = backup.getMetaAddrs()
+		info.Active = m.failover.target(watcher)
+	}
+	return info
+}
+
+// listTableInfos returns the cluster info of all the cached tables sorted by table name.
+func (m *ClusterManager) listTableInfos() []TableInfo {
+	tables := m.tableCache().GetALL(false)
+	result := make([]TableInfo, 0, len(tables))
+	for _, value := range tables {
+		result = append(result, m.tableInfoOf(value.(*TableInfoWatcher)))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Table < result[j].Table
+	})
+	return result
+}
+
+// refreshTable reads the route of the table from route store and replaces the cached one, the table is removed
+// from local cache if it no longer exists.
+func (m *ClusterManager) refreshTable(table string) (*TableInfoWatcher, error) {
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	old, _ := m.Tables.Get(table)
+	tableInfo, err := m.newTableInfo(context.Background(), table)
+	if err != nil {
+		if err == base.ERR_OBJECT_NOT_FOUND && old != nil {
+			m.Tables.Remove(table)
+			delete(m.snapshotTables, table)
+			logrus.Infof("[%s] local cache cluster info is removed by refreshing", table)
+		}
+		return nil, err
+	}
+	if err := m.Tables.Set(table, tableInfo); err != nil {
+		tableInfo.ctx.cancel()
+		return nil, err
+	}
+	// the old watcher is released after the new one is watched, so that the shared clusters are kept watched
+	if old != nil {
+		watcher := old.(*TableInfoWatcher)
+		m.inheritMetaRefsLocked(watcher, tableInfo)
+		watcher.ctx.cancel()
+		globalConfigCache.invalidateTable(watcher)
+	}
+	logrus.Infof("[%s] local cache cluster info is refreshed to %s(%s)", table, tableInfo.clusterName,
+		tableInfo.getMetaAddrs())
+	return tableInfo, nil
+}
+
+// evictTable removes the table from local cache, it returns false if the table is not cached.
+func (m *ClusterManager) evictTable(table string) bool {
+	m.Mut.Lock()
+	defer m.Mut.Unlock()
+	if !m.Tables.Remove(table) {
+		return false
+	}
+	logrus.Infof("[%s] local cache cluster info is evicted manually", table)
+	return true
+}
+
+// parseAdminTableRequest checks the admin request which updates a table, e.g. POST /tables/evict?table=t.
+func parseAdminTableRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		admin.RenderError(w, http.StatusMethodNotAllowed, "POST is required")
+		return "", false
+	}
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		admin.RenderError(w, http.StatusBadRequest, "table is required")
+		return "", false
+	}
+	return table, true
+}
+
+// handleListTables is the admin handler to show the cached tables.
+func handleListTables(w http.ResponseWriter, r *http.Request) {
+	tables := globalClusterManager.listTableInfos()
+	admin.RenderJSON(w, map[string]interface{}{
+		"count":  len(tables),
+		"tables": tables,
+	})
+}
+
+// handleRefreshTable is the admin handler to refresh the route of a table, e.g. POST /tables/refresh?table=t.
+func handleRefreshTable(w http.ResponseWriter, r *http.Request) {
+	table, ok := parseAdminTableRequest(w, r)
+	if !ok {
+		return
+	}
+	tableInfo, err := globalClusterManager.refreshTable(table)
+	if err == base.ERR_OBJECT_NOT_FOUND {
+		admin.RenderError(w, http.StatusNotFound, "table \"%s\" doesn't exist", table)
+		return
+	}
+	if err != nil {
+		admin.RenderError(w, http.StatusServiceUnavailable, "failed to refresh table \"%s\": %s", table, err)
+		return
+	}
+	admin.RenderJSON(w, globalClusterManager.tableInfoOf(tableInfo))
+}
+
+// handleEvictTable is the admin handler to evict a table from local cache, e.g. POST /tables/evict?table=t.
+func handleEvictTable(w http.ResponseWriter, r *http.Request) {
+	table, ok := parseAdminTableRequest(w, r)
+	if !ok {
+		return
+	}
+	if !globalClusterManager.evictTable(table) {
+		admin.RenderError(w, http.StatusNotFound, "table \"%s\" is not cached", table)
+		return
+	}
+	admin.RenderJSON(w, map[string]string{"evicted": table})
+}
@@ -0,0 +1,133 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTableAdminRouteFile = `
+tables:
+  temp:
+    cluster_name: onebox
+    meta_addrs: 127.0.0.1:34601,127.0.0.1:34602
+  stat:
+    cluster_name: onebox
+    backup:
+      cluster_name: onebox_backup
+clusters:
+  onebox:
+    meta_addrs: 127.0.0.1:34601,127.0.0.1:34602
+  onebox_backup:
+    meta_addrs: 127.0.1.1:34601,127.0.1.1:34602
+`
+
+func TestTableAdmin(t *testing.T) {
+	m, _ := newTestFileClusterManager(t, testTableAdminRouteFile)
+	m.failover = newFailover()
+	oldManager := globalClusterManager
+	globalClusterManager = m
+	defer func() { globalClusterManager = oldManager }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tables", handleListTables)
+	mux.HandleFunc("/tables/refresh", handleRefreshTable)
+	mux.HandleFunc("/tables/evict", handleEvictTable)
+	mux.HandleFunc("/metas", handleListMetas)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request := func(method string, url string, v interface{}) int {
+		req, err := http.NewRequest(method, server.URL+url, nil)
+		assert.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		if v != nil {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+	type tableList struct {
+		Count  int         `json:"count"`
+		Tables []TableInfo `json:"tables"`
+	}
+
+	var tables tableList
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/tables", &tables))
+	assert.Equal(t, 0, tables.Count)
+
+	// the table is loaded by refreshing
+	var info TableInfo
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/tables/refresh?table=stat", &info))
+	assert.Equal(t, TableInfo{
+		Table:           "stat",
+		ClusterName:     "onebox",
+		MetaAddrs:       "127.0.0.1:34601,127.0.0.1:34602",
+		State:           tableWatching,
+		SharedCluster:   true,
+		BackupCluster:   "onebox_backup",
+		BackupMetaAddrs: "127.0.1.1:34601,127.0.1.1:34602",
+		Active:          failoverPrimary,
+	}, info)
+	for _, table := range []string{"stat", "temp"} {
+		_, err := m.getMetaAddrs(context.Background(), table)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/tables", &tables))
+	assert.Equal(t, 2, tables.Count)
+	assert.Equal(t, "stat", tables.Tables[0].Table)
+	assert.Equal(t, "temp", tables.Tables[1].Table)
+	assert.False(t, tables.Tables[1].SharedCluster)
+
+	// refreshing replaces the cached watcher, and the shared cluster and meta manager are kept
+	old, _ := m.Tables.Get("stat")
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/tables/refresh?table=stat", nil))
+	cached, _ := m.Tables.Get("stat")
+	assert.NotEqual(t, old, cached)
+	assert.NotNil(t, old.(*TableInfoWatcher).ctx.ctx.Err())
+	m.clusterMut.Lock()
+	assert.Equal(t, 1, m.clusters["onebox"].refs)
+	m.clusterMut.Unlock()
+
+	var metas struct {
+		Count int        `json:"count"`
+		Metas []MetaInfo `json:"metas"`
+	}
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/metas", &metas))
+	assert.Equal(t, 1, metas.Count)
+	assert.Equal(t, int32(2), metas.Metas[0].Refs)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/tables/evict?table=temp", nil))
+	assert.False(t, m.Tables.Has("temp"))
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/tables/evict?table=temp", nil))
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/tables/refresh?table=notExist", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodGet, "/tables/evict?table=stat", nil))
+	var errResp map[string]string
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/tables/refresh", &errResp))
+	assert.Equal(t, "table is required", errResp["error"])
+}
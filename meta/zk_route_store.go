@@ -0,0 +1,301 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/go-zookeeper/zk"
+	"github.com/sirupsen/logrus"
+)
+
+// zkClustersNode is the child of the root which holds the cluster records rather than a table.
+const zkClustersNode = "clusters"
+
+// zkRouteStore is the RouteStore based on zookeeper.
+// The zookeeper path layout:
+// /<RegionPathRoot>/<table> =>
+//                         {
+//                           "cluster_name" : "clusterName",
+//                           "meta_addrs" : "metaAddr1,metaAddr2,metaAddr3"
+//                         }
+// The table can also have an optional "backup" cluster in the same format, see failover.
+// The "meta_addrs" of the table can be omitted, then the table references the cluster record:
+// /<RegionPathRoot>/clusters/<clusterName> =>
+//                         {
+//                           "meta_addrs" : "metaAddr1,metaAddr2,metaAddr3"
+//                         }
+// or the cluster is an alias of another cluster:
+// /<RegionPathRoot>/clusters/<clusterName> =>
+//                         {
+//                           "alias" : "otherClusterName"
+//                         }
+type zkRouteStore struct {
+	// mu guards conn and addrs, which are replaced once the zookeeper servers are changed by reloading the config
+	mu    sync.RWMutex
+	conn  *zk.Conn
+	addrs []string
+	root  string
+}
+
+// newZkRouteStore connects to zookeeper, the unit of timeout is ms.
+func newZkRouteStore(addrs []string, root string, timeout int) (*zkRouteStore, error) {
+	conn, _, err := zk.Connect(addrs, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to zookeeper \"%s\": %s", addrs, err)
+	}
+	return &zkRouteStore{
+		conn:  conn,
+		addrs: addrs,
+		root:  root,
+	}, nil
+}
+
+func (s *zkRouteStore) Get(table string) (*ClusterInfo, error) {
+	path := s.tablePath(table)
+	value, _, err := s.getConn().Get(path)
+	if err != nil {
+		return nil, s.convertError(table, path, err)
+	}
+	cluster, err := s.parseValue(table, path, value)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.MetaAddrs == "" {
+		if cluster.MetaAddrs, _, err = resolveCluster(cluster.Name, s.getCluster); err != nil {
+			return nil, err
+		}
+	}
+	return cluster, nil
+}
+
+func (s *zkRouteStore) Watch(ctx context.Context, table string) (*ClusterInfo, <-chan RouteEvent, error) {
+	path := s.tablePath(table)
+	value, _, zkEvents, err := s.getConn().GetW(path)
+	if err != nil {
+		return nil, nil, s.convertError(table, path, err)
+	}
+	cluster, err := s.parseValue(table, path, value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events := make(chan RouteEvent, 1)
+	go forwardZkEvent(ctx, zkEvents, events)
+	return cluster, events, nil
+}
+
+func (s *zkRouteStore) List() (map[string]*ClusterInfo, error) {
+	tables, _, err := s.getConn().Children(s.root)
+	if err != nil {
+		logrus.Errorf("failed to list tables from zk[%s(%s)]: %s", s.getAddrs(), s.root, err)
+		return nil, base.ERR_ZOOKEEPER_OPERATION
+	}
+	return s.getTables(tables)
+}
+
+func (s *zkRouteStore) WatchList(ctx context.Context) (map[string]*ClusterInfo, <-chan RouteEvent, error) {
+	tables, _, zkEvents, err := s.getConn().ChildrenW(s.root)
+	if err != nil {
+		logrus.Errorf("failed to list tables from zk[%s(%s)]: %s", s.getAddrs(), s.root, err)
+		return nil, nil, base.ERR_ZOOKEEPER_OPERATION
+	}
+	result, err := s.getTables(tables)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events := make(chan RouteEvent, 1)
+	go forwardZkEvent(ctx, zkEvents, events)
+	return result, events, nil
+}
+
+func (s *zkRouteStore) WatchCluster(ctx context.Context, cluster string) (string, <-chan RouteEvent, error) {
+	var zkEvents []<-chan zk.Event
+	metaAddrs, _, err := resolveCluster(cluster, func(name string) (*clusterRecord, error) {
+		path := s.clusterPath(name)
+		value, _, ch, err := s.getConn().GetW(path)
+		if err != nil {
+			return nil, s.convertError(name, path, err)
+		}
+		zkEvents = append(zkEvents, ch)
+		return s.parseCluster(name, path, value)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// every node on the alias chain is watched, the channel is large enough to never block the forwarding
+	events := make(chan RouteEvent, len(zkEvents))
+	for _, ch := range zkEvents {
+		go forwardZkEvent(ctx, ch, events)
+	}
+	return metaAddrs, events, nil
+}
+
+// forwardZkEvent converts the zookeeper watch event to RouteEvent.
+func forwardZkEvent(ctx context.Context, zkEvents <-chan zk.Event, events chan<- RouteEvent) {
+	// the zookeeper watch channel is closed after it's fired, or the connection is closed
+	var event zk.Event
+	select {
+	case event = <-zkEvents:
+	case <-ctx.Done():
+		return
+	}
+	switch event.Type {
+	case zk.EventNodeDataChanged, zk.EventNodeChildrenChanged:
+		events <- RouteEvent{Type: RouteChanged}
+	case zk.EventNodeDeleted:
+		events <- RouteEvent{Type: RouteDeleted}
+	default:
+		events <- RouteEvent{Type: RouteWatchLost, Err: fmt.Errorf("zk event %s: %v", event.Type.String(), event.Err)}
+	}
+}
+
+// getTables reads the cluster info of the tables, the invalid or removed ones are skipped.
+func (s *zkRouteStore) getTables(tables []string) (map[string]*ClusterInfo, error) {
+	result := make(map[string]*ClusterInfo)
+	resolved := make(map[string]string)
+	for _, table := range tables {
+		if table == zkClustersNode {
+			continue
+		}
+		path := s.tablePath(table)
+		value, _, err := s.getConn().Get(path)
+		if err != nil {
+			if err == zk.ErrNoNode {
+				continue // removed after listing
+			}
+			logrus.Errorf("[%s] failed to get cluster info from zk(%s): %s", table, path, err)
+			return nil, base.ERR_ZOOKEEPER_OPERATION
+		}
+		cluster, err := parseClusterInfo(value)
+		if err != nil {
+			logrus.Warnf("[%s] cluster info on zk(%s) format is invalid, err = %s", table, path, err)
+			continue
+		}
+		if cluster.MetaAddrs == "" {
+			metaAddrs, ok := resolved[cluster.Name]
+			if !ok {
+				if metaAddrs, _, err = resolveCluster(cluster.Name, s.getCluster); err != nil {
+					if err == base.ERR_OBJECT_NOT_FOUND || err == base.ERR_INVALID_DATA {
+						logrus.Warnf("[%s] skip the table referencing the unresolvable cluster %s", table, cluster.Name)
+						continue
+					}
+					return nil, err
+				}
+				resolved[cluster.Name] = metaAddrs
+			}
+			cluster.MetaAddrs = metaAddrs
+		}
+		result[table] = cluster
+	}
+	return result, nil
+}
+
+// Ping checks the root node exists on zookeeper.
+func (s *zkRouteStore) Ping() error {
+	if _, _, err := s.getConn().Exists(s.root); err != nil {
+		logrus.Errorf("failed to check the root of zk[%s(%s)]: %s", s.getAddrs(), s.root, err)
+		return base.ERR_ZOOKEEPER_OPERATION
+	}
+	return nil
+}
+
+func (s *zkRouteStore) Close() {
+	s.getConn().Close()
+}
+
+func (s *zkRouteStore) getConn() *zk.Conn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conn
+}
+
+func (s *zkRouteStore) getAddrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.addrs
+}
+
+// reconnect connects to the new zookeeper servers and closes the previous connection. The watches on the previous
+// connection are lost, and they are re-established on the new one by the watchers.
+func (s *zkRouteStore) reconnect(addrs []string, timeout int) error {
+	conn, _, err := zk.Connect(addrs, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("failed to connect to zookeeper \"%s\": %s", addrs, err)
+	}
+	s.mu.Lock()
+	old, oldAddrs := s.conn, s.addrs
+	s.conn, s.addrs = conn, addrs
+	s.mu.Unlock()
+
+	old.Close()
+	logrus.Infof("zookeeper connection is switched from %s to %s", oldAddrs, addrs)
+	return nil
+}
+
+func (s *zkRouteStore) tablePath(table string) string {
+	return fmt.Sprintf("%s/%s", s.root, table)
+}
+
+func (s *zkRouteStore) clusterPath(cluster string) string {
+	return fmt.Sprintf("%s/%s/%s", s.root, zkClustersNode, cluster)
+}
+
+func (s *zkRouteStore) getCluster(name string) (*clusterRecord, error) {
+	path := s.clusterPath(name)
+	value, _, err := s.getConn().Get(path)
+	if err != nil {
+		return nil, s.convertError(name, path, err)
+	}
+	return s.parseCluster(name, path, value)
+}
+
+func (s *zkRouteStore) parseCluster(name string, path string, value []byte) (*clusterRecord, error) {
+	record, err := parseClusterRecord(value)
+	if err != nil {
+		logrus.Errorf("[%s] cluster record on zk[%s(%s)] format is invalid, err = %s", name, s.getAddrs(), path, err)
+		return nil, base.ERR_INVALID_DATA
+	}
+	return record, nil
+}
+
+func (s *zkRouteStore) convertError(table string, path string, err error) error {
+	if err == zk.ErrNoNode {
+		logrus.Errorf("[%s] cluster info doesn't exist on zk[%s(%s)], err: %s", table, s.getAddrs(), path, err)
+		return base.ERR_OBJECT_NOT_FOUND
+	}
+	logrus.Errorf("[%s] failed to get cluster info from zk[%s(%s)]: %s", table, s.getAddrs(), path, err)
+	return base.ERR_ZOOKEEPER_OPERATION
+}
+
+func (s *zkRouteStore) parseValue(table string, path string, value []byte) (*ClusterInfo, error) {
+	cluster, err := parseClusterInfo(value)
+	if err != nil {
+		logrus.Errorf("[%s] cluster info on zk[%s(%s)] format is invalid, err = %s", table, s.getAddrs(), path, err)
+		return nil, base.ERR_INVALID_DATA
+	}
+	return cluster, nil
+}
@@ -20,15 +20,68 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	falcon "github.com/niean/goperfcounter"
 	"github.com/sirupsen/logrus"
 )
 
+// falconSink reports the counters by goperfcounter, which pushes them to falcon agent periodically
+type falconSink struct {
+	// mu guards the gauges from being updated while they're moved to the names with the reloaded tags
+	mu     sync.RWMutex
+	gauges []*falconGauge
+}
+
+func newFalconSink() (Sink, error) {
+	return &falconSink{}, nil
+}
+
+func (s *falconSink) RegisterGauge(counterName string, tagsName []string) Gauge {
+	gauge := registerFalconGauge(counterName, tagsName)
+	gauge.sink = s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gauges = append(s.gauges, gauge)
+	return gauge
+}
+
+func (s *falconSink) RegisterMeter(counterName string, tagsName []string) Meter {
+	return registerFalconMeter(counterName, tagsName)
+}
+
+func (s *falconSink) RegisterHistogram(counterName string, tagsName []string) Histogram {
+	return registerFalconHistogram(counterName, tagsName)
+}
+
+// Start is a no-op, goperfcounter starts pushing once it's imported.
+func (s *falconSink) Start() error {
+	return nil
+}
+
+// Close is a no-op, goperfcounter provides no flush api.
+func (s *falconSink) Close(ctx context.Context) error {
+	return nil
+}
+
+// ReloadTags moves the values of the gauges to the names with the reloaded `metric.tags`, the meters and histograms
+// are reported with the new names on their next updates, since the names are built on each update.
+func (s *falconSink) ReloadTags() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, gauge := range s.gauges {
+		gauge.reloadTags()
+	}
+}
+
 type falconGauge struct {
+	sink        *falconSink
 	counterName string
 	tagsName    []string
+	// names is the custom tag values of the reported names, used to move the values once the tags are reloaded
+	names sync.Map
 }
 
 // Add add value of counter
@@ -38,7 +91,13 @@ func (f *falconGauge) Add(value int64) {
 
 // Add add value of counter with custom tags
 func (f *falconGauge) AddWithTags(tagsValue []string, counterValue int64) {
-	falcon.SetCounterCount(parseToCounterName(f.counterName, f.tagsName, tagsValue), counterValue)
+	f.sink.mu.RLock()
+	defer f.sink.mu.RUnlock()
+	name := parseToCounterName(f.counterName, f.tagsName, tagsValue)
+	if _, ok := f.names.Load(name); !ok {
+		f.names.Store(name, append([]string{}, tagsValue...))
+	}
+	falcon.SetCounterCount(name, counterValue)
 }
 
 // Inc add value of counter, value = 1
@@ -58,7 +117,7 @@ func (f *falconGauge) Sub(value int64) {
 
 // Decrease decrease value of counter with custom tags
 func (f *falconGauge) SubWithTags(tagsValue []string, counterValue int64) {
-	falcon.SetCounterCount(parseToCounterName(f.counterName, f.tagsName, tagsValue), -counterValue)
+	f.AddWithTags(tagsValue, -counterValue)
 }
 
 // Dec decrease value of counter, value = 1
@@ -71,6 +130,24 @@ func (f *falconGauge) DecWithTags(tagsValue []string) {
 	f.SubWithTags(tagsValue, 1)
 }
 
+// reloadTags moves the values to the names with the reloaded tags. goperfcounter can't unregister a counter, so
+// the ones with the previous tags are reset to 0.
+func (f *falconGauge) reloadTags() {
+	f.names.Range(func(key interface{}, value interface{}) bool {
+		name := key.(string)
+		newName := parseToCounterName(f.counterName, f.tagsName, value.([]string))
+		if newName == name {
+			return true
+		}
+		count := falcon.GetCounterCount(name)
+		falcon.SetCounterCount(newName, count)
+		falcon.SetCounterCount(name, -count)
+		f.names.Delete(name)
+		f.names.Store(newName, value)
+		return true
+	})
+}
+
 type falconMeter struct {
 	counterName string
 	tagsName    []string
@@ -86,6 +163,22 @@ func (f *falconMeter) UpdateWithTags(tags []string) {
 	falcon.SetMeterCount(parseToCounterName(f.counterName, f.tagsName, tags), 1)
 }
 
+// falconHistogram reports the percentiles of the values, e.g. 75th, 95th and 99th
+type falconHistogram struct {
+	counterName string
+	tagsName    []string
+}
+
+// Update add the value into histogram
+func (f *falconHistogram) Update(value int64) {
+	f.UpdateWithTags([]string{}, value)
+}
+
+// UpdateWithTags add the value into histogram with custom tags
+func (f *falconHistogram) UpdateWithTags(tagsValue []string, value int64) {
+	falcon.SetHistogramCount(parseToCounterName(f.counterName, f.tagsName, tagsValue), value)
+}
+
 func registerFalconGauge(counterName string, tagsName []string) *falconGauge {
 	return &falconGauge{
 		counterName: counterName,
@@ -100,10 +193,18 @@ func registerFalconMeter(counterName string, tagsName []string) *falconMeter {
 	}
 }
 
+func registerFalconHistogram(counterName string, tagsName []string) *falconHistogram {
+	return &falconHistogram{
+		counterName: counterName,
+		tagsName:    tagsName,
+	}
+}
+
 // transfer counterName registered and tags into final counterName
 func parseToCounterName(counterName string, tagsName []string, tagsValue []string) string {
-	tagsName = combineConfigTagsName(tagsName)
-	tagsValue = combineConfigTagsValue(tagsValue)
+	tags := loadConfigTags()
+	tagsName = tags.combineNames(tagsName)
+	tagsValue = tags.combineValues(tagsValue)
 	if len(tagsName) != len(tagsValue) {
 		logrus.Panicf("[%s] tag's length is invalid: tagsName=%s, tagsValue=%s", counterName, tagsName, tagsValue)
 	}
@@ -0,0 +1,174 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+var memory = newMemorySink()
+
+// MemorySink keeps the counters in memory, it's enabled by the metric type "memory" and mainly used in tests
+// to inspect the reported values.
+type MemorySink struct {
+	mu         sync.Mutex
+	gauges     map[string]int64
+	meters     map[string]int64
+	histograms map[string][]int64
+}
+
+func newMemorySink() *MemorySink {
+	return &MemorySink{
+		gauges:     make(map[string]int64),
+		meters:     make(map[string]int64),
+		histograms: make(map[string][]int64),
+	}
+}
+
+// Memory returns the in-memory sink.
+func Memory() *MemorySink {
+	return memory
+}
+
+func memoryKey(counterName string, tagsValue []string) string {
+	return strings.Join(append([]string{counterName}, tagsValue...), ",")
+}
+
+// Gauge returns the current value of the gauge with the given tags.
+func (s *MemorySink) Gauge(counterName string, tagsValue ...string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gauges[memoryKey(counterName, tagsValue)]
+}
+
+// Meter returns how many times the meter with the given tags is updated.
+func (s *MemorySink) Meter(counterName string, tagsValue ...string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meters[memoryKey(counterName, tagsValue)]
+}
+
+// Histogram returns a copy of the values recorded by the histogram with the given tags.
+func (s *MemorySink) Histogram(counterName string, tagsValue ...string) []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.histograms[memoryKey(counterName, tagsValue)]...)
+}
+
+// Reset clears all the recorded values.
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gauges = make(map[string]int64)
+	s.meters = make(map[string]int64)
+	s.histograms = make(map[string][]int64)
+}
+
+func (s *MemorySink) RegisterGauge(counterName string, tagsName []string) Gauge {
+	return &memoryGauge{sink: s, name: counterName}
+}
+
+func (s *MemorySink) RegisterMeter(counterName string, tagsName []string) Meter {
+	return &memoryMeter{sink: s, name: counterName}
+}
+
+func (s *MemorySink) RegisterHistogram(counterName string, tagsName []string) Histogram {
+	return &memoryHistogram{sink: s, name: counterName}
+}
+
+func (s *MemorySink) Start() error {
+	return nil
+}
+
+func (s *MemorySink) Close(ctx context.Context) error {
+	return nil
+}
+
+type memoryGauge struct {
+	sink *MemorySink
+	name string
+}
+
+func (g *memoryGauge) Add(value int64) {
+	g.AddWithTags([]string{}, value)
+}
+
+func (g *memoryGauge) AddWithTags(tagsValue []string, counterValue int64) {
+	g.sink.mu.Lock()
+	defer g.sink.mu.Unlock()
+	g.sink.gauges[memoryKey(g.name, tagsValue)] += counterValue
+}
+
+func (g *memoryGauge) Inc() {
+	g.IncWithTags([]string{})
+}
+
+func (g *memoryGauge) IncWithTags(tagsValue []string) {
+	g.AddWithTags(tagsValue, 1)
+}
+
+func (g *memoryGauge) Sub(value int64) {
+	g.SubWithTags([]string{}, value)
+}
+
+func (g *memoryGauge) SubWithTags(tagsValue []string, counterValue int64) {
+	g.AddWithTags(tagsValue, -counterValue)
+}
+
+func (g *memoryGauge) Dec() {
+	g.DecWithTags([]string{})
+}
+
+func (g *memoryGauge) DecWithTags(tagsValue []string) {
+	g.SubWithTags(tagsValue, 1)
+}
+
+type memoryMeter struct {
+	sink *MemorySink
+	name string
+}
+
+func (m *memoryMeter) Update() {
+	m.UpdateWithTags([]string{})
+}
+
+func (m *memoryMeter) UpdateWithTags(tagsValue []string) {
+	m.sink.mu.Lock()
+	defer m.sink.mu.Unlock()
+	m.sink.meters[memoryKey(m.name, tagsValue)]++
+}
+
+type memoryHistogram struct {
+	sink *MemorySink
+	name string
+}
+
+func (h *memoryHistogram) Update(value int64) {
+	h.UpdateWithTags([]string{}, value)
+}
+
+func (h *memoryHistogram) UpdateWithTags(tagsValue []string, value int64) {
+	h.sink.mu.Lock()
+	defer h.sink.mu.Unlock()
+	key := memoryKey(h.name, tagsValue)
+	h.sink.histograms[key] = append(h.sink.histograms[key], value)
+}
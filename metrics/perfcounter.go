@@ -20,7 +20,12 @@
 package metrics
 
 import (
+	"context"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pegasus-kv/meta-proxy/config"
 	"github.com/sirupsen/logrus"
@@ -48,16 +53,61 @@ type Meter interface {
 	UpdateWithTags(tagsValue []string)
 }
 
-// Init metric base config
+// Histogram is the generic type for performance counters which sample the distribution of values, for example,
+// used for request latency
+type Histogram interface {
+	Update(value int64)
+	UpdateWithTags(tagsValue []string, value int64)
+}
+
+// Timer is the Histogram of durations, the durations are reported in microseconds
+type Timer interface {
+	Histogram
+
+	UpdateSince(start time.Time)
+	UpdateSinceWithTags(tagsValue []string, start time.Time)
+}
+
+// TagsReloader is implemented by the sinks which bind `metric.tags` to their collectors. ReloadTags is called once
+// the tags are reloaded, the collectors should be rebuilt so that the new tags apply.
+type TagsReloader interface {
+	ReloadTags()
+}
+
+// configTags is the parsed `metric.tags`, the names and values are of the same order.
+type configTags struct {
+	names  []string
+	values []string
+}
+
+var (
+	// currentTags is the *configTags in effect, it's replaced rather than modified on reloading
+	currentTags   atomic.Value
+	subscribeOnce sync.Once
+)
+
+// Init starts the sinks enabled by `metric.types`, it must be called after all the counters are registered.
 func Init() {
-	mtype := config.GlobalConfig.MetricsOpts.Type
-	if mtype == "prometheus" {
-		go startPromHTTPServer()
-		return
-	} else if mtype == "falcon" {
-		return
+	currentTags.Store(parseConfigTags(config.Current().MetricsOpts.Tags))
+	subscribeOnce.Do(func() {
+		config.Subscribe(reloadTags)
+	})
+	for _, sink := range enabledSinks() {
+		if err := sink.Start(); err != nil {
+			logrus.Panicf("failed to start metric sink: %s", err)
+		}
+	}
+}
+
+// Close flushes the metrics and stops the metric reporters. It's called when the proxy exits.
+func Close(ctx context.Context) error {
+	var firstErr error
+	for _, sink := range enabledSinks() {
+		if err := sink.Close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	logrus.Panicf("no support tags type: %s", mtype)
+	return firstErr
 }
 
 // RegisterGauge using counter name with default tags in config
@@ -67,14 +117,14 @@ func RegisterGauge(counterName string) Gauge {
 
 // RegisterGaugeWithTags using counter name with custom tags and default tags of config
 func RegisterGaugeWithTags(counterName string, tagsName []string) Gauge {
-	mtype := config.GlobalConfig.MetricsOpts.Type
-	if mtype == "prometheus" {
-		return registerPromGauge(counterName, tagsName)
-	} else if mtype == "falcon" {
-		return registerFalconGauge(counterName, tagsName)
+	var gauges multiGauge
+	for _, sink := range enabledSinks() {
+		gauges = append(gauges, sink.RegisterGauge(counterName, tagsName))
+	}
+	if len(gauges) == 1 {
+		return gauges[0]
 	}
-	logrus.Panicf("no support tagsName type: %s", mtype)
-	return nil
+	return gauges
 }
 
 // RegisterMeter using counter name with default tags in config
@@ -84,28 +134,96 @@ func RegisterMeter(counterName string) Meter {
 
 // RegisterMeterWithTags using counter name with custom tags and default tags of config
 func RegisterMeterWithTags(counterName string, tagsName []string) Meter {
-	mtype := config.GlobalConfig.MetricsOpts.Type
-	if mtype == "prometheus" {
-		return registerPromMeter(counterName, tagsName)
-	} else if mtype == "falcon" {
-		return registerFalconMeter(counterName, tagsName)
+	var meters multiMeter
+	for _, sink := range enabledSinks() {
+		meters = append(meters, sink.RegisterMeter(counterName, tagsName))
+	}
+	if len(meters) == 1 {
+		return meters[0]
 	}
-	logrus.Panicf("no support tags type: %s", mtype)
-	return nil
+	return meters
 }
 
-// join default tagsName of config and custom tagsName
-func combineConfigTagsName(tagsName []string) []string {
-	for _, tag := range config.GlobalConfig.MetricsOpts.Tags {
-		tagsName = append(tagsName, strings.Split(tag, "=")[0])
+// RegisterHistogram using counter name with default tags in config
+func RegisterHistogram(counterName string) Histogram {
+	return RegisterHistogramWithTags(counterName, []string{})
+}
+
+// RegisterHistogramWithTags using counter name with custom tags and default tags of config. The prometheus buckets
+// are set by `metric.histogram_buckets` of the counter, or defaultHistogramBuckets if not set.
+func RegisterHistogramWithTags(counterName string, tagsName []string) Histogram {
+	var histograms multiHistogram
+	for _, sink := range enabledSinks() {
+		histograms = append(histograms, sink.RegisterHistogram(counterName, tagsName))
 	}
-	return tagsName
+	if len(histograms) == 1 {
+		return histograms[0]
+	}
+	return histograms
 }
 
-// join default tagsValue of config and custom tagsValue
-func combineConfigTagsValue(tagsValue []string) []string {
-	for _, tag := range config.GlobalConfig.MetricsOpts.Tags {
-		tagsValue = append(tagsValue, strings.Split(tag, "=")[1])
+// RegisterTimer using counter name with default tags in config
+func RegisterTimer(counterName string) Timer {
+	return RegisterTimerWithTags(counterName, []string{})
+}
+
+// RegisterTimerWithTags using counter name with custom tags and default tags of config
+func RegisterTimerWithTags(counterName string, tagsName []string) Timer {
+	return &timer{Histogram: RegisterHistogramWithTags(counterName, tagsName)}
+}
+
+type timer struct {
+	Histogram
+}
+
+// UpdateSince add the duration since start in microseconds
+func (t *timer) UpdateSince(start time.Time) {
+	t.UpdateSinceWithTags([]string{}, start)
+}
+
+// UpdateSinceWithTags add the duration since start in microseconds with custom tags
+func (t *timer) UpdateSinceWithTags(tagsValue []string, start time.Time) {
+	t.UpdateWithTags(tagsValue, time.Since(start).Microseconds())
+}
+
+func parseConfigTags(tags []string) *configTags {
+	result := &configTags{}
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, "=", 2)
+		result.names = append(result.names, kv[0])
+		result.values = append(result.values, kv[1])
+	}
+	return result
+}
+
+// loadConfigTags returns the `metric.tags` in effect.
+func loadConfigTags() *configTags {
+	if tags, ok := currentTags.Load().(*configTags); ok {
+		return tags
 	}
-	return tagsValue
+	return parseConfigTags(config.GlobalConfig.MetricsOpts.Tags)
+}
+
+// reloadTags makes the reloaded `metric.tags` take effect, the sinks rebuild their collectors with the new tags.
+func reloadTags(old *config.Configuration, new *config.Configuration) {
+	if reflect.DeepEqual(old.MetricsOpts.Tags, new.MetricsOpts.Tags) {
+		return
+	}
+	currentTags.Store(parseConfigTags(new.MetricsOpts.Tags))
+	for _, sink := range enabledSinks() {
+		if reloader, ok := sink.(TagsReloader); ok {
+			reloader.ReloadTags()
+		}
+	}
+	logrus.Infof("metric tags are reloaded: %s", new.MetricsOpts.Tags)
+}
+
+// join default tagsName of config and custom tagsName
+func (t *configTags) combineNames(tagsName []string) []string {
+	return append(append([]string{}, tagsName...), t.names...)
+}
+
+// join default tagsValue of config and custom tagsValue
+func (t *configTags) combineValues(tagsValue []string) []string {
+	return append(append([]string{}, tagsValue...), t.values...)
 }
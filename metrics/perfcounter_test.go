@@ -20,13 +20,17 @@
 package metrics
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	falcon "github.com/niean/goperfcounter"
 	"github.com/pegasus-kv/meta-proxy/config"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,19 +39,22 @@ func init() {
 }
 
 func TestParseTags(t *testing.T) {
-	tagsName := combineConfigTagsName([]string{"table"})
-	tagsValue := combineConfigTagsValue([]string{"temp"})
+	tagsName := loadConfigTags().combineNames([]string{"table"})
+	tagsValue := loadConfigTags().combineValues([]string{"temp"})
 	assert.Equal(t, tagsName, []string{"table", "region", "service"})
 	assert.Equal(t, tagsValue, []string{"temp", "local_tst", "meta_proxy"})
 }
 
 func TestPrometheus(t *testing.T) {
-	config.GlobalConfig.MetricsOpts.Type = "prometheus"
+	config.GlobalConfig.MetricsOpts.Types = []string{"prometheus"}
 	gaugeCounterWithTags := RegisterGaugeWithTags("promGaugeWithTagsTest", []string{"table"})
 	meterCounterWithTags := RegisterMeterWithTags("promMeterWithTagsTest", []string{"table"})
 
 	gaugeCounterNoTags := RegisterGauge("promGaugeNoTagsTest")
 	meterCounterNoTags := RegisterMeter("promMeterNoTagsTest")
+	config.GlobalConfig.MetricsOpts.HistogramBuckets["promHistogramTest"] = []float64{100, 1000}
+	histogramCounter := RegisterHistogramWithTags("promHistogramTest", []string{"table"})
+	timerCounter := RegisterTimer("promTimerTest")
 	Init()
 	// mock the promGauge counter: gaugeCounterWithTags = 0
 	gaugeCounterWithTags.AddWithTags([]string{"temp"}, 100)
@@ -63,6 +70,11 @@ func TestPrometheus(t *testing.T) {
 	// mock the promMeter: meterCounter = 1
 	meterCounterWithTags.UpdateWithTags([]string{"temp"})
 	meterCounterNoTags.Update()
+
+	// mock the promHistogram: one in the bucket of 100, two in 1000
+	histogramCounter.UpdateWithTags([]string{"temp"}, 10)
+	histogramCounter.UpdateWithTags([]string{"temp"}, 500)
+	timerCounter.UpdateSince(time.Now())
 	time.Sleep(10000000)
 	resp, err := http.Get("http://localhost:9091/metrics")
 	assert.Nil(t, err)
@@ -74,10 +86,14 @@ func TestPrometheus(t *testing.T) {
 	assert.Contains(t, result, "promMeterWithTagsTest{region=\"local_tst\",service=\"meta_proxy\",table=\"temp\"} 1")
 	assert.Contains(t, result, "promGaugeNoTagsTest{region=\"local_tst\",service=\"meta_proxy\"} 0")
 	assert.Contains(t, result, "promMeterNoTagsTest{region=\"local_tst\",service=\"meta_proxy\"} 1")
+	assert.Contains(t, result, "promHistogramTest_bucket{region=\"local_tst\",service=\"meta_proxy\",table=\"temp\",le=\"100\"} 1")
+	assert.Contains(t, result, "promHistogramTest_bucket{region=\"local_tst\",service=\"meta_proxy\",table=\"temp\",le=\"1000\"} 2")
+	assert.Contains(t, result, "promHistogramTest_sum{region=\"local_tst\",service=\"meta_proxy\",table=\"temp\"} 510")
+	assert.Contains(t, result, "promTimerTest_count{region=\"local_tst\",service=\"meta_proxy\"} 1")
 }
 
 func TestFalcon(t *testing.T) {
-	config.GlobalConfig.MetricsOpts.Type = "falcon"
+	config.GlobalConfig.MetricsOpts.Types = []string{"falcon"}
 	counterName := parseToCounterName("counterName", []string{"table"}, []string{"temp"})
 	assert.Equal(t, "counterName,table=temp,region=local_tst,service=meta_proxy", counterName)
 
@@ -100,4 +116,112 @@ func TestFalcon(t *testing.T) {
 	// mock the falconMeter
 	meterCounterWithTags.UpdateWithTags([]string{"temp"})
 	meterCounterNoTags.Update()
+
+	// mock the falconHistogram
+	histogramCounter := RegisterHistogramWithTags("falconHistogramTest", []string{"table"})
+	histogramCounter.UpdateWithTags([]string{"temp"}, 10)
+	histogramCounter.UpdateWithTags([]string{"temp"}, 30)
+	name := parseToCounterName("falconHistogramTest", []string{"table"}, []string{"temp"})
+	assert.Equal(t, int64(2), falcon.GetHistogramCount(name))
+	assert.Equal(t, float64(20), falcon.GetHistogramMean(name))
+}
+
+type countingSink struct {
+	*MemorySink
+	started int
+}
+
+func (s *countingSink) Start() error {
+	s.started++
+	return nil
+}
+
+func TestMultiSinks(t *testing.T) {
+	custom := &countingSink{MemorySink: newMemorySink()}
+	RegisterSink("custom", func() (Sink, error) {
+		return custom, nil
+	})
+	config.GlobalConfig.MetricsOpts.Types = []string{"falcon", "memory", "custom"}
+	defer func() {
+		config.GlobalConfig.MetricsOpts.Types = []string{"falcon"}
+	}()
+	assert.Nil(t, config.GlobalConfig.Validate())
+
+	gauge := RegisterGaugeWithTags("multiGaugeTest", []string{"table"})
+	meter := RegisterMeterWithTags("multiMeterTest", []string{"table"})
+	histogram := RegisterHistogramWithTags("multiHistogramTest", []string{"table"})
+	Init()
+	assert.Equal(t, 1, custom.started)
+
+	gauge.AddWithTags([]string{"temp"}, 10)
+	gauge.DecWithTags([]string{"temp"})
+	meter.UpdateWithTags([]string{"temp"})
+	meter.UpdateWithTags([]string{"temp"})
+	histogram.UpdateWithTags([]string{"temp"}, 10)
+	histogram.UpdateWithTags([]string{"temp"}, 30)
+
+	for _, sink := range []*MemorySink{Memory(), custom.MemorySink} {
+		assert.Equal(t, int64(9), sink.Gauge("multiGaugeTest", "temp"))
+		assert.Equal(t, int64(2), sink.Meter("multiMeterTest", "temp"))
+		assert.Equal(t, []int64{10, 30}, sink.Histogram("multiHistogramTest", "temp"))
+	}
+	assert.Equal(t, int64(9), falcon.GetCounterCount(parseToCounterName("multiGaugeTest", []string{"table"}, []string{"temp"})))
+	assert.Equal(t, int64(2), falcon.GetMeterCount(parseToCounterName("multiMeterTest", []string{"table"}, []string{"temp"})))
+	assert.Equal(t, float64(20), falcon.GetHistogramMean(parseToCounterName("multiHistogramTest", []string{"table"}, []string{"temp"})))
+	assert.Nil(t, Close(context.Background()))
+}
+
+// setTestTags reloads `metric.tags` as the config is reloaded, the tags are restored on cleanup.
+func setTestTags(t *testing.T, tags ...string) {
+	old := config.Current()
+	cfg := *old
+	cfg.MetricsOpts.Tags = tags
+	reloadTags(old, &cfg)
+	t.Cleanup(func() {
+		reloadTags(&cfg, old)
+	})
+}
+
+func TestReloadTags(t *testing.T) {
+	config.GlobalConfig.MetricsOpts.Types = []string{"prometheus", "falcon"}
+	defer func() {
+		config.GlobalConfig.MetricsOpts.Types = []string{"falcon"}
+	}()
+	gauge := RegisterGaugeWithTags("reloadGaugeTest", []string{"table"})
+	meter := RegisterMeterWithTags("reloadMeterTest", []string{"table"})
+	histogram := RegisterHistogramWithTags("reloadHistogramTest", []string{"table"})
+	gauge.AddWithTags([]string{"temp"}, 3)
+	meter.UpdateWithTags([]string{"temp"})
+	histogram.UpdateWithTags([]string{"temp"}, 10)
+	oldName := parseToCounterName("reloadGaugeTest", []string{"table"}, []string{"temp"})
+
+	// both the tag keys and values can be changed
+	setTestTags(t, "region=c3", "idc=bj")
+	gauge.IncWithTags([]string{"temp"})
+	meter.UpdateWithTags([]string{"temp"})
+
+	families, err := sinks["prometheus"].(*promSink).Gather()
+	assert.Nil(t, err)
+	series := make(map[string][]*dto.Metric)
+	for _, family := range families {
+		series[family.GetName()] = family.GetMetric()
+	}
+	labels := []*dto.LabelPair{
+		{Name: proto.String("idc"), Value: proto.String("bj")},
+		{Name: proto.String("region"), Value: proto.String("c3")},
+		{Name: proto.String("table"), Value: proto.String("temp")},
+	}
+	// the gauges and counters keep their values under the new tags, while the histograms restart
+	assert.Len(t, series["reloadGaugeTest"], 1)
+	assert.Equal(t, labels, series["reloadGaugeTest"][0].GetLabel())
+	assert.Equal(t, float64(4), series["reloadGaugeTest"][0].GetGauge().GetValue())
+	assert.Len(t, series["reloadMeterTest"], 1)
+	assert.Equal(t, labels, series["reloadMeterTest"][0].GetLabel())
+	assert.Equal(t, float64(2), series["reloadMeterTest"][0].GetCounter().GetValue())
+	assert.Empty(t, series["reloadHistogramTest"])
+
+	name := parseToCounterName("reloadGaugeTest", []string{"table"}, []string{"temp"})
+	assert.Equal(t, "reloadGaugeTest,table=temp,region=c3,idc=bj", name)
+	assert.Equal(t, int64(4), falcon.GetCounterCount(name))
+	assert.Equal(t, int64(0), falcon.GetCounterCount(oldName))
 }
@@ -20,17 +20,30 @@
 package metrics
 
 import (
+	"context"
 	"net/http"
+	"sync"
 
+	"github.com/pegasus-kv/meta-proxy/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 )
 
+// promLabels is the labels of a prometheus vector, which are the custom tags followed by `metric.tags`. The vector
+// is rebuilt with the new labels once `metric.tags` is reloaded, mu guards the vector from being updated meanwhile.
+type promLabels struct {
+	mu          sync.RWMutex
+	counterName string
+	tagsName    []string
+	tags        *configTags
+}
+
 // promGauge promGauge for reporting the current total number which can be "add" or "delete"
 type promGauge struct {
-	labelsName []string
-	metric     *prometheus.GaugeVec
+	promLabels
+	metric *prometheus.GaugeVec
 }
 
 // Add add value of counter
@@ -40,7 +53,9 @@ func (p *promGauge) Add(value int64) {
 
 // Add add value of counter with custom tags
 func (p *promGauge) AddWithTags(tagsValue []string, counterValue int64) {
-	p.metric.WithLabelValues(combineConfigTagsValue(tagsValue)...).Add(float64(counterValue))
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.metric.WithLabelValues(p.tags.combineValues(tagsValue)...).Add(float64(counterValue))
 }
 
 // Inc add value of counter, value = 1
@@ -50,7 +65,7 @@ func (p *promGauge) Inc() {
 
 // Inc add value of counter with custom tags, value = 1
 func (p *promGauge) IncWithTags(tagsValue []string) {
-	p.metric.WithLabelValues(combineConfigTagsValue(tagsValue)...).Inc()
+	p.AddWithTags(tagsValue, 1)
 }
 
 // Decrease decrease value of counter
@@ -60,7 +75,7 @@ func (p *promGauge) Sub(value int64) {
 
 // Decrease decrease value of counter with custom tags
 func (p *promGauge) SubWithTags(tagsValue []string, counterValue int64) {
-	p.metric.WithLabelValues(combineConfigTagsValue(tagsValue)...).Add(-float64(counterValue))
+	p.AddWithTags(tagsValue, -counterValue)
 }
 
 // Dec decrease value of counter, value = 1
@@ -70,14 +85,29 @@ func (p *promGauge) Dec() {
 
 // Dec decrease value of counter with custom tags, value = 1
 func (p *promGauge) DecWithTags(tagsValue []string) {
-	p.metric.WithLabelValues(combineConfigTagsValue(tagsValue)...).Dec()
+	p.SubWithTags(tagsValue, 1)
+}
+
+// rebuild replaces the vector by the one labeled with the tags, the gauges keep their values.
+func (p *promGauge) rebuild(tags *configTags, registerer prometheus.Registerer) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: p.counterName,
+	}, tags.combineNames(p.tagsName))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range collectPromMetrics(p.metric, p.tagsName) {
+		gauge.WithLabelValues(tags.combineValues(m.tagsValue)...).Set(m.GetGauge().GetValue())
+	}
+	registerRebuiltCollector(registerer, p.counterName, gauge)
+	p.metric = gauge
+	p.tags = tags
 }
 
 // promMeter promMeter for reporting the rate number which only can be "add"
 // and the rate get by using like "rate(counter_name[5m])" in web query page ***/
 type promMeter struct {
-	labelsName []string
-	metric     *prometheus.CounterVec
+	promLabels
+	metric *prometheus.CounterVec
 }
 
 // Update the counter, add 1
@@ -87,41 +117,239 @@ func (p *promMeter) Update() {
 
 // Update the counter with custom tags, add 1
 func (p *promMeter) UpdateWithTags(tags []string) {
-	p.metric.WithLabelValues(combineConfigTagsValue(tags)...).Inc()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.metric.WithLabelValues(p.tags.combineValues(tags)...).Inc()
+}
+
+// rebuild replaces the vector by the one labeled with the tags, the counters keep their values.
+func (p *promMeter) rebuild(tags *configTags, registerer prometheus.Registerer) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: p.counterName,
+	}, tags.combineNames(p.tagsName))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range collectPromMetrics(p.metric, p.tagsName) {
+		counter.WithLabelValues(tags.combineValues(m.tagsValue)...).Add(m.GetCounter().GetValue())
+	}
+	registerRebuiltCollector(registerer, p.counterName, counter)
+	p.metric = counter
+	p.tags = tags
+}
+
+// defaultHistogramBuckets is from 100 to 3276800 by doubling, which suits the latency in microseconds.
+var defaultHistogramBuckets = prometheus.ExponentialBuckets(100, 2, 16)
+
+// promHistogram for reporting the distribution of values by buckets
+type promHistogram struct {
+	promLabels
+	metric *prometheus.HistogramVec
+}
+
+// Update add the value into histogram
+func (p *promHistogram) Update(value int64) {
+	p.UpdateWithTags([]string{}, value)
 }
 
-func registerPromGauge(counterName string, labelsName []string) *promGauge {
-	labelsName = combineConfigTagsName(labelsName)
+// UpdateWithTags add the value into histogram with custom tags
+func (p *promHistogram) UpdateWithTags(tagsValue []string, value int64) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.metric.WithLabelValues(p.tags.combineValues(tagsValue)...).Observe(float64(value))
+}
+
+// rebuild replaces the vector by the one labeled with the tags, the histograms restart from empty since the
+// observed values can't be restored from the buckets.
+func (p *promHistogram) rebuild(tags *configTags, registerer prometheus.Registerer) {
+	histogram := newPromHistogramVec(p.counterName, tags.combineNames(p.tagsName))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	registerRebuiltCollector(registerer, p.counterName, histogram)
+	p.metric = histogram
+	p.tags = tags
+}
+
+func registerPromGauge(registerer prometheus.Registerer, counterName string, labelsName []string) *promGauge {
+	tags := loadConfigTags()
 	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: counterName,
-	}, labelsName)
-	prometheus.MustRegister(gauge)
+	}, tags.combineNames(labelsName))
+	registerer.MustRegister(gauge)
 
 	return &promGauge{
-		labelsName: labelsName,
+		promLabels: promLabels{counterName: counterName, tagsName: labelsName, tags: tags},
 		metric:     gauge,
 	}
 }
 
-func registerPromMeter(counterName string, labelsName []string) *promMeter {
-	labelsName = combineConfigTagsName(labelsName)
+func registerPromMeter(registerer prometheus.Registerer, counterName string, labelsName []string) *promMeter {
+	tags := loadConfigTags()
 	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: counterName,
-	}, labelsName)
-	prometheus.MustRegister(counter)
+	}, tags.combineNames(labelsName))
+	registerer.MustRegister(counter)
 
 	return &promMeter{
-		labelsName: labelsName,
+		promLabels: promLabels{counterName: counterName, tagsName: labelsName, tags: tags},
 		metric:     counter,
 	}
 }
 
-func startPromHTTPServer() {
-	http.Handle("/metrics", promhttp.HandlerFor(
-		prometheus.DefaultGatherer,
+func registerPromHistogram(registerer prometheus.Registerer, counterName string,
+	labelsName []string) *promHistogram {
+	tags := loadConfigTags()
+	histogram := newPromHistogramVec(counterName, tags.combineNames(labelsName))
+	registerer.MustRegister(histogram)
+
+	return &promHistogram{
+		promLabels: promLabels{counterName: counterName, tagsName: labelsName, tags: tags},
+		metric:     histogram,
+	}
+}
+
+func newPromHistogramVec(counterName string, labelsName []string) *prometheus.HistogramVec {
+	buckets := config.GlobalConfig.MetricsOpts.HistogramBuckets[counterName]
+	if len(buckets) == 0 {
+		buckets = defaultHistogramBuckets
+	}
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    counterName,
+		Buckets: buckets,
+	}, labelsName)
+}
+
+// promMetric is a collected metric of a vector, with the values of its custom tags.
+type promMetric struct {
+	*dto.Metric
+	tagsValue []string
+}
+
+// collectPromMetrics returns the current metrics of the vector.
+func collectPromMetrics(collector prometheus.Collector, tagsName []string) []promMetric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+	var result []promMetric
+	for metric := range ch {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			logrus.Warnf("failed to collect prometheus metric %s: %s", metric.Desc(), err)
+			continue
+		}
+		labels := make(map[string]string, len(pb.GetLabel()))
+		for _, label := range pb.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		tagsValue := make([]string, len(tagsName))
+		for i, name := range tagsName {
+			tagsValue[i] = labels[name]
+		}
+		result = append(result, promMetric{Metric: pb, tagsValue: tagsValue})
+	}
+	return result
+}
+
+func registerRebuiltCollector(registerer prometheus.Registerer, counterName string, collector prometheus.Collector) {
+	if err := registerer.Register(collector); err != nil {
+		logrus.Errorf("failed to register prometheus counter %s with the reloaded tags: %s", counterName, err)
+	}
+}
+
+// promRebuilder is the prometheus counter which is rebuilt once `metric.tags` is reloaded.
+type promRebuilder interface {
+	rebuild(tags *configTags, registerer prometheus.Registerer)
+}
+
+// promSink serves the counters on `metric.prometheus_address` for scraping. The counters are registered in the
+// registry of the sink rather than the default one, since prometheus never allows a registered name to change its
+// label names, the registry is replaced with the rebuilt counters once `metric.tags` is reloaded.
+type promSink struct {
+	server *http.Server
+
+	mu       sync.Mutex
+	registry *prometheus.Registry
+	counters []promRebuilder
+}
+
+func newPromSink() (Sink, error) {
+	return &promSink{registry: prometheus.NewRegistry()}, nil
+}
+
+func (s *promSink) RegisterGauge(counterName string, tagsName []string) Gauge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gauge := registerPromGauge(s.registry, counterName, tagsName)
+	s.counters = append(s.counters, gauge)
+	return gauge
+}
+
+func (s *promSink) RegisterMeter(counterName string, tagsName []string) Meter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meter := registerPromMeter(s.registry, counterName, tagsName)
+	s.counters = append(s.counters, meter)
+	return meter
+}
+
+func (s *promSink) RegisterHistogram(counterName string, tagsName []string) Histogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	histogram := registerPromHistogram(s.registry, counterName, tagsName)
+	s.counters = append(s.counters, histogram)
+	return histogram
+}
+
+// ReloadTags rebuilds the vectors with the reloaded `metric.tags`, the series with the previous tags are removed.
+func (s *promSink) ReloadTags() {
+	tags := loadConfigTags()
+	registry := prometheus.NewRegistry()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, counter := range s.counters {
+		counter.rebuild(tags, registry)
+	}
+	s.registry = registry
+}
+
+// Gather collects the default metrics, e.g. of the go runtime, and the counters of the proxy.
+func (s *promSink) Gather() ([]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	registry := s.registry
+	s.mu.Unlock()
+	return prometheus.Gatherers{prometheus.DefaultGatherer, registry}.Gather()
+}
+
+// Start starts the prometheus http server, it's a no-op if the server is already started.
+func (s *promSink) Start() error {
+	if s.server != nil {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(
+		s,
 		promhttp.HandlerOpts{
 			EnableOpenMetrics: true,
 		},
 	))
-	logrus.Fatal(http.ListenAndServe(":9091", nil))
+	server := &http.Server{
+		Addr:    config.GlobalConfig.MetricsOpts.PromAddress,
+		Handler: mux,
+	}
+	s.server = server
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logrus.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+// Close waits for the ongoing scrapes to complete, so that the last values are collected.
+func (s *promSink) Close(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
 }
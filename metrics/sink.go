@@ -0,0 +1,156 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Sink is a metrics backend, e.g. prometheus or falcon. The counters are registered into all the sinks enabled by
+// `metric.types`, and the updates are fanned out to them.
+type Sink interface {
+	RegisterGauge(counterName string, tagsName []string) Gauge
+	RegisterMeter(counterName string, tagsName []string) Meter
+	RegisterHistogram(counterName string, tagsName []string) Histogram
+
+	// Start is called by Init once all the counters are registered, e.g. to start reporting.
+	Start() error
+	// Close flushes the metrics and stops the sink when the proxy exits.
+	Close(ctx context.Context) error
+}
+
+// SinkFactory creates the sink when it's enabled by `metric.types`, it's called at most once.
+type SinkFactory func() (Sink, error)
+
+var (
+	sinkMut       sync.Mutex
+	sinkFactories = make(map[string]SinkFactory)
+	// sinks is the created sinks keyed by type
+	sinks = make(map[string]Sink)
+)
+
+func init() {
+	RegisterSink("prometheus", newPromSink)
+	RegisterSink("falcon", newFalconSink)
+	RegisterSink("memory", func() (Sink, error) {
+		return memory, nil
+	})
+}
+
+// RegisterSink makes the sink available as the metric type `name`, so that it can be enabled in `metric.types`.
+// It's typically called in the init function of the package which implements the sink.
+func RegisterSink(name string, factory SinkFactory) {
+	sinkMut.Lock()
+	defer sinkMut.Unlock()
+	sinkFactories[name] = factory
+	config.RegisterMetricType(name)
+}
+
+// enabledSinks returns the sinks enabled by `metric.types`, the sink is created on its first use.
+func enabledSinks() []Sink {
+	sinkMut.Lock()
+	defer sinkMut.Unlock()
+	var result []Sink
+	for _, mtype := range config.GlobalConfig.MetricsOpts.Types {
+		sink, ok := sinks[mtype]
+		if !ok {
+			factory, ok := sinkFactories[mtype]
+			if !ok {
+				logrus.Panicf("no support metric type: %s", mtype)
+			}
+			var err error
+			if sink, err = factory(); err != nil {
+				logrus.Panicf("failed to create metric sink %s: %s", mtype, err)
+			}
+			sinks[mtype] = sink
+		}
+		result = append(result, sink)
+	}
+	return result
+}
+
+// multiGauge fans out the updates to the gauges of all the sinks
+type multiGauge []Gauge
+
+func (m multiGauge) Add(value int64) {
+	m.AddWithTags([]string{}, value)
+}
+
+func (m multiGauge) AddWithTags(tagsValue []string, counterValue int64) {
+	for _, gauge := range m {
+		gauge.AddWithTags(tagsValue, counterValue)
+	}
+}
+
+func (m multiGauge) Inc() {
+	m.IncWithTags([]string{})
+}
+
+func (m multiGauge) IncWithTags(tagsValue []string) {
+	m.AddWithTags(tagsValue, 1)
+}
+
+func (m multiGauge) Sub(value int64) {
+	m.SubWithTags([]string{}, value)
+}
+
+func (m multiGauge) SubWithTags(tagsValue []string, counterValue int64) {
+	for _, gauge := range m {
+		gauge.SubWithTags(tagsValue, counterValue)
+	}
+}
+
+func (m multiGauge) Dec() {
+	m.DecWithTags([]string{})
+}
+
+func (m multiGauge) DecWithTags(tagsValue []string) {
+	m.SubWithTags(tagsValue, 1)
+}
+
+// multiMeter fans out the updates to the meters of all the sinks
+type multiMeter []Meter
+
+func (m multiMeter) Update() {
+	m.UpdateWithTags([]string{})
+}
+
+func (m multiMeter) UpdateWithTags(tagsValue []string) {
+	for _, meter := range m {
+		meter.UpdateWithTags(tagsValue)
+	}
+}
+
+// multiHistogram fans out the updates to the histograms of all the sinks
+type multiHistogram []Histogram
+
+func (m multiHistogram) Update(value int64) {
+	m.UpdateWithTags([]string{}, value)
+}
+
+func (m multiHistogram) UpdateWithTags(tagsValue []string, value int64) {
+	for _, histogram := range m {
+		histogram.UpdateWithTags(tagsValue, value)
+	}
+}
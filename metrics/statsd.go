@@ -0,0 +1,393 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	RegisterSink("statsd", newStatsdSink)
+}
+
+// statsdDroppedSamples is the counter of the histogram samples dropped while the sink isn't connected to the agent.
+const statsdDroppedSamples = "statsd_dropped_samples"
+
+// statsdEscaper replaces the characters which are reserved by the StatsD protocol in names and tags.
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_")
+
+// statsdSink aggregates the counters in memory and sends them to the StatsD agent every flush interval. The
+// gauges are sent as absolute values, the meters as the counts since last flush and the histograms as each
+// sampled value, all the lines are batched into udp packets of at most `max_packet_size` bytes.
+type statsdSink struct {
+	address       string
+	prefix        string
+	dogStatsD     bool
+	flushInterval time.Duration
+	maxPacketSize int
+
+	mu       sync.Mutex
+	conn     net.Conn
+	gauges   map[statsdGaugeID]*statsdGaugeValue
+	counters map[statsdKey]int64
+	// samples is the pending lines of histogram values, they're sent once they fill up a packet
+	samples     []string
+	samplesSize int
+	// dropped is the number of samples dropped since last flush, since they can't be sent without connection
+	dropped int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type statsdKey struct {
+	name string
+	// tags is the DogStatsD suffix "|#key:value,...", it's empty for plain StatsD whose tags are in name
+	tags string
+}
+
+// statsdGaugeID identifies the value of a gauge by the custom tag values joined by "\x00". The key is built on
+// each flush rather than update, so that the value is sent with the `metric.tags` in effect once they're reloaded.
+type statsdGaugeID struct {
+	counter   *statsdCounter
+	tagsValue string
+}
+
+type statsdGaugeValue struct {
+	tagsValue []string
+	value     int64
+}
+
+func newStatsdSink() (Sink, error) {
+	opts := config.GlobalConfig.MetricsOpts.Statsd
+	return &statsdSink{
+		address:       opts.Address,
+		prefix:        opts.Prefix,
+		dogStatsD:     opts.DogStatsD,
+		flushInterval: time.Duration(opts.FlushInterval) * time.Millisecond,
+		maxPacketSize: opts.MaxPacketSize,
+		gauges:        make(map[statsdGaugeID]*statsdGaugeValue),
+		counters:      make(map[statsdKey]int64),
+	}, nil
+}
+
+func (s *statsdSink) RegisterGauge(counterName string, tagsName []string) Gauge {
+	return &statsdGauge{s.newCounter(counterName, tagsName)}
+}
+
+func (s *statsdSink) RegisterMeter(counterName string, tagsName []string) Meter {
+	return &statsdMeter{s.newCounter(counterName, tagsName)}
+}
+
+func (s *statsdSink) RegisterHistogram(counterName string, tagsName []string) Histogram {
+	return &statsdHistogram{s.newCounter(counterName, tagsName)}
+}
+
+// Start connects to the StatsD agent and starts flushing periodically, it's a no-op if it's already started.
+func (s *statsdSink) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.Dial("udp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to statsd %s: %s", s.address, err)
+	}
+	s.conn = conn
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.loop(s.stop, s.done)
+	return nil
+}
+
+// Close sends the pending metrics and closes the connection.
+func (s *statsdSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop = nil
+	s.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn := s.conn
+	s.conn = nil
+	return conn.Close()
+}
+
+func (s *statsdSink) loop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *statsdSink) flush() {
+	s.mu.Lock()
+	var lines []string
+	for id, gauge := range s.gauges {
+		key := id.counter.key(gauge.tagsValue)
+		if gauge.value < 0 {
+			// a signed value is a delta in StatsD, reset the gauge to set it negative
+			lines = append(lines, s.line(key, 0, "g"))
+		}
+		lines = append(lines, s.line(key, gauge.value, "g"))
+	}
+	for key, value := range s.counters {
+		if value > 0 {
+			lines = append(lines, s.line(key, value, "c"))
+		}
+	}
+	s.counters = make(map[statsdKey]int64)
+	if s.dropped > 0 {
+		lines = append(lines, s.line(statsdKey{name: statsdEscaper.Replace(s.prefix + statsdDroppedSamples)}, s.dropped, "c"))
+		s.dropped = 0
+	}
+	lines = append(lines, s.samples...)
+	s.samples = nil
+	s.samplesSize = 0
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn != nil {
+		s.send(conn, lines)
+	}
+}
+
+// send batches the lines into packets and writes them to the agent.
+func (s *statsdSink) send(conn net.Conn, lines []string) {
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > s.maxPacketSize {
+			s.write(conn, packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		s.write(conn, packet)
+	}
+}
+
+func (s *statsdSink) write(conn net.Conn, packet []byte) {
+	if _, err := conn.Write(packet); err != nil {
+		logrus.Warnf("failed to send metrics to statsd %s: %s", s.address, err)
+	}
+}
+
+func (s *statsdSink) line(key statsdKey, value int64, metricType string) string {
+	return fmt.Sprintf("%s:%d|%s%s", key.name, value, metricType, key.tags)
+}
+
+func (s *statsdSink) addGauge(counter *statsdCounter, tagsValue []string, value int64) {
+	id := statsdGaugeID{counter: counter, tagsValue: strings.Join(tagsValue, "\x00")}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gauge := s.gauges[id]
+	if gauge == nil {
+		gauge = &statsdGaugeValue{tagsValue: append([]string{}, tagsValue...)}
+		s.gauges[id] = gauge
+	}
+	gauge.value += value
+}
+
+func (s *statsdSink) addCounter(key statsdKey, value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[key] += value
+}
+
+func (s *statsdSink) addSample(key statsdKey, value int64) {
+	metricType := "ms"
+	if s.dogStatsD {
+		metricType = "h"
+	}
+	line := s.line(key, value, metricType)
+
+	s.mu.Lock()
+	if s.conn == nil {
+		// the sink is not started or closed, the samples would pile up since nothing sends them
+		s.dropped++
+		s.mu.Unlock()
+		return
+	}
+	var full []string
+	if len(s.samples) > 0 && s.samplesSize+1+len(line) > s.maxPacketSize {
+		// the pending samples fill up a packet, send them without waiting for the flush
+		full = s.samples
+		s.samples = nil
+		s.samplesSize = 0
+	}
+	if len(s.samples) > 0 {
+		s.samplesSize++
+	}
+	s.samples = append(s.samples, line)
+	s.samplesSize += len(line)
+	conn := s.conn
+	s.mu.Unlock()
+
+	if full != nil {
+		s.send(conn, full)
+	}
+}
+
+// statsdCounter builds the StatsD name and tags of the counter
+type statsdCounter struct {
+	sink        *statsdSink
+	counterName string
+	tagsName    []string
+}
+
+func (s *statsdSink) newCounter(counterName string, tagsName []string) statsdCounter {
+	return statsdCounter{
+		sink:        s,
+		counterName: counterName,
+		tagsName:    tagsName,
+	}
+}
+
+// key returns "<prefix><name>" and "|#key:value,..." for DogStatsD, or "<prefix><name>.key.value..." for StatsD.
+func (c *statsdCounter) key(tagsValue []string) statsdKey {
+	metricTags := loadConfigTags()
+	tagsName := metricTags.combineNames(c.tagsName)
+	tagsValue = metricTags.combineValues(tagsValue)
+	if len(tagsName) != len(tagsValue) {
+		logrus.Panicf("[%s] tag's length is invalid: tagsName=%s, tagsValue=%s", c.counterName, tagsName, tagsValue)
+	}
+
+	var name strings.Builder
+	var tags strings.Builder
+	name.WriteString(statsdEscaper.Replace(c.sink.prefix + c.counterName))
+	for n := range tagsName {
+		tagName := statsdEscaper.Replace(tagsName[n])
+		tagValue := statsdEscaper.Replace(tagsValue[n])
+		if c.sink.dogStatsD {
+			if n == 0 {
+				tags.WriteString("|#")
+			} else {
+				tags.WriteString(",")
+			}
+			tags.WriteString(tagName + ":" + tagValue)
+		} else {
+			// the dots split the name into hierarchies in graphite
+			name.WriteString("." + strings.ReplaceAll(tagName, ".", "_") + "." + strings.ReplaceAll(tagValue, ".", "_"))
+		}
+	}
+	return statsdKey{name: name.String(), tags: tags.String()}
+}
+
+type statsdGauge struct {
+	statsdCounter
+}
+
+// Add add value of counter
+func (g *statsdGauge) Add(value int64) {
+	g.AddWithTags([]string{}, value)
+}
+
+// AddWithTags add value of counter with custom tags
+func (g *statsdGauge) AddWithTags(tagsValue []string, counterValue int64) {
+	g.sink.addGauge(&g.statsdCounter, tagsValue, counterValue)
+}
+
+// Inc add value of counter, value = 1
+func (g *statsdGauge) Inc() {
+	g.IncWithTags([]string{})
+}
+
+// IncWithTags add value of counter with custom tags, value = 1
+func (g *statsdGauge) IncWithTags(tagsValue []string) {
+	g.AddWithTags(tagsValue, 1)
+}
+
+// Sub decrease value of counter
+func (g *statsdGauge) Sub(value int64) {
+	g.SubWithTags([]string{}, value)
+}
+
+// SubWithTags decrease value of counter with custom tags
+func (g *statsdGauge) SubWithTags(tagsValue []string, counterValue int64) {
+	g.AddWithTags(tagsValue, -counterValue)
+}
+
+// Dec decrease value of counter, value = 1
+func (g *statsdGauge) Dec() {
+	g.DecWithTags([]string{})
+}
+
+// DecWithTags decrease value of counter with custom tags, value = 1
+func (g *statsdGauge) DecWithTags(tagsValue []string) {
+	g.SubWithTags(tagsValue, 1)
+}
+
+type statsdMeter struct {
+	statsdCounter
+}
+
+// Update add value of counter, value = 1
+func (m *statsdMeter) Update() {
+	m.UpdateWithTags([]string{})
+}
+
+// UpdateWithTags add value of counter with custom tags, value = 1
+func (m *statsdMeter) UpdateWithTags(tagsValue []string) {
+	m.sink.addCounter(m.key(tagsValue), 1)
+}
+
+type statsdHistogram struct {
+	statsdCounter
+}
+
+// Update add the value into histogram
+func (h *statsdHistogram) Update(value int64) {
+	h.UpdateWithTags([]string{}, value)
+}
+
+// UpdateWithTags add the value into histogram with custom tags
+func (h *statsdHistogram) UpdateWithTags(tagsValue []string, value int64) {
+	h.sink.addSample(h.key(tagsValue), value)
+}
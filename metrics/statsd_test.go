@@ -0,0 +1,209 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStatsdListener starts a udp server as the StatsD agent, and points the statsd options to it.
+func newStatsdListener(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(t, err)
+	opts := config.GlobalConfig.MetricsOpts.Statsd
+	t.Cleanup(func() {
+		config.GlobalConfig.MetricsOpts.Statsd = opts
+		conn.Close()
+	})
+	config.GlobalConfig.MetricsOpts.Statsd.Address = conn.LocalAddr().String()
+	return conn
+}
+
+// readStatsdPackets reads the packets until count lines are received or timeout.
+func readStatsdPackets(t *testing.T, conn *net.UDPConn, count int) (packets []string, lines []string) {
+	buf := make([]byte, 65536)
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for len(lines) < count {
+		n, err := conn.Read(buf)
+		if !assert.Nil(t, err) {
+			return
+		}
+		packet := string(buf[:n])
+		packets = append(packets, packet)
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	return
+}
+
+func TestStatsd(t *testing.T) {
+	listener := newStatsdListener(t)
+	config.GlobalConfig.MetricsOpts.Statsd.Prefix = "meta_proxy."
+	config.GlobalConfig.MetricsOpts.Statsd.DogStatsD = false
+	// the metrics are sent on close rather than periodically
+	config.GlobalConfig.MetricsOpts.Statsd.FlushInterval = 3600000
+	config.GlobalConfig.MetricsOpts.Statsd.MaxPacketSize = 1432
+	sink, _ := newStatsdSink()
+
+	gauge := sink.RegisterGauge("statsdGaugeTest", []string{"table"})
+	negativeGauge := sink.RegisterGauge("statsdNegativeGaugeTest", []string{})
+	meter := sink.RegisterMeter("statsdMeterTest", []string{"table"})
+	histogram := sink.RegisterHistogram("statsdHistogramTest", []string{"meta"})
+	assert.Nil(t, sink.Start())
+
+	gauge.AddWithTags([]string{"temp"}, 10)
+	gauge.DecWithTags([]string{"temp"})
+	negativeGauge.Sub(2)
+	meter.UpdateWithTags([]string{"temp"})
+	meter.UpdateWithTags([]string{"temp"})
+	histogram.UpdateWithTags([]string{"127.0.0.1:34601"}, 100)
+	assert.Nil(t, sink.Close(context.Background()))
+	assert.Nil(t, sink.Close(context.Background()))
+
+	packets, lines := readStatsdPackets(t, listener, 5)
+	assert.Len(t, packets, 1)
+	assert.ElementsMatch(t, []string{
+		"meta_proxy.statsdGaugeTest.table.temp.region.local_tst.service.meta_proxy:9|g",
+		"meta_proxy.statsdNegativeGaugeTest.region.local_tst.service.meta_proxy:0|g",
+		"meta_proxy.statsdNegativeGaugeTest.region.local_tst.service.meta_proxy:-2|g",
+		"meta_proxy.statsdMeterTest.table.temp.region.local_tst.service.meta_proxy:2|c",
+		"meta_proxy.statsdHistogramTest.meta.127_0_0_1_34601.region.local_tst.service.meta_proxy:100|ms",
+	}, lines)
+}
+
+func TestDogStatsdFlush(t *testing.T) {
+	listener := newStatsdListener(t)
+	config.GlobalConfig.MetricsOpts.Statsd.Prefix = ""
+	config.GlobalConfig.MetricsOpts.Statsd.DogStatsD = true
+	config.GlobalConfig.MetricsOpts.Statsd.FlushInterval = 10
+	config.GlobalConfig.MetricsOpts.Statsd.MaxPacketSize = 1432
+	sink, _ := newStatsdSink()
+	defer sink.Close(context.Background())
+
+	gauge := sink.RegisterGauge("dogGaugeTest", []string{"table"})
+	meter := sink.RegisterMeter("dogMeterTest", []string{})
+	assert.Nil(t, sink.Start())
+	gauge.AddWithTags([]string{"temp"}, 3)
+	meter.Update()
+
+	// the gauge is sent on every flush, while the meter is only sent once
+	_, lines := readStatsdPackets(t, listener, 3)
+	assert.Contains(t, lines, "dogGaugeTest:3|g|#table:temp,region:local_tst,service:meta_proxy")
+	assert.Contains(t, lines, "dogMeterTest:1|c|#region:local_tst,service:meta_proxy")
+	_, lines = readStatsdPackets(t, listener, 2)
+	assert.Contains(t, lines, "dogGaugeTest:3|g|#table:temp,region:local_tst,service:meta_proxy")
+	assert.NotContains(t, lines, "dogMeterTest:1|c|#region:local_tst,service:meta_proxy")
+}
+
+func TestStatsdBatching(t *testing.T) {
+	listener := newStatsdListener(t)
+	config.GlobalConfig.MetricsOpts.Statsd.Prefix = ""
+	config.GlobalConfig.MetricsOpts.Statsd.DogStatsD = true
+	config.GlobalConfig.MetricsOpts.Statsd.FlushInterval = 3600000
+	config.GlobalConfig.MetricsOpts.Statsd.MaxPacketSize = 200
+	sink, _ := newStatsdSink()
+
+	// each line is 60 bytes, so that a packet holds 3 lines
+	histogram := sink.RegisterHistogram("dogHistogramTest", []string{})
+	assert.Nil(t, sink.Start())
+	for i := 0; i < 10; i++ {
+		histogram.Update(int64(100 + i))
+	}
+
+	// the full packets are sent without waiting for the flush
+	packets, lines := readStatsdPackets(t, listener, 9)
+	assert.Equal(t, []string{
+		"dogHistogramTest:100|h|#region:local_tst,service:meta_proxy",
+		"dogHistogramTest:101|h|#region:local_tst,service:meta_proxy",
+		"dogHistogramTest:102|h|#region:local_tst,service:meta_proxy",
+	}, lines[:3])
+	assert.Nil(t, sink.Close(context.Background()))
+	rest, restLines := readStatsdPackets(t, listener, 1)
+	packets = append(packets, rest...)
+	lines = append(lines, restLines...)
+
+	assert.Len(t, lines, 10)
+	assert.Equal(t, "dogHistogramTest:109|h|#region:local_tst,service:meta_proxy", lines[9])
+	for _, packet := range packets {
+		assert.LessOrEqual(t, len(packet), 200)
+	}
+}
+
+func TestStatsdDropWithoutConn(t *testing.T) {
+	listener := newStatsdListener(t)
+	config.GlobalConfig.MetricsOpts.Statsd.Prefix = "meta_proxy."
+	config.GlobalConfig.MetricsOpts.Statsd.DogStatsD = false
+	config.GlobalConfig.MetricsOpts.Statsd.FlushInterval = 3600000
+	config.GlobalConfig.MetricsOpts.Statsd.MaxPacketSize = 1432
+	sink, _ := newStatsdSink()
+
+	// the samples are dropped rather than piled up before the sink is started
+	histogram := sink.RegisterHistogram("statsdDroppedTest", []string{})
+	for i := 0; i < 1000; i++ {
+		histogram.Update(int64(i))
+	}
+	statsd := sink.(*statsdSink)
+	assert.Empty(t, statsd.samples)
+
+	// the number of the dropped samples is reported once connected
+	assert.Nil(t, sink.Start())
+	histogram.Update(1)
+	assert.Nil(t, sink.Close(context.Background()))
+	_, lines := readStatsdPackets(t, listener, 2)
+	assert.ElementsMatch(t, []string{
+		"meta_proxy.statsd_dropped_samples:1000|c",
+		"meta_proxy.statsdDroppedTest.region.local_tst.service.meta_proxy:1|ms",
+	}, lines)
+
+	histogram.Update(1)
+	assert.Empty(t, statsd.samples)
+	assert.Equal(t, int64(1), statsd.dropped)
+}
+
+func TestStatsdReloadTags(t *testing.T) {
+	listener := newStatsdListener(t)
+	config.GlobalConfig.MetricsOpts.Statsd.Prefix = ""
+	config.GlobalConfig.MetricsOpts.Statsd.DogStatsD = true
+	config.GlobalConfig.MetricsOpts.Statsd.FlushInterval = 3600000
+	config.GlobalConfig.MetricsOpts.Statsd.MaxPacketSize = 1432
+	sink, _ := newStatsdSink()
+
+	gauge := sink.RegisterGauge("dogReloadGaugeTest", []string{"table"})
+	meter := sink.RegisterMeter("dogReloadMeterTest", []string{})
+	assert.Nil(t, sink.Start())
+	gauge.AddWithTags([]string{"temp"}, 3)
+	meter.Update()
+
+	// the gauge is sent with the reloaded tags, while the meter counted before reloading keeps the previous tags
+	setTestTags(t, "region=c3")
+	gauge.IncWithTags([]string{"temp"})
+	assert.Nil(t, sink.Close(context.Background()))
+	_, lines := readStatsdPackets(t, listener, 2)
+	assert.ElementsMatch(t, []string{
+		"dogReloadGaugeTest:4|g|#table:temp,region:c3",
+		"dogReloadMeterTest:1|c|#region:local_tst,service:meta_proxy",
+	}, lines)
+}
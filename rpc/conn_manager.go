@@ -0,0 +1,247 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package rpc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientConn wraps a client connection to record its runtime state.
+type clientConn struct {
+	io.ReadWriteCloser
+
+	remoteAddr string
+	listener   string
+	startTime  time.Time
+
+	requests   int64
+	pending    int64 // the number of requests that are not responded yet
+	bytesIn    int64
+	bytesOut   int64
+	lastActive int64 // unix nano
+	closed     int32
+}
+
+// ConnectionInfo is a snapshot of the client connection state.
+type ConnectionInfo struct {
+	RemoteAddr string    `json:"remote_addr"`
+	Listener   string    `json:"listener"`
+	StartTime  time.Time `json:"start_time"`
+	Requests   int64     `json:"requests"`
+	Pending    int64     `json:"pending"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	LastActive time.Time `json:"last_active"`
+}
+
+func newClientConn(conn io.ReadWriteCloser, remoteAddr string, listener string) *clientConn {
+	now := time.Now()
+	return &clientConn{
+		ReadWriteCloser: conn,
+		remoteAddr:      remoteAddr,
+		listener:        listener,
+		startTime:       now,
+		lastActive:      now.UnixNano(),
+	}
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&c.bytesIn, int64(n))
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *clientConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&c.bytesOut, int64(n))
+		c.touch()
+	}
+	return n, err
+}
+
+// Close closes the underlying connection, it's safe to be called multiple times.
+func (c *clientConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	return c.ReadWriteCloser.Close()
+}
+
+// isClosed returns whether the connection is closed by the server.
+func (c *clientConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+func (c *clientConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *clientConn) requestStarted() {
+	atomic.AddInt64(&c.requests, 1)
+	atomic.AddInt64(&c.pending, 1)
+	c.touch()
+}
+
+func (c *clientConn) requestFinished() {
+	atomic.AddInt64(&c.pending, -1)
+	c.touch()
+}
+
+// setReadDeadline makes the blocking read return at `t`, it does nothing if the connection
+// doesn't support deadline.
+func (c *clientConn) setReadDeadline(t time.Time) {
+	if conn, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		_ = conn.SetReadDeadline(t)
+	}
+}
+
+// remoteIP returns the client host, or empty string if the remote address has no host, e.g unix socket.
+func (c *clientConn) remoteIP() string {
+	host, _, err := net.SplitHostPort(c.remoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func (c *clientConn) info() ConnectionInfo {
+	return ConnectionInfo{
+		RemoteAddr: c.remoteAddr,
+		Listener:   c.listener,
+		StartTime:  c.startTime,
+		Requests:   atomic.LoadInt64(&c.requests),
+		Pending:    atomic.LoadInt64(&c.pending),
+		BytesIn:    atomic.LoadInt64(&c.bytesIn),
+		BytesOut:   atomic.LoadInt64(&c.bytesOut),
+		LastActive: time.Unix(0, atomic.LoadInt64(&c.lastActive)),
+	}
+}
+
+// connManager tracks the alive client connections and enforces the connection limits.
+type connManager struct {
+	maxConns      int // 0 means unlimited
+	maxConnsPerIP int // 0 means unlimited
+	idleTimeout   time.Duration
+
+	mu    sync.Mutex
+	conns map[*clientConn]struct{}
+	perIP map[string]int
+}
+
+func newConnManager(maxConns int, maxConnsPerIP int, idleTimeout time.Duration) *connManager {
+	return &connManager{
+		maxConns:      maxConns,
+		maxConnsPerIP: maxConnsPerIP,
+		idleTimeout:   idleTimeout,
+		conns:         make(map[*clientConn]struct{}),
+		perIP:         make(map[string]int),
+	}
+}
+
+// add registers the connection, it fails if any connection limit is exceeded.
+func (m *connManager) add(c *clientConn) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maxConns > 0 && len(m.conns) >= m.maxConns {
+		return fmt.Errorf("connection count exceeds the limit %d", m.maxConns)
+	}
+	ip := c.remoteIP()
+	if ip != "" && m.maxConnsPerIP > 0 && m.perIP[ip] >= m.maxConnsPerIP {
+		return fmt.Errorf("connection count from %s exceeds the limit %d", ip, m.maxConnsPerIP)
+	}
+	m.conns[c] = struct{}{}
+	if ip != "" {
+		m.perIP[ip]++
+	}
+	return nil
+}
+
+func (m *connManager) remove(c *clientConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.conns[c]; !ok {
+		return
+	}
+	delete(m.conns, c)
+	if ip := c.remoteIP(); ip != "" {
+		m.perIP[ip]--
+		if m.perIP[ip] == 0 {
+			delete(m.perIP, ip)
+		}
+	}
+}
+
+func (m *connManager) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+// forEach calls fn for every alive connection with the lock held, fn must not block.
+func (m *connManager) forEach(fn func(c *clientConn)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c := range m.conns {
+		fn(c)
+	}
+}
+
+// list returns the state of all alive connections sorted by remote address.
+func (m *connManager) list() []ConnectionInfo {
+	infos := make([]ConnectionInfo, 0)
+	m.forEach(func(c *clientConn) {
+		infos = append(infos, c.info())
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].RemoteAddr < infos[j].RemoteAddr
+	})
+	return infos
+}
+
+// closeIdle closes the connections that have no pending request and are inactive for longer than
+// idleTimeout. It returns the number of closed connections.
+func (m *connManager) closeIdle(now time.Time) int {
+	if m.idleTimeout <= 0 {
+		return 0
+	}
+	var idle []*clientConn
+	m.forEach(func(c *clientConn) {
+		lastActive := time.Unix(0, atomic.LoadInt64(&c.lastActive))
+		if atomic.LoadInt64(&c.pending) == 0 && now.Sub(lastActive) > m.idleTimeout {
+			idle = append(idle, c)
+		}
+	})
+	for _, c := range idle {
+		_ = c.Close()
+	}
+	return len(idle)
+}
@@ -0,0 +1,151 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/XiaoMi/pegasus-go-client/idl/replication"
+	"github.com/XiaoMi/pegasus-go-client/idl/rrdb"
+	"github.com/XiaoMi/pegasus-go-client/session"
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnManagerLimits(t *testing.T) {
+	m := newConnManager(3, 2, 0)
+
+	c1 := newClientConn(newFakeConn(nil), "127.0.0.1:1001", "")
+	c2 := newClientConn(newFakeConn(nil), "127.0.0.1:1002", "")
+	c3 := newClientConn(newFakeConn(nil), "127.0.0.1:1003", "")
+	assert.Nil(t, m.add(c1))
+	assert.Nil(t, m.add(c2))
+	assert.NotNil(t, m.add(c3)) // exceeds per-ip limit
+
+	// unix socket connections have no remote ip, so only the total limit applies
+	unix1 := newClientConn(newFakeConn(nil), "", "")
+	unix2 := newClientConn(newFakeConn(nil), "", "")
+	assert.Nil(t, m.add(unix1))
+	assert.NotNil(t, m.add(unix2)) // exceeds total limit
+	assert.Equal(t, 3, m.len())
+
+	m.remove(c1)
+	m.remove(c1) // remove twice is harmless
+	assert.Nil(t, m.add(c3))
+	assert.Equal(t, 3, m.len())
+	assert.Equal(t, 2, m.perIP["127.0.0.1"])
+}
+
+func TestConnManagerCloseIdle(t *testing.T) {
+	m := newConnManager(0, 0, time.Minute)
+	idle := newClientConn(newFakeConn(nil), "127.0.0.1:1001", "")
+	busy := newClientConn(newFakeConn(nil), "127.0.0.1:1002", "")
+	active := newClientConn(newFakeConn(nil), "127.0.0.1:1003", "")
+	assert.Nil(t, m.add(idle))
+	assert.Nil(t, m.add(busy))
+	assert.Nil(t, m.add(active))
+	busy.requestStarted()
+
+	assert.Equal(t, 2, m.closeIdle(time.Now().Add(2*time.Minute)))
+	assert.True(t, idle.isClosed())
+	assert.False(t, busy.isClosed()) // the pending request keeps the connection alive
+	assert.True(t, active.isClosed())
+
+	// idle timeout is disabled
+	m = newConnManager(0, 0, 0)
+	assert.Nil(t, m.add(busy))
+	busy.requestFinished()
+	assert.Equal(t, 0, m.closeIdle(time.Now().Add(time.Hour)))
+}
+
+func TestClientConnState(t *testing.T) {
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "test", PartitionIndices: []int32{}}
+	rcall, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+	reqCnt := 3
+	var reqBuf []byte
+	for i := 0; i < reqCnt; i++ {
+		reqBuf = append(reqBuf, rcall.RawReq...)
+	}
+	registerQueryConfigRPC(&replication.QueryCfgResponse{Err: &base.ErrorCode{Errno: "ERR_OK"}})
+	defer unregisterAllRPC()
+
+	fake := newFakeConn(reqBuf)
+	conn := newClientConn(fake, "127.0.0.1:56789", "0.0.0.0:34601")
+	serveConn(context.Background(), conn, nil)
+
+	info := conn.info()
+	assert.Equal(t, "127.0.0.1:56789", info.RemoteAddr)
+	assert.Equal(t, "0.0.0.0:34601", info.Listener)
+	assert.Equal(t, int64(reqCnt), info.Requests)
+	assert.Equal(t, int64(0), info.Pending)
+	assert.Equal(t, int64(len(reqBuf)), info.BytesIn)
+	assert.Equal(t, int64(fake.wbuf.Len()), info.BytesOut)
+	assert.False(t, info.LastActive.Before(info.StartTime))
+}
+
+func TestServerConnectionLimitAndIdle(t *testing.T) {
+	opts := config.GlobalConfig.ServerOpts
+	defer func() {
+		config.GlobalConfig.ServerOpts = opts
+	}()
+	config.GlobalConfig.ServerOpts.MaxConnections = 1
+	config.GlobalConfig.ServerOpts.IdleTimeout = 200
+
+	server, conn := startTestServer(t)
+	defer conn.Close()
+
+	// the second connection is rejected
+	conn2, err := net.Dial("tcp", server.Addrs()[0].String())
+	assert.Nil(t, err)
+	defer conn2.Close()
+	_ = conn2.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn2.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	// the alive connection is shown on admin endpoint
+	recorder := httptest.NewRecorder()
+	server.handleListConnections(recorder, httptest.NewRequest("GET", "/connections", nil))
+	var result struct {
+		Count       int              `json:"count"`
+		Connections []ConnectionInfo `json:"connections"`
+	}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	assert.Equal(t, 1, result.Count)
+	assert.Equal(t, conn.LocalAddr().String(), result.Connections[0].RemoteAddr)
+	assert.Equal(t, server.Addrs()[0].String(), result.Connections[0].Listener)
+
+	// the connection is closed after being idle for a while
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, server.Shutdown(ctx))
+	assert.Equal(t, 0, server.ConnectionCount())
+}
@@ -33,6 +33,9 @@ func init() {
 // methodRegistry stores the mapping from RPC method name to the method definition.
 type methodRegistry struct {
 	nameToMethod map[string]*MethodDefinition
+
+	// fallback handles the requests whose method is not registered, it's optional.
+	fallback RawMethodHandler
 }
 
 func findMethodByName(name string) (*MethodDefinition, error) {
@@ -49,6 +52,17 @@ func Register(name string, method *MethodDefinition) {
 	globalMethodRegistry.nameToMethod[name] = method
 }
 
+// RegisterFallback registers a raw handler for all the methods that are not registered, so that
+// these requests can be passed through rather than rejected.
+func RegisterFallback(handler RawMethodHandler) {
+	globalMethodRegistry.fallback = handler
+}
+
+// RawMethodHandler handles a request without decoding it. `body` is the thrift message of the request,
+// and the returned bytes is the complete response frame, which is sent back to client as is.
+// If the returned error is a base.DsnErrCode, it's sent back to client as the error code.
+type RawMethodHandler func(ctx context.Context, methodName string, body []byte) ([]byte, error)
+
 // MethodHandler handles a rpc request
 type MethodHandler func(context.Context, RequestArgs) ResponseResult
 
@@ -0,0 +1,95 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package rpc
+
+import (
+	"sync"
+
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/pegasus-kv/meta-proxy/metrics"
+)
+
+// unknownMethod is the method tag of the requests that no handler is found for, or whose method can't be decoded,
+// so that the arbitrary method names sent by clients don't blow up the counters.
+const unknownMethod = "unknown"
+
+// passthroughMethod is the method tag of the requests relayed by the fallback handler. Any method name
+// sent by clients reaches the fallback, so they share one tag to keep the counters bounded.
+const passthroughMethod = "passthrough"
+
+// declare perfcounters
+var clientConnectionCount metrics.Gauge
+var clientConnectionRejectedCount metrics.Meter
+var clientRequestTimeoutCount metrics.Meter
+var clientRequestLatency metrics.Timer
+
+var (
+	clientRequestCount        metrics.Meter
+	clientRequestFailedCount  metrics.Meter
+	clientRequestInFlight     metrics.Gauge
+	clientRequestSize         metrics.Histogram
+	clientResponseSize        metrics.Histogram
+	clientResponseFailedCount metrics.Meter
+)
+
+var registerCountersOnce sync.Once
+
+// initCounters registers the perfcounters of rpc package only once, it must be called after config is loaded.
+func initCounters() {
+	registerCountersOnce.Do(func() {
+		clientConnectionCount = metrics.RegisterGaugeWithTags("client_connection_count", []string{"listener"})
+		clientConnectionRejectedCount = metrics.RegisterMeterWithTags("client_connection_rejected_count", []string{"listener"})
+		clientRequestTimeoutCount = metrics.RegisterMeterWithTags("client_request_timeout_count", []string{"method"})
+		clientRequestLatency = metrics.RegisterTimerWithTags("client_request_latency", []string{"method"})
+
+		clientRequestCount = metrics.RegisterMeterWithTags("client_request_count", []string{"method"})
+		clientRequestFailedCount = metrics.RegisterMeterWithTags("client_request_failed_count", []string{"method", "error"})
+		clientRequestInFlight = metrics.RegisterGaugeWithTags("client_request_in_flight", []string{"method"})
+		clientRequestSize = metrics.RegisterHistogramWithTags("client_request_size", []string{"method"})
+		clientResponseSize = metrics.RegisterHistogramWithTags("client_response_size", []string{"method"})
+		clientResponseFailedCount = metrics.RegisterMeterWithTags("client_response_failed_count", []string{"method"})
+	})
+}
+
+// methodTag returns the method name of the request for the perfcounters, only the methods registered
+// by Register are tagged with their own names.
+func (r *pegasusRequest) methodTag() string {
+	if r == nil {
+		return unknownMethod
+	}
+	if r.handler == nil {
+		if r.rawHandler != nil {
+			return passthroughMethod
+		}
+		return unknownMethod
+	}
+	return r.methodName
+}
+
+// recordRequest counts the request which is fully read from the stream, even if it can't be handled.
+func recordRequest(req *pegasusRequest) {
+	clientRequestCount.UpdateWithTags([]string{req.methodTag()})
+	clientRequestSize.UpdateWithTags([]string{req.methodTag()}, int64(req.size))
+}
+
+// recordFailure counts the request which is responded with an error code, or can't be decoded if req is nil.
+func recordFailure(req *pegasusRequest, errno base.DsnErrCode) {
+	clientRequestFailedCount.UpdateWithTags([]string{req.methodTag(), errno.String()})
+}
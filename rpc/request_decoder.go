@@ -21,10 +21,13 @@ package rpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
 	"github.com/pegasus-kv/thrift/lib/go/thrift"
 )
 
@@ -56,6 +59,20 @@ type requestDecoder struct {
 	reader io.Reader
 }
 
+// requestError means the request is fully read from the stream but it can't be handled,
+// e.g. the method is unsupported or the arguments are malformed. Unlike other errors returned
+// by readRequest, the stream is not corrupt so the connection can keep serving the following
+// requests, and an error response with `errno` should be sent back to client.
+type requestError struct {
+	req   *pegasusRequest
+	errno base.DsnErrCode
+	err   error
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("failed to handle request %s(seqID=%d): %s: %s", e.req.methodName, e.req.seqID, e.errno, e.err)
+}
+
 // pegasusProtocolFlag is a const flag to identify if the RPC request is legal.
 var pegasusProtocolFlag = []byte("THFT")
 
@@ -82,9 +99,33 @@ type pegasusRequest struct {
 	seqID      uint64
 	args       RequestArgs
 	handler    MethodHandler
+
+	// rawBody and rawHandler are set instead of args and handler when the request is passed through.
+	rawBody    []byte
+	rawHandler RawMethodHandler
+
+	// ctx is the context for handling this request, whose deadline is derived from client timeout.
+	ctx context.Context
+
+	// size is the number of bytes of the request frame, received is the time the request is fully read.
+	size     int
+	received time.Time
+}
+
+// clientTimeout returns the timeout set by client in the request header, or 0 if it's not set.
+func (r *pegasusRequest) clientTimeout() time.Duration {
+	var timeoutMs int64
+	if r.reqv0 != nil {
+		timeoutMs = int64(r.reqv0.meta.clientTimeout)
+	} else if r.reqv1 != nil && r.reqv1.meta != nil {
+		timeoutMs = int64(r.reqv1.meta.GetClientTimeout())
+	}
+	return time.Duration(timeoutMs) * time.Millisecond
 }
 
 // readRequest reads fully the RPC request into pegasusRequest.
+// If the request is read but can't be handled, a *requestError is returned, otherwise any error means
+// the stream is closed or corrupt.
 func (d *requestDecoder) readRequest() (*pegasusRequest, error) {
 	// read protocol flag
 	flag := make([]byte, 4)
@@ -103,12 +144,23 @@ func (d *requestDecoder) readRequest() (*pegasusRequest, error) {
 		return nil, err
 	}
 	hdrVersion := binary.BigEndian.Uint32(hdrVersionBytes)
+	var req *pegasusRequest
 	if hdrVersion == 0 {
-		return d.readRequestV0()
+		req, err = d.readRequestV0()
 	} else if hdrVersion == 1 {
-		return d.readRequestV1()
+		req, err = d.readRequestV1()
+	} else {
+		return nil, fmt.Errorf("invalid request header version: %d", hdrVersion)
 	}
-	return nil, fmt.Errorf("invalid request header version: %d", hdrVersion)
+
+	if reqErr, ok := err.(*requestError); ok {
+		reqErr.req.received = time.Now()
+		recordRequest(reqErr.req)
+	} else if err == nil {
+		req.received = time.Now()
+		recordRequest(req)
+	}
+	return req, err
 }
 
 func (d *requestDecoder) readRequestV0() (*pegasusRequest, error) {
@@ -140,6 +192,7 @@ func (d *requestDecoder) readRequestV0() (*pegasusRequest, error) {
 	reqMeta.clientThreadHash = binary.BigEndian.Uint32(data[28:32])
 	reqMeta.clientPartitionHash = binary.BigEndian.Uint64(data[32:40])
 	reqv0.meta = reqMeta
+	pegasusReq.size = 48 + int(reqMeta.bodyLength)
 
 	// read request body
 	err = d.readRequestBody(pegasusReq, reqMeta.bodyLength)
@@ -165,6 +218,7 @@ func (d *requestDecoder) readRequestV1() (*pegasusRequest, error) {
 
 	reqv1.metaLength = binary.BigEndian.Uint32(data[0:4])
 	reqv1.bodyLength = binary.BigEndian.Uint32(data[4:8])
+	pegasusReq.size = 16 + int(reqv1.metaLength) + int(reqv1.bodyLength)
 
 	// read thrift_request_meta_v1
 	// TODO(wutao): do we need this struct?
@@ -175,17 +229,21 @@ func (d *requestDecoder) readRequestV1() (*pegasusRequest, error) {
 	}
 	iprot := thrift.NewTBinaryProtocolTransport(thrift.NewStreamTransportR(bytes.NewBuffer(data)))
 	meta := NewThriftRequestMetaV1()
-	err = meta.Read(iprot)
-	if err != nil {
-		return nil, err
-	}
+	metaErr := meta.Read(iprot)
 	reqv1.meta = meta
 
-	// read request body
+	// read request body, even if the meta is invalid, so the stream keeps complete
 	err = d.readRequestBody(pegasusReq, reqv1.bodyLength)
 	if err != nil {
 		return nil, err
 	}
+	if metaErr != nil {
+		return nil, &requestError{
+			req:   pegasusReq,
+			errno: base.ERR_INVALID_DATA,
+			err:   fmt.Errorf("invalid request meta: %s", metaErr),
+		}
+	}
 
 	return pegasusReq, nil
 }
@@ -208,15 +266,20 @@ func (d *requestDecoder) readRequestBody(req *pegasusRequest, bodyLength uint32)
 	req.methodName = name
 	method, err := findMethodByName(name)
 	if err != nil {
-		return err
+		if fallback := globalMethodRegistry.fallback; fallback != nil {
+			req.rawBody = data
+			req.rawHandler = fallback
+			return nil
+		}
+		return &requestError{req: req, errno: base.ERR_HANDLER_NOT_FOUND, err: err}
 	}
 	req.handler = method.Handler
 	req.args = method.RequestCreator()
 	if err = req.args.Read(iprot); err != nil {
-		return err
+		return &requestError{req: req, errno: base.ERR_INVALID_DATA, err: err}
 	}
 	if err = iprot.ReadMessageEnd(); err != nil {
-		return err
+		return &requestError{req: req, errno: base.ERR_INVALID_DATA, err: err}
 	}
 	return nil
 }
@@ -72,6 +72,7 @@ func registerQueryConfigRPC(resp *replication.QueryCfgResponse) {
 func unregisterAllRPC() {
 	// do cleanup after test
 	globalMethodRegistry.nameToMethod = make(map[string]*MethodDefinition)
+	globalMethodRegistry.fallback = nil
 }
 
 func TestDecoderReadRequest(t *testing.T) {
@@ -135,6 +136,67 @@ func TestDecoderHandleUnsupportedRequest(t *testing.T) {
 	dec := &requestDecoder{reader: newFakeConn(rcall.RawReq)}
 	_, err = dec.readRequest()
 	assert.NotNil(t, err) // method-not-found
+
+	// the request is fully read, so it can be responded with error
+	reqErr, ok := err.(*requestError)
+	assert.True(t, ok)
+	assert.Equal(t, base.ERR_HANDLER_NOT_FOUND, reqErr.errno)
+	assert.Equal(t, uint64(1), reqErr.req.seqID)
+	assert.Equal(t, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX", reqErr.req.methodName)
+}
+
+// TestDecoderHandleInvalidBody ensures a request with malformed arguments is consumed entirely and
+// reported as invalid data, so the following request can still be read.
+func TestDecoderHandleInvalidBody(t *testing.T) {
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = replication.NewQueryCfgRequest()
+	arg.Query.AppName = "test"
+
+	registerQueryConfigRPC(nil)
+	defer unregisterAllRPC()
+
+	rcall, err := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(2), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+	assert.Nil(t, err)
+	// truncate the arguments but keep the frame complete by fixing the body length in v0 header
+	truncated := 4
+	bad := append([]byte{}, rcall.RawReq[:len(rcall.RawReq)-truncated]...)
+	bodyLength := binary.BigEndian.Uint32(bad[16:20])
+	binary.BigEndian.PutUint32(bad[16:20], bodyLength-uint32(truncated))
+
+	dec := &requestDecoder{reader: newFakeConn(append(bad, rcall.RawReq...))}
+	_, err = dec.readRequest()
+	reqErr, ok := err.(*requestError)
+	assert.True(t, ok)
+	assert.Equal(t, base.ERR_INVALID_DATA, reqErr.errno)
+	assert.Equal(t, uint64(2), reqErr.req.seqID)
+
+	req, err := dec.readRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, "test", req.args.(*rrdb.MetaQueryCfgArgs).Query.AppName)
+}
+
+// TestDecoderCorruptStream ensures the errors that break the stream are not reported as requestError.
+func TestDecoderCorruptStream(t *testing.T) {
+	registerQueryConfigRPC(nil)
+	defer unregisterAllRPC()
+
+	rcall, err := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, rrdb.NewMetaQueryCfgArgs(), "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+	assert.Nil(t, err)
+
+	// empty body, the method name is unknown
+	emptyBody := append([]byte{}, rcall.RawReq[:48]...)
+	binary.BigEndian.PutUint32(emptyBody[16:20], 0)
+	// invalid header length
+	badHeader := append([]byte{}, rcall.RawReq...)
+	binary.BigEndian.PutUint32(badHeader[8:12], 47)
+
+	for _, data := range [][]byte{emptyBody, badHeader, []byte("GET / HTTP/1.1"), rcall.RawReq[:30]} {
+		dec := &requestDecoder{reader: newFakeConn(data)}
+		_, err = dec.readRequest()
+		assert.NotNil(t, err)
+		_, ok := err.(*requestError)
+		assert.False(t, ok)
+	}
 }
 
 func TestUnexpectedRPCProtocol(t *testing.T) {
@@ -198,3 +260,23 @@ func TestV1ProtocolHandleBadRequest(t *testing.T) {
 		assert.NotNil(t, err)
 	}
 }
+
+func TestDecoderFallbackRequest(t *testing.T) {
+	RegisterFallback(func(ctx context.Context, methodName string, body []byte) ([]byte, error) {
+		return nil, nil
+	})
+	defer unregisterAllRPC()
+
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = replication.NewQueryCfgRequest()
+	rcall, err := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, arg, "RPC_CM_LIST_APPS")
+	assert.Nil(t, err)
+
+	dec := &requestDecoder{reader: newFakeConn(rcall.RawReq)}
+	req, err := dec.readRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, "RPC_CM_LIST_APPS", req.methodName)
+	assert.NotNil(t, req.rawHandler)
+	assert.Equal(t, rcall.RawReq[48:], req.rawBody) // the body follows the 48-bytes v0 header
+	assert.Equal(t, passthroughMethod, req.methodTag())
+}
@@ -24,6 +24,7 @@ import (
 	"io"
 	"sync"
 
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
 	"github.com/pegasus-kv/thrift/lib/go/thrift"
 )
 
@@ -37,10 +38,37 @@ type responseEncoder struct {
 func (e *responseEncoder) sendResponse(req *pegasusRequest, result ResponseResult) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	return e.doSendResponse(req, result)
+	return e.doSendResponse(req, base.ERR_OK, result)
 }
 
-func (e *responseEncoder) doSendResponse(req *pegasusRequest, result ResponseResult) error {
+// sendErrorResponse sends back a response without body, which tells the client the request is failed
+// with `errno`.
+func (e *responseEncoder) sendErrorResponse(req *pegasusRequest, errno base.DsnErrCode) error {
+	recordFailure(req, errno)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.doSendResponse(req, errno, nil)
+}
+
+// sendRawResponse sends back the response frame of the request as is.
+func (e *responseEncoder) sendRawResponse(req *pegasusRequest, resp []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.write(req, resp)
+}
+
+// write writes the response frame of the request, and records its size or the failure.
+func (e *responseEncoder) write(req *pegasusRequest, resp []byte) error {
+	if _, err := e.writer.Write(resp); err != nil {
+		clientResponseFailedCount.UpdateWithTags([]string{req.methodTag()})
+		return err
+	}
+	clientResponseSize.UpdateWithTags([]string{req.methodTag()}, int64(len(resp)))
+	return nil
+}
+
+// The result is not written if errno is not ERR_OK.
+func (e *responseEncoder) doSendResponse(req *pegasusRequest, errno base.DsnErrCode, result ResponseResult) error {
 	// prepare response bytes
 
 	buf := thrift.NewTMemoryBuffer()
@@ -51,7 +79,7 @@ func (e *responseEncoder) doSendResponse(req *pegasusRequest, result ResponseRes
 	}
 
 	// error code
-	if err = oprot.WriteString("ERR_OK"); err != nil {
+	if err = oprot.WriteString(errno.String()); err != nil {
 		return err
 	}
 
@@ -59,8 +87,10 @@ func (e *responseEncoder) doSendResponse(req *pegasusRequest, result ResponseRes
 	if err = oprot.WriteMessageBegin(req.methodName+"_ACK", thrift.REPLY, int32(req.seqID)); err != nil {
 		return err
 	}
-	if err = result.Write(oprot); err != nil {
-		return err
+	if errno == base.ERR_OK {
+		if err = result.Write(oprot); err != nil {
+			return err
+		}
 	}
 	if err = oprot.WriteMessageEnd(); err != nil {
 		return err
@@ -70,8 +100,5 @@ func (e *responseEncoder) doSendResponse(req *pegasusRequest, result ResponseRes
 	respLen := buf.Len()
 	binary.BigEndian.PutUint32(buf.Bytes(), uint32(respLen))
 
-	if _, err := e.writer.Write(buf.Bytes()); err != nil {
-		return err
-	}
-	return nil
+	return e.write(req, buf.Bytes())
 }
@@ -61,3 +61,21 @@ func TestEncoderWriteResponse(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, *res.Success, *queryCfgRes.Success)
 }
+
+func TestEncoderWriteErrorResponse(t *testing.T) {
+	req := &pegasusRequest{
+		seqID:      2,
+		methodName: "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX",
+	}
+	wbuf := bytes.NewBuffer(nil)
+	enc := responseEncoder{
+		writer: wbuf,
+	}
+	assert.Nil(t, enc.sendErrorResponse(req, base.ERR_HANDLER_NOT_FOUND))
+
+	rcall, err := session.ReadRpcResponse(rpc.NewFakeRpcConn(wbuf, nil), session.NewPegasusCodec())
+	assert.Nil(t, err)
+	assert.Equal(t, base.ERR_HANDLER_NOT_FOUND, rcall.Err)
+	assert.Equal(t, int32(2), rcall.SeqId)
+	assert.Equal(t, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX_ACK", rcall.Name)
+}
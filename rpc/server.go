@@ -21,47 +21,246 @@ package rpc
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/pegasus-kv/meta-proxy/metrics"
+	"github.com/XiaoMi/pegasus-go-client/idl/base"
+	"github.com/pegasus-kv/meta-proxy/admin"
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/pegasus-kv/meta-proxy/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// declare perfcounters
-var clientConnectionCount metrics.Gauge
+// Server is the handle of a running rpc server, which accepts client connections on one
+// or more listeners.
+type Server struct {
+	listeners []*listener
 
-// Serve blocks until the connection shutdown.
-func Serve() error {
-	clientConnectionCount = metrics.RegisterGauge("client_connection_count")
+	// acceptWg waits for the accept loops, connWg waits for the connection goroutines.
+	acceptWg sync.WaitGroup
+	connWg   sync.WaitGroup
 
-	addr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:34601")
-	if err != nil {
-		return err
+	conns *connManager
+
+	// drain is closed when the server starts shutting down.
+	drain     chan struct{}
+	drainOnce sync.Once
+
+	// baseCtx is the root context of all requests, it's cancelled when the server is forced to stop.
+	baseCtx context.Context
+	cancel  context.CancelFunc
+}
+
+// listener accepts connections of one endpoint in its own goroutine.
+type listener struct {
+	ln     net.Listener
+	closed int32
+}
+
+// Serve starts listening on all the endpoints configured in `server.listeners`. The connections
+// are accepted in background, use Wait to block until the server is closed.
+func Serve() (*Server, error) {
+	initCounters()
+
+	opts := config.GlobalConfig.ServerOpts
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		conns: newConnManager(opts.MaxConnections, opts.MaxConnectionsPerIP,
+			time.Duration(opts.IdleTimeout)*time.Millisecond),
+		drain:   make(chan struct{}),
+		baseCtx: ctx,
+		cancel:  cancel,
 	}
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
+	for _, lnOpts := range opts.Listeners {
+		ln, err := listen(lnOpts.Network, lnOpts.Address)
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		logrus.Infof("start server listen: %s", ln.Addr())
+		s.listeners = append(s.listeners, &listener{ln: ln})
+	}
+
+	for _, l := range s.listeners {
+		s.acceptWg.Add(1)
+		go func(l *listener) {
+			s.acceptLoop(l)
+			s.acceptWg.Done()
+		}(l)
+	}
+	if s.conns.idleTimeout > 0 {
+		go s.closeIdleLoop()
+	}
+	admin.Register("/connections", s.handleListConnections)
+	return s, nil
+}
+
+func listen(network string, address string) (net.Listener, error) {
+	switch network {
+	case "tcp":
+		return net.Listen("tcp", address)
+	case "unix":
+		// remove the socket file left by the previous process, otherwise the bind fails.
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", address)
+	}
+	return nil, fmt.Errorf("unsupported listener network \"%s\"", network)
+}
+
+// Addrs returns the addresses that are actually bound, which is useful when the port is 0.
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.ln.Addr())
+	}
+	return addrs
+}
+
+// ConnectionCount returns the number of alive connections accepted by all listeners.
+func (s *Server) ConnectionCount() int {
+	return s.conns.len()
+}
+
+// Connections returns the state of all alive connections.
+func (s *Server) Connections() []ConnectionInfo {
+	return s.conns.list()
+}
+
+// handleListConnections is the admin handler to show the alive client connections.
+func (s *Server) handleListConnections(w http.ResponseWriter, r *http.Request) {
+	conns := s.Connections()
+	admin.RenderJSON(w, map[string]interface{}{
+		"count":       len(conns),
+		"connections": conns,
+	})
+}
+
+// Close stops accepting new connections. The established connections are not affected.
+func (s *Server) Close() error {
+	var firstErr error
+	for _, l := range s.listeners {
+		if !atomic.CompareAndSwapInt32(&l.closed, 0, 1) {
+			continue
+		}
+		if err := l.ln.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Wait blocks until all the listeners are closed.
+func (s *Server) Wait() {
+	s.acceptWg.Wait()
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new connections and reading new
+// requests, then waits for the ongoing requests to be responded before closing the connections.
+// If ctx is done before that, the ongoing requests are cancelled and the connections are closed
+// forcibly, the ctx error is returned in this case.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+	s.acceptWg.Wait()
+
+	// no more connections will be accepted from now on
+	s.drainOnce.Do(func() {
+		close(s.drain)
+	})
+	s.conns.forEach(func(c *clientConn) {
+		// unblock the reading goroutine immediately
+		c.setReadDeadline(time.Now())
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logrus.Info("all connections are drained")
 		return err
+	case <-ctx.Done():
 	}
-	logrus.Infof("start server listen: %s", listener.Addr())
+
+	logrus.Warnf("server shutdown timeout, force closing %d connections", s.conns.len())
+	s.cancel()
+	s.conns.forEach(func(c *clientConn) {
+		_ = c.Close()
+	})
+	<-done
+	return ctx.Err()
+}
+
+func (s *Server) acceptLoop(l *listener) {
+	addr := l.ln.Addr().String()
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.ln.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&l.closed) == 1 {
+				logrus.Infof("server listen %s is closed", addr)
+				return
+			}
 			logrus.Errorf("connection accept: %s", err)
 			continue
 		}
-		clientConnectionCount.Inc()
-		// TODO(wutao): add connections management
+		c := newClientConn(conn, conn.RemoteAddr().String(), addr)
+		if err := s.conns.add(c); err != nil {
+			logrus.Warnf("reject connection %s: %s", c.remoteAddr, err)
+			clientConnectionRejectedCount.UpdateWithTags([]string{addr})
+			_ = c.Close()
+			continue
+		}
+		clientConnectionCount.IncWithTags([]string{addr})
+		s.connWg.Add(1)
 
 		// use one goroutine per connection
-		go serveConn(conn, conn.RemoteAddr().String())
+		go func() {
+			serveConn(s.baseCtx, c, s.drain)
+			_ = c.Close()
+
+			s.conns.remove(c)
+			clientConnectionCount.DecWithTags([]string{addr})
+			s.connWg.Done()
+		}()
 	}
 }
 
-// conn is a network connection but abstracted as a ReadWriteCloser here in order to do mock test.
+// closeIdleLoop periodically closes the idle connections until the server shuts down.
+func (s *Server) closeIdleLoop() {
+	ticker := time.NewTicker(s.conns.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if n := s.conns.closeIdle(now); n > 0 {
+				logrus.Infof("close %d idle connections", n)
+			}
+		case <-s.drain:
+			return
+		}
+	}
+}
+
+// serveSpanName is the name of the root span of each request, the method is recorded in the attribute
+// instead, since the methods relayed to meta server are arbitrary.
+const serveSpanName = "rpc.Serve"
+
+// conn wraps a network connection which is abstracted as a ReadWriteCloser in order to do mock test.
 // The caller typically invokes serveConn in a go statement.
-func serveConn(conn io.ReadWriteCloser, remoteAddr string) {
+// The connection stops reading new requests once `drain` is closed, but the ongoing requests are
+// still responded unless `baseCtx` is cancelled.
+func serveConn(baseCtx context.Context, conn *clientConn, drain <-chan struct{}) {
+	remoteAddr := conn.remoteAddr
 	dec := &requestDecoder{
 		reader: conn,
 	}
@@ -71,30 +270,66 @@ func serveConn(conn io.ReadWriteCloser, remoteAddr string) {
 
 	// `ctx` is the root of all sub-tasks. It notifies the children to terminate
 	//  if the connection encounters some error.
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(baseCtx)
 	var wg sync.WaitGroup
 	for {
 		req, err := dec.readRequest()
 		if err != nil {
-			if err != io.EOF {
-				logrus.Warn(err)
-				// TODO(wutao): send back rpc response for this error if the request is fully read
+			if isDraining(drain) {
+				logrus.Infof("connection %s stops reading for server shutdown", remoteAddr)
+				// wait for the ongoing requests to be responded
+				wg.Wait()
+				break
+			}
+			if conn.isClosed() {
+				logrus.Infof("connection %s is closed by server", remoteAddr)
+				break
+			}
+			if reqErr, ok := err.(*requestError); ok {
+				// the stream is intact, tell the client this request is failed and go on
+				logrus.Warnf("connection %s: %s", remoteAddr, reqErr)
+				if err := enc.sendErrorResponse(reqErr.req, reqErr.errno); err != nil {
+					logrus.Error(err)
+				}
 				continue
 			}
-			clientConnectionCount.Dec()
+			if err != io.EOF {
+				logrus.Warnf("connection %s is corrupt and will be closed: %s", remoteAddr, err)
+				recordFailure(nil, base.ERR_INVALID_DATA)
+				break
+			}
 			logrus.Infof("connection %s is closed", remoteAddr)
 			break
 		}
 
 		// Asynchronously execute RPC handler in order to not block the connection reading.
+		conn.requestStarted()
 		wg.Add(1)
 		go func() {
-			result := req.handler(ctx, req.args)
-			err := enc.sendResponse(req, result)
-			if err != nil {
+			var reqCancel context.CancelFunc
+			req.ctx, reqCancel = context.WithTimeout(ctx, requestTimeout(req.clientTimeout()))
+			method := req.methodTag()
+			var span trace.Span
+			req.ctx, span = tracing.Start(req.ctx, serveSpanName, tracing.MethodKey.String(req.methodName),
+				tracing.SeqIDKey.Int64(int64(req.seqID)), tracing.PeerKey.String(remoteAddr))
+			clientRequestInFlight.IncWithTags([]string{method})
+			send := handleRequest(req, enc)
+			var err error
+			if req.ctx.Err() == context.DeadlineExceeded {
+				// the client has given up waiting, the response is useless
+				logrus.Warnf("connection %s: request %s(seqID=%d) is timeout, drop the response",
+					remoteAddr, req.methodName, req.seqID)
+				clientRequestTimeoutCount.UpdateWithTags([]string{method})
+				err = req.ctx.Err()
+			} else if err = send(); err != nil {
 				logrus.Error(err)
 			}
+			tracing.End(span, err)
+			clientRequestInFlight.DecWithTags([]string{method})
+			clientRequestLatency.UpdateSinceWithTags([]string{method}, req.received)
+			reqCancel()
 
+			conn.requestFinished()
 			wg.Done()
 		}()
 	}
@@ -105,3 +340,51 @@ func serveConn(conn io.ReadWriteCloser, remoteAddr string) {
 	// This connection exits only when all children are terminated.
 	wg.Wait()
 }
+
+// handleRequest executes the handler of the request and returns the function to send back the response.
+func handleRequest(req *pegasusRequest, enc *responseEncoder) func() error {
+	if req.rawHandler == nil {
+		result := req.handler(req.ctx, req.args)
+		return func() error {
+			return enc.sendResponse(req, result)
+		}
+	}
+
+	resp, err := req.rawHandler(req.ctx, req.methodName, req.rawBody)
+	if err != nil {
+		logrus.Warnf("failed to pass through request %s(seqID=%d): %s", req.methodName, req.seqID, err)
+		errno := base.ERR_UNKNOWN
+		if dsnErr, ok := err.(base.DsnErrCode); ok {
+			errno = dsnErr
+		}
+		return func() error {
+			return enc.sendErrorResponse(req, errno)
+		}
+	}
+	return func() error {
+		return enc.sendRawResponse(req, resp)
+	}
+}
+
+// requestTimeout returns the timeout of the request, which is the client timeout capped by
+// `server.max_request_timeout`, or `server.default_request_timeout` if the client sets no timeout.
+func requestTimeout(clientTimeout time.Duration) time.Duration {
+	opts := config.GlobalConfig.ServerOpts
+	maxTimeout := time.Duration(opts.MaxRequestTimeout) * time.Millisecond
+	if clientTimeout <= 0 {
+		clientTimeout = time.Duration(opts.DefaultRequestTimeout) * time.Millisecond
+	}
+	if clientTimeout > maxTimeout {
+		return maxTimeout
+	}
+	return clientTimeout
+}
+
+func isDraining(drain <-chan struct{}) bool {
+	select {
+	case <-drain:
+		return true
+	default:
+		return false
+	}
+}
@@ -20,25 +20,105 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/XiaoMi/pegasus-go-client/idl/base"
 	"github.com/XiaoMi/pegasus-go-client/idl/replication"
 	"github.com/XiaoMi/pegasus-go-client/idl/rrdb"
 	"github.com/XiaoMi/pegasus-go-client/rpc"
 	"github.com/XiaoMi/pegasus-go-client/session"
+	falcon "github.com/niean/goperfcounter"
 	"github.com/pegasus-kv/meta-proxy/config"
 	"github.com/pegasus-kv/meta-proxy/metrics"
+	"github.com/pegasus-kv/meta-proxy/tracing"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func init() {
 	config.Init("../config/yaml/meta-proxy-example.yml")
-	_ = Serve()
+	initCounters()
 	metrics.Init()
 }
 
+func TestServeMultipleListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta-proxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "meta-proxy.sock")
+
+	listeners := config.GlobalConfig.ServerOpts.Listeners
+	defer func() {
+		config.GlobalConfig.ServerOpts.Listeners = listeners
+	}()
+	config.GlobalConfig.ServerOpts.Listeners = append(listeners[:0:0], listeners...)
+	config.GlobalConfig.ServerOpts.Listeners[0].Address = "127.0.0.1:0" // ephemeral port
+	config.GlobalConfig.ServerOpts.Listeners[1].Address = sockPath
+
+	resp := &replication.QueryCfgResponse{
+		Err:            &base.ErrorCode{Errno: "ERR_OK"},
+		AppID:          3,
+		PartitionCount: 128,
+		Partitions:     []*replication.PartitionConfiguration{},
+	}
+	registerQueryConfigRPC(resp)
+	defer unregisterAllRPC()
+
+	server, err := Serve()
+	assert.Nil(t, err)
+	addrs := server.Addrs()
+	assert.Equal(t, 2, len(addrs))
+	assert.NotEqual(t, "127.0.0.1:0", addrs[0].String())
+	assert.Equal(t, sockPath, addrs[1].String())
+
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "test", PartitionIndices: []int32{}}
+	rcall, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+	for _, addr := range addrs {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		assert.Nil(t, err)
+		_, err = conn.Write(rcall.RawReq)
+		assert.Nil(t, err)
+
+		respCall, err := session.ReadRpcResponse(rpc.NewFakeRpcConn(conn, conn), session.NewPegasusCodec())
+		assert.Nil(t, err)
+		assert.Equal(t, *resp, *respCall.Result.(*rrdb.MetaQueryCfgResult).Success)
+		assert.Nil(t, conn.Close())
+	}
+
+	assert.Nil(t, server.Close())
+	server.Wait()
+	_, err = net.Dial(addrs[0].Network(), addrs[0].String())
+	assert.NotNil(t, err)
+}
+
+func TestServeInvalidListener(t *testing.T) {
+	listeners := config.GlobalConfig.ServerOpts.Listeners
+	defer func() {
+		config.GlobalConfig.ServerOpts.Listeners = listeners
+	}()
+	config.GlobalConfig.ServerOpts.Listeners = append(listeners[:0:0], listeners...)
+	config.GlobalConfig.ServerOpts.Listeners[0].Address = "127.0.0.1:0"
+	config.GlobalConfig.ServerOpts.Listeners[1].Network = "udp"
+
+	_, err := Serve()
+	assert.NotNil(t, err)
+}
+
 func TestServeConn(t *testing.T) {
 	// mock connection and request
 	arg := rrdb.NewMetaQueryCfgArgs()
@@ -68,7 +148,7 @@ func TestServeConn(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		serveConn(conn, "127.0.0.1:56789")
+		serveConn(context.Background(), newClientConn(conn, "127.0.0.1:56789", ""), nil)
 		wg.Done()
 	}()
 	wg.Wait()
@@ -85,3 +165,332 @@ func TestServeConn(t *testing.T) {
 	}
 
 }
+
+// registerSlowQueryConfigRPC registers a handler that notifies `started` and then blocks until `release`
+// is closed or the request is cancelled.
+func registerSlowQueryConfigRPC(resp *replication.QueryCfgResponse, started chan<- struct{}, release <-chan struct{}) {
+	Register("RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX", &MethodDefinition{
+		RequestCreator: func() RequestArgs {
+			return &rrdb.MetaQueryCfgArgs{
+				Query: replication.NewQueryCfgRequest(),
+			}
+		},
+		Handler: func(ctx context.Context, ra RequestArgs) ResponseResult {
+			started <- struct{}{}
+			select {
+			case <-release:
+				return &rrdb.MetaQueryCfgResult{Success: resp}
+			case <-ctx.Done():
+				return &rrdb.MetaQueryCfgResult{Success: &replication.QueryCfgResponse{
+					Err: &base.ErrorCode{Errno: base.ERR_TIMEOUT.String()},
+				}}
+			}
+		},
+	})
+}
+
+func startTestServer(t *testing.T) (*Server, net.Conn) {
+	listeners := config.GlobalConfig.ServerOpts.Listeners
+	defer func() {
+		config.GlobalConfig.ServerOpts.Listeners = listeners
+	}()
+	config.GlobalConfig.ServerOpts.Listeners = append(listeners[:0:0], listeners[0])
+	config.GlobalConfig.ServerOpts.Listeners[0].Address = "127.0.0.1:0"
+
+	server, err := Serve()
+	assert.Nil(t, err)
+	conn, err := net.Dial("tcp", server.Addrs()[0].String())
+	assert.Nil(t, err)
+	return server, conn
+}
+
+// TestServerGracefulShutdown ensures the ongoing requests are fully responded during shutdown.
+func TestServerGracefulShutdown(t *testing.T) {
+	resp := &replication.QueryCfgResponse{
+		Err:            &base.ErrorCode{Errno: "ERR_OK"},
+		AppID:          3,
+		PartitionCount: 128,
+		Partitions:     []*replication.PartitionConfiguration{},
+	}
+	reqCnt := 20
+	started := make(chan struct{}, reqCnt)
+	release := make(chan struct{})
+	registerSlowQueryConfigRPC(resp, started, release)
+	defer unregisterAllRPC()
+
+	server, conn := startTestServer(t)
+	defer conn.Close()
+
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "test", PartitionIndices: []int32{}}
+	for i := 0; i < reqCnt; i++ {
+		rcall, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(i), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+		_, err := conn.Write(rcall.RawReq)
+		assert.Nil(t, err)
+	}
+	// wait until all the requests are being handled
+	for i := 0; i < reqCnt; i++ {
+		<-started
+	}
+
+	shutdownErr := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+	// the server must be waiting for the ongoing requests
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("server shutdown before the requests are responded: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	assert.Nil(t, <-shutdownErr)
+
+	clientConn := rpc.NewFakeRpcConn(conn, nil)
+	for i := 0; i < reqCnt; i++ {
+		rcall, err := session.ReadRpcResponse(clientConn, session.NewPegasusCodec())
+		assert.Nil(t, err)
+		assert.Equal(t, *resp, *rcall.Result.(*rrdb.MetaQueryCfgResult).Success)
+	}
+	// the connection is closed after all responses are sent
+	_, err := conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, server.ConnectionCount())
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	registerSlowQueryConfigRPC(nil, started, make(chan struct{}))
+	defer unregisterAllRPC()
+
+	server, conn := startTestServer(t)
+	defer conn.Close()
+
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "test", PartitionIndices: []int32{}}
+	rcall, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+	_, err := conn.Write(rcall.RawReq)
+	assert.Nil(t, err)
+	<-started
+
+	// the request never completes, so it's cancelled when the deadline is exceeded
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+	assert.Equal(t, 0, server.ConnectionCount())
+}
+
+// TestServeConnBadRequest ensures the client gets an error response for the unhandled request,
+// and the connection keeps serving the following requests.
+func TestServeConnBadRequest(t *testing.T) {
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "test", PartitionIndices: []int32{}}
+	unknown, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, arg, "RPC_CM_UNKNOWN")
+	known, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(2), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+	resp := &replication.QueryCfgResponse{Err: &base.ErrorCode{Errno: "ERR_OK"}, Partitions: []*replication.PartitionConfiguration{}}
+	registerQueryConfigRPC(resp)
+	defer unregisterAllRPC()
+
+	// the trailing garbage corrupts the stream, so the connection is closed without more responses
+	var reqBuf []byte
+	reqBuf = append(reqBuf, unknown.RawReq...)
+	reqBuf = append(reqBuf, known.RawReq...)
+	reqBuf = append(reqBuf, []byte("garbage")...)
+	reqBuf = append(reqBuf, known.RawReq...)
+	conn := newFakeConn(reqBuf)
+	serveConn(context.Background(), newClientConn(conn, "127.0.0.1:56789", ""), nil)
+
+	clientConn := rpc.NewFakeRpcConn(conn.wbuf, nil)
+	rcall, err := session.ReadRpcResponse(clientConn, session.NewPegasusCodec())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), rcall.SeqId)
+	assert.Equal(t, base.ERR_HANDLER_NOT_FOUND, rcall.Err)
+
+	rcall, err = session.ReadRpcResponse(clientConn, session.NewPegasusCodec())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), rcall.SeqId)
+	assert.Equal(t, *resp, *rcall.Result.(*rrdb.MetaQueryCfgResult).Success)
+	assert.Equal(t, 0, conn.wbuf.Len())
+}
+
+// falconCounterName returns the name of falcon counter with the default tags in the example config.
+func falconCounterName(name string, tags ...string) string {
+	return name + "," + strings.Join(tags, ",") + ",region=local_tst,service=meta_proxy"
+}
+
+func TestServeConnMetrics(t *testing.T) {
+	method := "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX"
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "test", PartitionIndices: []int32{}}
+	unknown, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, arg, "RPC_CM_UNKNOWN")
+	known, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(2), &base.Gpid{}, arg, method)
+	resp := &replication.QueryCfgResponse{Err: &base.ErrorCode{Errno: "ERR_OK"}, Partitions: []*replication.PartitionConfiguration{}}
+	registerQueryConfigRPC(resp)
+	defer unregisterAllRPC()
+
+	requestCount := falconCounterName("client_request_count", "method="+method)
+	unknownCount := falconCounterName("client_request_count", "method=unknown")
+	notFoundCount := falconCounterName("client_request_failed_count", "method=unknown", "error=ERR_HANDLER_NOT_FOUND")
+	corruptCount := falconCounterName("client_request_failed_count", "method=unknown", "error=ERR_INVALID_DATA")
+	inFlight := falconCounterName("client_request_in_flight", "method="+method)
+	requestSize := falconCounterName("client_request_size", "method="+method)
+	responseSize := falconCounterName("client_response_size", "method="+method)
+	latency := falconCounterName("client_request_latency", "method="+method)
+	meters := []string{requestCount, unknownCount, notFoundCount, corruptCount}
+	histograms := []string{requestSize, responseSize, latency}
+	before := make(map[string]int64)
+	for _, name := range meters {
+		before[name] = falcon.GetMeterCount(name)
+	}
+	for _, name := range histograms {
+		before[name] = falcon.GetHistogramCount(name)
+	}
+	inFlightBefore := falcon.GetCounterCount(inFlight)
+
+	var reqBuf []byte
+	reqBuf = append(reqBuf, unknown.RawReq...)
+	reqBuf = append(reqBuf, known.RawReq...)
+	reqBuf = append(reqBuf, known.RawReq...)
+	reqBuf = append(reqBuf, []byte("garbage")...)
+	conn := newFakeConn(reqBuf)
+	serveConn(context.Background(), newClientConn(conn, "127.0.0.1:56789", ""), nil)
+
+	assert.Equal(t, int64(2), falcon.GetMeterCount(requestCount)-before[requestCount])
+	assert.Equal(t, int64(1), falcon.GetMeterCount(unknownCount)-before[unknownCount])
+	assert.Equal(t, int64(1), falcon.GetMeterCount(notFoundCount)-before[notFoundCount])
+	assert.Equal(t, int64(1), falcon.GetMeterCount(corruptCount)-before[corruptCount])
+	for _, name := range histograms {
+		assert.Equal(t, int64(2), falcon.GetHistogramCount(name)-before[name], name)
+	}
+	assert.Equal(t, int64(len(known.RawReq)), falcon.GetHistogramMax(requestSize))
+	assert.Equal(t, inFlightBefore, falcon.GetCounterCount(inFlight))
+}
+
+func TestServeConnTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(provider)
+
+	method := "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX"
+	resp := &replication.QueryCfgResponse{Err: &base.ErrorCode{Errno: "ERR_OK"}, Partitions: []*replication.PartitionConfiguration{}}
+	Register(method, &MethodDefinition{
+		RequestCreator: func() RequestArgs {
+			return &rrdb.MetaQueryCfgArgs{Query: replication.NewQueryCfgRequest()}
+		},
+		Handler: func(ctx context.Context, ra RequestArgs) ResponseResult {
+			_, span := tracing.Start(ctx, "handler")
+			span.End()
+			return &rrdb.MetaQueryCfgResult{Success: resp}
+		},
+	})
+	defer unregisterAllRPC()
+
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "test", PartitionIndices: []int32{}}
+	known, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(7), &base.Gpid{}, arg, method)
+	conn := newFakeConn(known.RawReq)
+	serveConn(context.Background(), newClientConn(conn, "127.0.0.1:56789", ""), nil)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 2, len(spans))
+	child, root := spans[0], spans[1]
+	assert.Equal(t, "handler", child.Name())
+	assert.Equal(t, root.SpanContext().SpanID(), child.Parent().SpanID())
+	assert.Equal(t, serveSpanName, root.Name())
+	assert.False(t, root.Parent().IsValid())
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		tracing.MethodKey.String(method),
+		tracing.SeqIDKey.Int64(7),
+		tracing.PeerKey.String("127.0.0.1:56789"),
+	}, root.Attributes())
+	assert.Equal(t, codes.Unset, root.Status().Code)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// default_request_timeout: 3000, max_request_timeout: 10000
+	assert.Equal(t, 3*time.Second, requestTimeout(0))
+	assert.Equal(t, 100*time.Millisecond, requestTimeout(100*time.Millisecond))
+	assert.Equal(t, 10*time.Second, requestTimeout(time.Minute))
+}
+
+// TestServeConnDropTimeoutResponse ensures the request is cancelled when the client timeout
+// expires, and its response is dropped.
+func TestServeConnDropTimeoutResponse(t *testing.T) {
+	resp := &replication.QueryCfgResponse{Err: &base.ErrorCode{Errno: "ERR_OK"}, Partitions: []*replication.PartitionConfiguration{}}
+	deadlines := make(chan time.Duration, 2)
+	Register("RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX", &MethodDefinition{
+		RequestCreator: func() RequestArgs {
+			return &rrdb.MetaQueryCfgArgs{Query: replication.NewQueryCfgRequest()}
+		},
+		Handler: func(ctx context.Context, ra RequestArgs) ResponseResult {
+			deadline, _ := ctx.Deadline()
+			deadlines <- time.Until(deadline)
+			if ra.(*rrdb.MetaQueryCfgArgs).Query.AppName == "slow" {
+				<-ctx.Done()
+			}
+			return &rrdb.MetaQueryCfgResult{Success: resp}
+		},
+	})
+	defer unregisterAllRPC()
+
+	server, conn := startTestServer(t)
+	defer server.Close()
+	defer conn.Close()
+
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "slow", PartitionIndices: []int32{}}
+	slow, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+	binary.BigEndian.PutUint32(slow.RawReq[32:36], 100) // client timeout in v0 header
+	arg.Query = &replication.QueryCfgRequest{AppName: "fast", PartitionIndices: []int32{}}
+	fast, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(2), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+
+	_, err := conn.Write(slow.RawReq)
+	assert.Nil(t, err)
+	assert.True(t, <-deadlines <= 100*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	_, err = conn.Write(fast.RawReq)
+	assert.Nil(t, err)
+	assert.True(t, <-deadlines > time.Second) // default timeout
+
+	// the response of the slow request is dropped
+	rcall, err := session.ReadRpcResponse(rpc.NewFakeRpcConn(conn, nil), session.NewPegasusCodec())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), rcall.SeqId)
+}
+
+// TestServeConnPassthrough ensures the unregistered methods are handled by the fallback handler, whose
+// response is relayed to client as is.
+func TestServeConnPassthrough(t *testing.T) {
+	resp := &replication.QueryCfgResponse{Err: &base.ErrorCode{Errno: "ERR_OK"}, Partitions: []*replication.PartitionConfiguration{}}
+	RegisterFallback(func(ctx context.Context, methodName string, body []byte) ([]byte, error) {
+		if methodName != "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX" {
+			return nil, base.ERR_CLUSTER_NOT_FOUND
+		}
+		// mock the raw response frame from meta server
+		buf := bytes.NewBuffer(nil)
+		enc := &responseEncoder{writer: buf}
+		err := enc.sendResponse(&pegasusRequest{methodName: methodName, seqID: 1}, &rrdb.MetaQueryCfgResult{Success: resp})
+		return buf.Bytes(), err
+	})
+	defer unregisterAllRPC()
+
+	arg := rrdb.NewMetaQueryCfgArgs()
+	arg.Query = &replication.QueryCfgRequest{AppName: "test", PartitionIndices: []int32{}}
+	forwarded, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(1), &base.Gpid{}, arg, "RPC_CM_QUERY_PARTITION_CONFIG_BY_INDEX")
+	failed, _ := session.MarshallPegasusRpc(session.NewPegasusCodec(), int32(2), &base.Gpid{}, arg, "RPC_CM_LIST_APPS")
+	conn := newFakeConn(append(append([]byte{}, forwarded.RawReq...), failed.RawReq...))
+	serveConn(context.Background(), newClientConn(conn, "127.0.0.1:56789", ""), nil)
+
+	clientConn := rpc.NewFakeRpcConn(conn.wbuf, nil)
+	results := make(map[int32]*session.PegasusRpcCall)
+	for i := 0; i < 2; i++ {
+		rcall, err := session.ReadRpcResponse(clientConn, session.NewPegasusCodec())
+		assert.Nil(t, err)
+		results[rcall.SeqId] = rcall
+	}
+	assert.Equal(t, *resp, *results[1].Result.(*rrdb.MetaQueryCfgResult).Success)
+	assert.Equal(t, base.ERR_CLUSTER_NOT_FOUND, results[2].Err)
+}
@@ -35,6 +35,15 @@ cd $PEGASUS_PKG
 ./run.sh start_onebox -w
 cd ../
 
+# the etcd route store tests run the etcd binary
+ETCD_VER="v3.5.4"
+ETCD_PKG="etcd-${ETCD_VER}-linux-amd64"
+if [ ! -f $ETCD_PKG.tar.gz ]; then
+    wget --quiet https://github.com/etcd-io/etcd/releases/download/${ETCD_VER}/$ETCD_PKG.tar.gz
+    tar xf $ETCD_PKG.tar.gz
+fi
+export ETCD_BIN="$(pwd)/$ETCD_PKG/etcd"
+
 GO111MODULE=on make build
 ./bin/echo > /dev/null 2>&1 & # run echoserver in the background, drop its stderr/stdout
 
@@ -0,0 +1,129 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package tracing reports the OpenTelemetry spans of the client requests, which show where the time of a slow
+// request goes, e.g. the route store, the connection setup or the meta server.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/pegasus-kv/meta-proxy"
+
+// The attributes of the spans.
+var (
+	MethodKey    = attribute.Key("rpc.method")
+	SeqIDKey     = attribute.Key("rpc.seq_id")
+	PeerKey      = attribute.Key("net.peer.name")
+	TableKey     = attribute.Key("pegasus.table")
+	ClusterKey   = attribute.Key("pegasus.cluster")
+	MetaAddrsKey = attribute.Key("pegasus.meta_addrs")
+)
+
+var (
+	provider *sdktrace.TracerProvider
+	// file is the output of exporter "file"
+	file *os.File
+)
+
+// Init sets up the exporter configured by `tracing`. The spans are dropped if the exporter is "none".
+func Init() error {
+	opts := config.GlobalConfig.TracingOpts
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Exporter {
+	case "none":
+		return nil
+	case "otlp":
+		clientOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(opts.Endpoint)}
+		if opts.Insecure {
+			clientOpts = append(clientOpts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), clientOpts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		file, err = os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open trace file \"%s\": %s", opts.File, err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return fmt.Errorf("no support trace exporter: %s", opts.Exporter)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create trace exporter %s: %s", opts.Exporter, err)
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(opts.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	logrus.Infof("tracing is enabled, exporter: %s", opts.Exporter)
+	return nil
+}
+
+// Close exports the pending spans and stops the exporter. It's called when the proxy exits.
+func Close(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	err := provider.Shutdown(ctx)
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	provider = nil
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		file = nil
+	}
+	return err
+}
+
+// Start starts a span as the child of the span in ctx, it must be ended by End.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End marks the span as failed if err is not nil, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
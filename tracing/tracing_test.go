@@ -0,0 +1,112 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pegasus-kv/meta-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	config.Init("../config/yaml/meta-proxy-example.yml")
+}
+
+// exportedSpan is the part of the span written by exporter "file"
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	Parent struct {
+		SpanID string
+	}
+	Attributes []struct {
+		Key   string
+		Value struct {
+			Value interface{}
+		}
+	}
+	Status struct {
+		Code        string
+		Description string
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta-proxy-trace")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opts := config.GlobalConfig.TracingOpts
+	defer func() {
+		config.GlobalConfig.TracingOpts = opts
+	}()
+	config.GlobalConfig.TracingOpts.Exporter = "file"
+	config.GlobalConfig.TracingOpts.File = filepath.Join(dir, "trace.json")
+
+	assert.Nil(t, Init())
+	ctx, root := Start(context.Background(), "root", TableKey.String("temp"))
+	_, child := Start(ctx, "child")
+	End(child, errors.New("not found"))
+	End(root, nil)
+	assert.Nil(t, Close(context.Background()))
+	assert.Nil(t, Close(context.Background()))
+
+	file, err := os.Open(config.GlobalConfig.TracingOpts.File)
+	assert.Nil(t, err)
+	defer file.Close()
+	var spans []exportedSpan
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var span exportedSpan
+		assert.Nil(t, decoder.Decode(&span))
+		spans = append(spans, span)
+	}
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, "Error", spans[0].Status.Code)
+	assert.Equal(t, "not found", spans[0].Status.Description)
+	assert.Equal(t, "root", spans[1].Name)
+	assert.Equal(t, spans[1].SpanContext.TraceID, spans[0].SpanContext.TraceID)
+	assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].Parent.SpanID)
+	assert.Equal(t, 1, len(spans[1].Attributes))
+	assert.Equal(t, "pegasus.table", spans[1].Attributes[0].Key)
+	assert.Equal(t, "temp", spans[1].Attributes[0].Value.Value)
+}
+
+func TestInitNone(t *testing.T) {
+	assert.Equal(t, "none", config.GlobalConfig.TracingOpts.Exporter)
+	assert.Nil(t, Init())
+	assert.Nil(t, provider)
+
+	// the spans are dropped without exporter
+	_, span := Start(context.Background(), "dropped")
+	assert.False(t, span.IsRecording())
+	End(span, nil)
+	assert.Nil(t, Close(context.Background()))
+}